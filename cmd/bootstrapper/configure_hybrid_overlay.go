@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/openshift/windows-machine-config-bootstrapper/pkg/bootstrapper"
+)
+
+var (
+	// configureHybridOverlayCmd describes the configure-hybrid-overlay command
+	configureHybridOverlayCmd = &cobra.Command{
+		Use:   "configure-hybrid-overlay",
+		Short: "Configures the hybrid-overlay-node service",
+		Long: "Creates or updates the hybrid-overlay-node service, which sets up the OVN-Kubernetes hybrid overlay " +
+			"network on the Windows node, and starts it. initialize-kubelet must be run first.",
+		Run: runConfigureHybridOverlayCmd,
+	}
+
+	// configureHybridOverlayOpts holds the options of the configure-hybrid-overlay command
+	configureHybridOverlayOpts struct {
+		// installDir is the directory the kubelet is installed to
+		installDir string
+		// hybridOverlayPath is the location of the hybrid-overlay-node binary
+		hybridOverlayPath string
+		// vxlanPort is the VXLAN port of the hybrid overlay network
+		vxlanPort string
+		// platformType is the type of the platform where the cluster is deployed
+		platformType string
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(configureHybridOverlayCmd)
+	configureHybridOverlayCmd.PersistentFlags().StringVar(&configureHybridOverlayOpts.installDir, "install-dir",
+		"c:\\k", "Kubelet file location to bootstrap the Windows node. Defaults to C:\\k")
+	configureHybridOverlayCmd.PersistentFlags().StringVar(&configureHybridOverlayOpts.hybridOverlayPath,
+		"hybrid-overlay-path", "c:\\k\\hybrid-overlay-node.exe", "Location of the hybrid-overlay-node binary")
+	configureHybridOverlayCmd.PersistentFlags().StringVar(&configureHybridOverlayOpts.vxlanPort, "vxlan-port", "",
+		"VXLAN port of the hybrid overlay network. If unset, the hybrid-overlay-node default is used.")
+	configureHybridOverlayCmd.PersistentFlags().StringVar(&configureHybridOverlayOpts.platformType, "platform-type",
+		"", "Type of the platform where the cluster is deployed. Example: AWS, Azure, GCP")
+}
+
+// runConfigureHybridOverlayCmd configures the hybrid-overlay-node service on the Windows node
+func runConfigureHybridOverlayCmd(cmd *cobra.Command, args []string) {
+	flag.Parse()
+	wmcb, err := bootstrapper.NewWinNodeBootstrapper(configureHybridOverlayOpts.installDir, "", "", "", "", "",
+		configureHybridOverlayOpts.platformType)
+	if err != nil {
+		log.Error(err, "could not create bootstrapper")
+		os.Exit(1)
+	}
+
+	if err = wmcb.ConfigureHybridOverlay(configureHybridOverlayOpts.hybridOverlayPath,
+		configureHybridOverlayOpts.vxlanPort); err != nil {
+		log.Error(err, "could not configure hybrid-overlay-node")
+		os.Exit(1)
+	}
+
+	// Send success message to StdOut to ascertain that the hybrid-overlay-node configuration was successful
+	os.Stdout.WriteString("hybrid-overlay-node configured successfully")
+
+	if err = wmcb.Disconnect(); err != nil {
+		log.Error(err, "can't clean up bootstrapper")
+	}
+}
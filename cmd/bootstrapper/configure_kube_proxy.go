@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/openshift/windows-machine-config-bootstrapper/pkg/bootstrapper"
+)
+
+var (
+	// configureKubeProxyCmd describes the configure-kube-proxy command
+	configureKubeProxyCmd = &cobra.Command{
+		Use:   "configure-kube-proxy",
+		Short: "Configures the kube-proxy service",
+		Long: "Creates or updates the kube-proxy service, which programs the Services of the cluster into the HNS " +
+			"network of the pods, and starts it. configure-hybrid-overlay must be run first.",
+		Run: runConfigureKubeProxyCmd,
+		PreRunE: func(cmd *cobra.Command, _ []string) error {
+			return cmd.MarkPersistentFlagRequired("source-vip")
+		},
+	}
+
+	// configureKubeProxyOpts holds the options of the configure-kube-proxy command
+	configureKubeProxyOpts struct {
+		// installDir is the directory the kubelet is installed to
+		installDir string
+		// kubeProxyPath is the location of the kube-proxy binary
+		kubeProxyPath string
+		// networkName is the name of the HNS network kube-proxy programs the Services into
+		networkName string
+		// sourceVIP is the IP of the HNS endpoint the node uses to reach the pods
+		sourceVIP string
+		// clusterCIDR is the CIDR of the pods of the cluster
+		clusterCIDR string
+		// platformType is the type of the platform where the cluster is deployed
+		platformType string
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(configureKubeProxyCmd)
+	configureKubeProxyCmd.PersistentFlags().StringVar(&configureKubeProxyOpts.installDir, "install-dir",
+		"c:\\k", "Kubelet file location to bootstrap the Windows node. Defaults to C:\\k")
+	configureKubeProxyCmd.PersistentFlags().StringVar(&configureKubeProxyOpts.kubeProxyPath, "kube-proxy-path",
+		"c:\\k\\kube-proxy.exe", "Location of the kube-proxy binary")
+	configureKubeProxyCmd.PersistentFlags().StringVar(&configureKubeProxyOpts.networkName, "network-name",
+		bootstrapper.DefaultHNSNetworkName, "Name of the HNS network created by hybrid-overlay-node")
+	configureKubeProxyCmd.PersistentFlags().StringVar(&configureKubeProxyOpts.sourceVIP, "source-vip", "",
+		"IP of the HNS endpoint the node uses to reach the pods over the overlay network")
+	configureKubeProxyCmd.PersistentFlags().StringVar(&configureKubeProxyOpts.clusterCIDR, "cluster-cidr", "",
+		"CIDR of the pods of the cluster. If unset, kube-proxy does not distinguish cluster traffic.")
+	configureKubeProxyCmd.PersistentFlags().StringVar(&configureKubeProxyOpts.platformType, "platform-type",
+		"", "Type of the platform where the cluster is deployed. Example: AWS, Azure, GCP")
+}
+
+// runConfigureKubeProxyCmd configures the kube-proxy service on the Windows node
+func runConfigureKubeProxyCmd(cmd *cobra.Command, args []string) {
+	flag.Parse()
+	wmcb, err := bootstrapper.NewWinNodeBootstrapper(configureKubeProxyOpts.installDir, "", "", "", "", "",
+		configureKubeProxyOpts.platformType)
+	if err != nil {
+		log.Error(err, "could not create bootstrapper")
+		os.Exit(1)
+	}
+
+	if err = wmcb.ConfigureKubeProxy(configureKubeProxyOpts.kubeProxyPath, configureKubeProxyOpts.networkName,
+		configureKubeProxyOpts.sourceVIP, configureKubeProxyOpts.clusterCIDR); err != nil {
+		log.Error(err, "could not configure kube-proxy")
+		os.Exit(1)
+	}
+
+	// Send success message to StdOut to ascertain that the kube-proxy configuration was successful
+	os.Stdout.WriteString("kube-proxy configured successfully")
+
+	if err = wmcb.Disconnect(); err != nil {
+		log.Error(err, "can't clean up bootstrapper")
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"flag"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/openshift/windows-machine-config-bootstrapper/pkg/bootstrapper"
 	"github.com/spf13/cobra"
@@ -16,11 +18,14 @@ var (
 			"If this command is run after configure-cni is executed, it will overwrite the CNI options.",
 		Run: runInitializeKubeletCmd,
 		PreRunE: func(cmd *cobra.Command, _ []string) error {
-			err := cmd.MarkPersistentFlagRequired("ignition-file")
-			if err != nil {
-				return err
+			// The ignition can be given through a MachineConfig instead of the ignition file
+			if !cmd.Flags().Changed("machine-config") {
+				err := cmd.MarkPersistentFlagRequired("ignition-file")
+				if err != nil {
+					return err
+				}
 			}
-			err = cmd.MarkPersistentFlagRequired("kubelet-path")
+			err := cmd.MarkPersistentFlagRequired("kubelet-path")
 			if err != nil {
 				return err
 			}
@@ -31,6 +36,8 @@ var (
 	initializeKubeletOpts struct {
 		// The location of the ignition file
 		ignitionFile string
+		// The location of the worker MachineConfig, whose embedded ignition is used instead of the ignition file
+		machineConfig string
 		// The location where the kubelet.exe has been downloaded to
 		kubeletPath string
 		// kubeletVerbosity represents the log level for kubelet
@@ -39,32 +46,160 @@ var (
 		installDir string
 		// nodeIP directs the kubelet to use a specific IP for the node object
 		nodeIP string
-		// clusterDNS is the IP address of the DNS server used for all containers
+		// clusterDNS is the comma separated list of IP addresses of the DNS servers used for all containers
 		clusterDNS string
 		// platformType contains type of the platform where the cluster is deployed
 		platformType string
+		// enforceNodeAllocatable is the list of node allocatable enforcement levels for the kubelet
+		enforceNodeAllocatable []string
+		// tlsCipherSuites is the list of cipher suites allowed for the kubelet's serving TLS
+		tlsCipherSuites []string
+		// tlsMinVersion is the minimum TLS version supported by the kubelet's server
+		tlsMinVersion string
+		// maxPods is the maximum number of pods the kubelet runs
+		maxPods int
+		// systemReservedCPU is the CPU reserved for system daemons
+		systemReservedCPU string
+		// systemReservedMemory is the memory reserved for system daemons
+		systemReservedMemory string
+		// staticPodDir is the directory where the kubelet looks for static pod manifests
+		staticPodDir string
+		// logDir is the directory the kubelet log is written to
+		logDir string
+		// logFileMaxSize is the size in MB at which the kubelet log file is rotated
+		logFileMaxSize int
+		// streamingConnectionIdleTimeout is the idle time after which the kubelet closes streaming connections
+		streamingConnectionIdleTimeout time.Duration
+		// startCordoned registers the node with the cordoned taint
+		startCordoned bool
+		// machineConfigPool is the name of the machine config pool the node is labelled with
+		machineConfigPool string
+		// nodeLabels are extra labels applied to the node
+		nodeLabels map[string]string
+		// registerWithTaints are extra taints the node registers with
+		registerWithTaints []string
+		// containerRuntimeEndpoint is the endpoint of the container runtime used by the kubelet
+		containerRuntimeEndpoint string
+		// runtimeServiceName is the name of the container runtime service the kubelet service depends on
+		runtimeServiceName string
+		// extraKubeletArgs are args given to the kubelet, overriding the generated args with the same name
+		extraKubeletArgs []string
+		// serviceMode determines how an existing or missing kubelet service is handled
+		serviceMode string
+		// checkDNS enables checking that the cluster DNS server is reachable before setting up the kubelet
+		checkDNS bool
+		// checkAPIServer enables checking that the API server is reachable before setting up the kubelet
+		checkAPIServer bool
+		// containerdPath is the location of the containerd binary
+		containerdPath string
+		// minContainerdVersion is the minimum containerd version required to set up the kubelet
+		minContainerdVersion string
+		// archiveKubeletLog preserves the log of an existing kubelet service
+		archiveKubeletLog bool
+		// dryRun validates the inputs and prints the kubelet args without setting up the kubelet
+		dryRun bool
 	}
 )
 
 func init() {
 	rootCmd.AddCommand(initializeKubeletCmd)
-	initializeKubeletCmd.PersistentFlags().StringVar(&initializeKubeletOpts.ignitionFile, "ignition-file", "",
-		"Ignition file location to bootstrap the Windows node")
 	initializeKubeletCmd.PersistentFlags().StringVar(&initializeKubeletOpts.kubeletPath, "kubelet-path", "",
 		"Kubelet file location to bootstrap the Windows node")
-	initializeKubeletCmd.PersistentFlags().StringVar(&initializeKubeletOpts.kubeletVerbosity, "kubelet-verbosity",
+	initializeKubeletCmd.PersistentFlags().StringVar(&initializeKubeletOpts.serviceMode, "service-mode",
+		bootstrapper.ServiceModeEnsure, "How an existing kubelet service is handled. Possible values: "+
+			bootstrapper.ServiceModeCreate+" fails if the service exists, "+bootstrapper.ServiceModeUpdate+
+			" fails if the service does not exist, "+bootstrapper.ServiceModeEnsure+" creates or updates the service.")
+	initializeKubeletCmd.PersistentFlags().BoolVar(&initializeKubeletOpts.checkDNS, "check-dns", false,
+		"Check that the cluster DNS server is reachable before setting up the kubelet service. "+
+			"Requires --cluster-dns to be set.")
+	initializeKubeletCmd.PersistentFlags().BoolVar(&initializeKubeletOpts.checkAPIServer, "check-api-server", false,
+		"Check that the API server of the bootstrap kubeconfig in the ignition file is reachable before setting up "+
+			"the kubelet service. An existing kubelet service is left untouched if the check fails.")
+	initializeKubeletCmd.PersistentFlags().StringVar(&initializeKubeletOpts.containerdPath, "containerd-path",
+		"c:\\k\\containerd\\containerd.exe", "Location of the containerd binary whose version is checked")
+	initializeKubeletCmd.PersistentFlags().StringVar(&initializeKubeletOpts.minContainerdVersion,
+		"min-containerd-version", "", "Minimum containerd version compatible with the kubelet, e.g. 1.6.8. "+
+			"If unset, the containerd version is not checked.")
+	initializeKubeletCmd.PersistentFlags().BoolVar(&initializeKubeletOpts.archiveKubeletLog, "archive-kubelet-log",
+		false, "Archive the log of an existing kubelet service to kubelet.log.<timestamp> before restarting it, "+
+			"so that the logs of each initialization are kept apart")
+	initializeKubeletCmd.PersistentFlags().BoolVar(&initializeKubeletOpts.dryRun, "dry-run", false,
+		"Validate the inputs and print the generated kubelet args without setting up the kubelet service. No network "+
+			"checks or metadata server lookups are done, so the --hostname-override arg is left out")
+	addKubeletConfigFlags(initializeKubeletCmd)
+}
+
+// addKubeletConfigFlags adds the flags used to generate the kubelet service arguments and configuration to the given
+// command
+func addKubeletConfigFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&initializeKubeletOpts.ignitionFile, "ignition-file", "",
+		"Ignition file location to bootstrap the Windows node")
+	cmd.PersistentFlags().StringVar(&initializeKubeletOpts.machineConfig, "machine-config", "",
+		"Location of a worker MachineConfig, in YAML or JSON, whose embedded ignition is used to bootstrap the "+
+			"Windows node instead of the ignition file")
+	cmd.PersistentFlags().StringVar(&initializeKubeletOpts.kubeletVerbosity, "kubelet-verbosity",
 		"", "Represents the log level for kubelet. If unset, will use the value in the kubelet' systemd unit "+
 			"file, if any, or default to "+bootstrapper.KubeletDefaultVerbosity)
-	initializeKubeletCmd.PersistentFlags().StringVar(&initializeKubeletOpts.installDir, "install-dir", "c:\\k",
+	cmd.PersistentFlags().StringVar(&initializeKubeletOpts.installDir, "install-dir", "c:\\k",
 		"Kubelet file location to bootstrap the Windows node. Defaults to C:\\k")
-	initializeKubeletCmd.PersistentFlags().StringVar(&initializeKubeletOpts.nodeIP, "node-ip", "",
+	cmd.PersistentFlags().StringVar(&initializeKubeletOpts.nodeIP, "node-ip", "",
 		"nodeIP is the IP that should be used as the node object's IP. "+
 			"If unset, kubelet will determine the IP itself.")
-	initializeKubeletCmd.PersistentFlags().StringVar(&initializeKubeletOpts.clusterDNS, "cluster-dns", "",
-		"The DNS server IP passed to kubelet, that will be used to configure all containers for DNS resolution. "+
-			"If unset, kubelet will determine the DNS server to use.")
-	initializeKubeletCmd.PersistentFlags().StringVar(&initializeKubeletOpts.platformType, "platform-type", "",
+	cmd.PersistentFlags().StringVar(&initializeKubeletOpts.clusterDNS, "cluster-dns", "",
+		"Comma separated list of DNS server IPs passed to kubelet, that will be used to configure all containers "+
+			"for DNS resolution, e.g. 172.30.0.10,fd02::a for dual-stack clusters. If unset, kubelet will determine the DNS server to use.")
+	cmd.PersistentFlags().StringVar(&initializeKubeletOpts.platformType, "platform-type", "",
 		"Type of the platform where the cluster is deployed. Example: AWS, Azure, GCP")
+	cmd.PersistentFlags().StringSliceVar(&initializeKubeletOpts.enforceNodeAllocatable,
+		"enforce-node-allocatable", nil, "Comma separated list of node allocatable levels to be enforced by the "+
+			"kubelet. Valid values are pods and none. The system-reserved and kube-reserved levels are not supported "+
+			"on Windows, which has no cgroups. If unset, nothing is enforced.")
+	cmd.PersistentFlags().StringSliceVar(&initializeKubeletOpts.tlsCipherSuites,
+		"tls-cipher-suites", nil, "Comma separated list of cipher suites allowed for the kubelet's server. "+
+			"If unset, the kubelet default cipher suites will be used.")
+	cmd.PersistentFlags().StringVar(&initializeKubeletOpts.tlsMinVersion, "tls-min-version", "",
+		"Minimum TLS version supported by the kubelet's server. Possible values: VersionTLS10, VersionTLS11, "+
+			"VersionTLS12, VersionTLS13. If unset, the kubelet default will be used.")
+	cmd.PersistentFlags().IntVar(&initializeKubeletOpts.maxPods, "max-pods", 0,
+		"Maximum number of pods the kubelet runs. If unset, defaults to 250.")
+	cmd.PersistentFlags().StringVar(&initializeKubeletOpts.systemReservedCPU, "system-reserved-cpu", "",
+		"CPU reserved for system daemons, e.g. 1000m. If unset, defaults to 500m.")
+	cmd.PersistentFlags().StringVar(&initializeKubeletOpts.systemReservedMemory, "system-reserved-memory", "",
+		"Memory reserved for system daemons, e.g. 2Gi. If unset, defaults to 1Gi.")
+	cmd.PersistentFlags().StringVar(&initializeKubeletOpts.staticPodDir, "static-pod-dir", "",
+		"Directory where the kubelet looks for static pod manifests. If unset, defaults to "+
+			"etc\\kubernetes\\manifests in the install directory.")
+	cmd.PersistentFlags().StringVar(&initializeKubeletOpts.logDir, "kubelet-log-dir", "",
+		"Directory the kubelet log is written to. If unset, defaults to \\var\\log\\kubelet on the drive of the "+
+			"install directory.")
+	cmd.PersistentFlags().IntVar(&initializeKubeletOpts.logFileMaxSize, "kubelet-log-file-max-size", 0,
+		"Size in MB at which the kubelet log file is rotated. If unset, the kubelet default of 1800 is used.")
+	cmd.PersistentFlags().DurationVar(&initializeKubeletOpts.streamingConnectionIdleTimeout,
+		"streaming-connection-idle-timeout", 0,
+		"Idle time after which the kubelet closes streaming connections, such as exec and port-forward sessions, "+
+			"e.g. 10m. If unset, defaults to 5m.")
+	cmd.PersistentFlags().BoolVar(&initializeKubeletOpts.startCordoned, "start-cordoned", false,
+		"Register the node with the node.openshift.io/cordoned=true:NoSchedule taint, so that no workloads are "+
+			"scheduled on it until the taint is removed from the node.")
+	cmd.PersistentFlags().StringVar(&initializeKubeletOpts.machineConfigPool, "machine-config-pool", "",
+		"Name of the machine config pool the node belongs to. The node is labelled with "+
+			"machineconfiguration.openshift.io/pool=<name> when it registers.")
+	cmd.PersistentFlags().StringToStringVar(&initializeKubeletOpts.nodeLabels, "node-labels", nil,
+		"Extra labels applied to the node when it registers, as comma separated key=value pairs, e.g. "+
+			"topology.kubernetes.io/zone=us-east-1a. The node.openshift.io/os_id label cannot be overridden.")
+	cmd.PersistentFlags().StringSliceVar(&initializeKubeletOpts.registerWithTaints, "register-with-taints", nil,
+		"Comma separated list of extra taints, in the form key=value:effect, the node registers with. The "+
+			"os=Windows taint is always applied, with the NoSchedule effect unless os=Windows is given with other "+
+			"effects. The os key is reserved for os=Windows, and no two taints may have the same key and effect.")
+	cmd.PersistentFlags().StringVar(&initializeKubeletOpts.containerRuntimeEndpoint, "container-runtime-endpoint", "",
+		"Endpoint of the container runtime used by the kubelet, as a npipe:// or tcp:// URL. If unset, defaults to "+
+			"npipe://./pipe/containerd-containerd.")
+	cmd.PersistentFlags().StringVar(&initializeKubeletOpts.runtimeServiceName, "runtime-service-name", "",
+		"Name of the Windows service of the container runtime the kubelet service depends on. If unset, defaults to "+
+			"containerd, or docker for the Docker engine pipe. The dependency is omitted if the service is not installed.")
+	cmd.PersistentFlags().StringArrayVar(&initializeKubeletOpts.extraKubeletArgs, "extra-kubelet-arg", nil,
+		"Extra arg, in the form --name=value, given to the kubelet. Can be repeated. Takes precedence over the args "+
+			"generated by WMCB and derived from the ignition file, and over earlier extra args with the same name.")
 }
 
 // runInitializeKubeletCmd starts the Windows Machine Config Bootstrapper
@@ -75,17 +210,56 @@ func runInitializeKubeletCmd(cmd *cobra.Command, args []string) {
 	wmcb, err := bootstrapper.NewWinNodeBootstrapper(initializeKubeletOpts.installDir,
 		initializeKubeletOpts.ignitionFile, initializeKubeletOpts.kubeletPath, initializeKubeletOpts.kubeletVerbosity,
 		initializeKubeletOpts.nodeIP, initializeKubeletOpts.clusterDNS,
-		initializeKubeletOpts.platformType)
+		initializeKubeletOpts.platformType,
+		bootstrapper.WithEnforceNodeAllocatable(initializeKubeletOpts.enforceNodeAllocatable),
+		bootstrapper.WithTLSConfig(initializeKubeletOpts.tlsCipherSuites, initializeKubeletOpts.tlsMinVersion),
+		bootstrapper.WithMaxPods(initializeKubeletOpts.maxPods),
+		bootstrapper.WithSystemReserved(initializeKubeletOpts.systemReservedCPU,
+			initializeKubeletOpts.systemReservedMemory),
+		bootstrapper.WithStaticPodDir(initializeKubeletOpts.staticPodDir),
+		bootstrapper.WithLogDir(initializeKubeletOpts.logDir),
+		bootstrapper.WithLogFileMaxSize(initializeKubeletOpts.logFileMaxSize),
+		bootstrapper.WithStreamingConnectionIdleTimeout(initializeKubeletOpts.streamingConnectionIdleTimeout),
+		bootstrapper.WithStartCordoned(initializeKubeletOpts.startCordoned),
+		bootstrapper.WithMachineConfigPool(initializeKubeletOpts.machineConfigPool),
+		bootstrapper.WithNodeLabels(initializeKubeletOpts.nodeLabels),
+		bootstrapper.WithRegisterWithTaints(initializeKubeletOpts.registerWithTaints),
+		bootstrapper.WithExtraKubeletArgs(initializeKubeletOpts.extraKubeletArgs),
+		bootstrapper.WithMachineConfig(initializeKubeletOpts.machineConfig),
+		bootstrapper.WithContainerRuntimeEndpoint(initializeKubeletOpts.containerRuntimeEndpoint),
+		bootstrapper.WithRuntimeServiceName(initializeKubeletOpts.runtimeServiceName),
+		bootstrapper.WithServiceMode(initializeKubeletOpts.serviceMode),
+		bootstrapper.WithKubeletLogArchive(initializeKubeletOpts.archiveKubeletLog),
+		bootstrapper.WithDNSCheck(initializeKubeletOpts.checkDNS),
+		bootstrapper.WithAPIServerCheck(initializeKubeletOpts.checkAPIServer),
+		bootstrapper.WithContainerdVersionCheck(initializeKubeletOpts.containerdPath,
+			initializeKubeletOpts.minContainerdVersion))
 	if err != nil {
 		log.Error(err, "could not create bootstrapper")
 		os.Exit(1)
 	}
 
-	err = wmcb.InitializeKubelet()
+	if initializeKubeletOpts.dryRun {
+		kubeletArgs, err := wmcb.Validate()
+		if err != nil {
+			log.Error(err, "validation failed")
+			os.Exit(1)
+		}
+		os.Stdout.WriteString(strings.Join(kubeletArgs, " "))
+		if err = wmcb.Disconnect(); err != nil {
+			log.Error(err, "can't clean up bootstrapper")
+		}
+		return
+	}
+
+	result, err := wmcb.InitializeKubelet()
 	if err != nil {
 		log.Error(err, "could not run bootstrapper")
 		os.Exit(1)
 	} else {
+		if !result.Changed {
+			log.Info("kubelet is already initialized with the given configuration, it was not restarted")
+		}
 		// Send success message to StdOut for WSU to ascertain that bootstrapping was successful
 		os.Stdout.WriteString("Bootstrapping completed successfully")
 	}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/openshift/windows-machine-config-bootstrapper/pkg/bootstrapper"
+)
+
+var (
+	// reconcileKubeletCmd describes the reconcile command
+	reconcileKubeletCmd = &cobra.Command{
+		Use:   "reconcile",
+		Short: "Ensures an initialized kubelet matches the desired configuration",
+		Long: "Compares the kubelet service arguments and environment, the kubelet configuration and the cloud " +
+			"config against the ones generated from the given options and ignition file, applies any differences " +
+			"and restarts the kubelet if needed. The kubelet must have been initialized with initialize-kubelet " +
+			"beforehand.",
+		Run: runReconcileKubeletCmd,
+		PreRunE: func(cmd *cobra.Command, _ []string) error {
+			// The ignition can be given through a MachineConfig instead of the ignition file
+			if cmd.Flags().Changed("machine-config") {
+				return nil
+			}
+			return cmd.MarkPersistentFlagRequired("ignition-file")
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(reconcileKubeletCmd)
+	addKubeletConfigFlags(reconcileKubeletCmd)
+}
+
+// runReconcileKubeletCmd reconciles the kubelet service on the Windows node with the desired configuration
+func runReconcileKubeletCmd(cmd *cobra.Command, args []string) {
+	flag.Parse()
+
+	wmcb, err := bootstrapper.NewWinNodeBootstrapper(initializeKubeletOpts.installDir,
+		initializeKubeletOpts.ignitionFile, "", initializeKubeletOpts.kubeletVerbosity,
+		initializeKubeletOpts.nodeIP, initializeKubeletOpts.clusterDNS,
+		initializeKubeletOpts.platformType,
+		bootstrapper.WithEnforceNodeAllocatable(initializeKubeletOpts.enforceNodeAllocatable),
+		bootstrapper.WithTLSConfig(initializeKubeletOpts.tlsCipherSuites, initializeKubeletOpts.tlsMinVersion),
+		bootstrapper.WithMaxPods(initializeKubeletOpts.maxPods),
+		bootstrapper.WithSystemReserved(initializeKubeletOpts.systemReservedCPU,
+			initializeKubeletOpts.systemReservedMemory),
+		bootstrapper.WithStaticPodDir(initializeKubeletOpts.staticPodDir),
+		bootstrapper.WithLogDir(initializeKubeletOpts.logDir),
+		bootstrapper.WithLogFileMaxSize(initializeKubeletOpts.logFileMaxSize),
+		bootstrapper.WithStreamingConnectionIdleTimeout(initializeKubeletOpts.streamingConnectionIdleTimeout),
+		bootstrapper.WithStartCordoned(initializeKubeletOpts.startCordoned),
+		bootstrapper.WithMachineConfigPool(initializeKubeletOpts.machineConfigPool),
+		bootstrapper.WithNodeLabels(initializeKubeletOpts.nodeLabels),
+		bootstrapper.WithRegisterWithTaints(initializeKubeletOpts.registerWithTaints),
+		bootstrapper.WithExtraKubeletArgs(initializeKubeletOpts.extraKubeletArgs),
+		bootstrapper.WithMachineConfig(initializeKubeletOpts.machineConfig),
+		bootstrapper.WithContainerRuntimeEndpoint(initializeKubeletOpts.containerRuntimeEndpoint),
+		bootstrapper.WithRuntimeServiceName(initializeKubeletOpts.runtimeServiceName))
+	if err != nil {
+		log.Error(err, "could not create bootstrapper")
+		os.Exit(1)
+	}
+
+	changed, err := wmcb.ReconcileKubelet()
+	if err != nil {
+		log.Error(err, "could not reconcile kubelet")
+		os.Exit(1)
+	}
+	if changed {
+		os.Stdout.WriteString("kubelet reconciled successfully")
+	} else {
+		os.Stdout.WriteString("no changes, kubelet is already in sync")
+	}
+
+	if err = wmcb.Disconnect(); err != nil {
+		log.Error(err, "can't clean up bootstrapper")
+	}
+}
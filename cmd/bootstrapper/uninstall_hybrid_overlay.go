@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/openshift/windows-machine-config-bootstrapper/pkg/bootstrapper"
+)
+
+var (
+	// uninstallHybridOverlayCmd describes the uninstall-hybrid-overlay command
+	uninstallHybridOverlayCmd = &cobra.Command{
+		Use:   "uninstall-hybrid-overlay",
+		Short: "Stops and removes the hybrid-overlay-node service",
+		Long:  "Stops and removes the hybrid-overlay-node service",
+		Run:   runUninstallHybridOverlayCmd,
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(uninstallHybridOverlayCmd)
+}
+
+// runUninstallHybridOverlayCmd uninstalls the hybrid-overlay-node service from the Windows node
+func runUninstallHybridOverlayCmd(cmd *cobra.Command, args []string) {
+	flag.Parse()
+	wmcb, err := bootstrapper.NewWinNodeBootstrapper("", "", "", "", "", "",
+		"")
+	if err != nil {
+		log.Error(err, "could not create bootstrapper")
+		os.Exit(1)
+	}
+
+	if err = wmcb.UninstallHybridOverlay(); err != nil {
+		log.Error(err, "could not uninstall hybrid-overlay-node")
+		os.Exit(1)
+	}
+
+	// Send success message to StdOut to ascertain that the hybrid-overlay-node removal was successful
+	os.Stdout.WriteString("hybrid-overlay-node uninstalled successfully")
+
+	if err = wmcb.Disconnect(); err != nil {
+		log.Error(err, "can't clean up bootstrapper")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/openshift/windows-machine-config-bootstrapper/pkg/bootstrapper"
+)
+
+var (
+	// uninstallKubeProxyCmd describes the uninstall-kube-proxy command
+	uninstallKubeProxyCmd = &cobra.Command{
+		Use:   "uninstall-kube-proxy",
+		Short: "Stops and removes the kube-proxy service",
+		Long:  "Stops and removes the kube-proxy service",
+		Run:   runUninstallKubeProxyCmd,
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(uninstallKubeProxyCmd)
+}
+
+// runUninstallKubeProxyCmd uninstalls the kube-proxy service from the Windows node
+func runUninstallKubeProxyCmd(cmd *cobra.Command, args []string) {
+	flag.Parse()
+	wmcb, err := bootstrapper.NewWinNodeBootstrapper("", "", "", "", "", "",
+		"")
+	if err != nil {
+		log.Error(err, "could not create bootstrapper")
+		os.Exit(1)
+	}
+
+	if err = wmcb.UninstallKubeProxy(); err != nil {
+		log.Error(err, "could not uninstall kube-proxy")
+		os.Exit(1)
+	}
+
+	// Send success message to StdOut to ascertain that the kube-proxy removal was successful
+	os.Stdout.WriteString("kube-proxy uninstalled successfully")
+
+	if err = wmcb.Disconnect(); err != nil {
+		log.Error(err, "can't clean up bootstrapper")
+	}
+}
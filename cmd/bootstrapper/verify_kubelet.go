@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/openshift/windows-machine-config-bootstrapper/pkg/bootstrapper"
+)
+
+var (
+	// verifyKubeletCmd describes the verify-kubelet command
+	verifyKubeletCmd = &cobra.Command{
+		Use:   "verify-kubelet",
+		Short: "Verifies the running kubelet service",
+		Long: "Verifies that the running kubelet service was started with the cloud provider expected for the " +
+			"platform type",
+		Run: runVerifyKubeletCmd,
+	}
+
+	// verifyKubeletOpts holds the options of the verify-kubelet command
+	verifyKubeletOpts struct {
+		// platformType is the type of the platform where the cluster is deployed
+		platformType string
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(verifyKubeletCmd)
+	verifyKubeletCmd.PersistentFlags().StringVar(&verifyKubeletOpts.platformType, "platform-type", "",
+		"Type of the platform where the cluster is deployed. Example: AWS, Azure, GCP")
+}
+
+// runVerifyKubeletCmd verifies the kubelet service of the Windows node
+func runVerifyKubeletCmd(cmd *cobra.Command, args []string) {
+	flag.Parse()
+	wmcb, err := bootstrapper.NewWinNodeBootstrapper("", "", "", "", "", "",
+		verifyKubeletOpts.platformType)
+	if err != nil {
+		log.Error(err, "could not create bootstrapper")
+		os.Exit(1)
+	}
+
+	if err = wmcb.VerifyCloudProvider(); err != nil {
+		log.Error(err, "kubelet verification failed")
+		os.Exit(1)
+	}
+
+	os.Stdout.WriteString("kubelet verified successfully")
+
+	if err = wmcb.Disconnect(); err != nil {
+		log.Error(err, "can't clean up bootstrapper")
+	}
+}
@@ -13,6 +13,7 @@ replace (
 require (
 	github.com/aws/aws-sdk-go-v2/config v1.10.0
 	github.com/aws/aws-sdk-go-v2/feature/ec2/imds v1.8.0
+	github.com/coreos/go-semver v0.3.0
 	github.com/coreos/ign-converter v0.0.0-20200825151652-ea20012f9844
 	github.com/coreos/ignition v0.35.0
 	github.com/coreos/ignition/v2 v2.6.0
@@ -22,6 +23,7 @@ require (
 	github.com/stretchr/testify v1.7.0
 	github.com/vincent-petithory/dataurl v0.0.0-20160330182126-9a301d65acbb
 	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f
+	gopkg.in/yaml.v3 v3.0.1
 	k8s.io/apimachinery v0.25.2
 	sigs.k8s.io/controller-runtime v0.13.0
 )
@@ -37,7 +39,6 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/sso v1.6.0 // indirect
 	github.com/aws/aws-sdk-go-v2/service/sts v1.9.0 // indirect
 	github.com/aws/smithy-go v1.9.0 // indirect
-	github.com/coreos/go-semver v0.3.0 // indirect
 	github.com/coreos/go-systemd v0.0.0-20190321100706-95778dfbb74e // indirect
 	github.com/coreos/go-systemd/v22 v22.0.0 // indirect
 	github.com/coreos/vcontext v0.0.0-20190529201340-22b159166068 // indirect
@@ -59,7 +60,6 @@ require (
 	golang.org/x/text v0.3.7 // indirect
 	gopkg.in/inf.v0 v0.9.1 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 	k8s.io/api v0.25.2 // indirect
 	k8s.io/klog/v2 v2.70.1 // indirect
 	k8s.io/utils v0.0.0-20220728103510-ee6ede2d64ed // indirect
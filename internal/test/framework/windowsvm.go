@@ -2,6 +2,7 @@ package framework
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"strings"
@@ -26,6 +27,11 @@ const (
 // https://issues.redhat.com/browse/WINC-245
 var cloudProvider providers.CloudProvider
 
+// connectTimeout is the maximum time allowed to establish the ssh connection to the Windows VMs, so that a filtered
+// port fails fast instead of hanging the test suite
+var connectTimeout = flag.Duration("connect-timeout", windows.DefaultConnectTimeout,
+	"Maximum time allowed to establish the ssh connection to the Windows VMs")
+
 // TestWindowsVM is the interface for interacting with a Windows VM in the test framework. This will hold the
 // specialized information related to test suite
 type TestWindowsVM interface {
@@ -127,7 +133,7 @@ func (f *TestFramework) newWindowsMachineSet(vmCount int, skipVMSetup bool) ([]T
 	}
 
 	for i, machine := range provisionedMachines {
-		winVM := &windows.Windows{}
+		winVM := &windows.Windows{ConnectTimeout: *connectTimeout}
 
 		ipAddress := ""
 		for _, address := range machine.Status.Addresses {
@@ -1,15 +1,18 @@
 package aws
 
 import (
+	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"k8s.io/apimachinery/pkg/util/rand"
-	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	awssession "github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -19,6 +22,7 @@ import (
 	core "k8s.io/api/core/v1"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
 	awsprovider "sigs.k8s.io/cluster-api-provider-aws/pkg/apis/awsprovider/v1beta1"
 
 	"github.com/openshift/windows-machine-config-bootstrapper/internal/test/clusterinfo"
@@ -31,59 +35,235 @@ const (
 	windowsLabel = "machine.openshift.io/os-id"
 	// instanceType is the AWS specific instance type to create the VM with
 	instanceType = "m5a.large"
+	// capaClusterTagKeyPrefix is the prefix of the cluster ownership tag key used by the cluster-api-provider-aws
+	capaClusterTagKeyPrefix = "sigs.k8s.io/cluster-api-provider-aws/cluster/"
+	// capaRoleTagKey is the tag key used by the cluster-api-provider-aws to identify the role of a resource
+	capaRoleTagKey = "sigs.k8s.io/cluster-api-provider-aws/role"
+	// capaNodeRoleTagValue is the role tag value of the resources belonging to the worker nodes
+	capaNodeRoleTagValue = "node"
 )
 
+// workerSGName is the name of the security group of the cluster worker nodes. It is used as a fallback when the
+// security group cannot be discovered by its tags, as in shared-VPC clusters.
+var workerSGName = flag.String("worker-sg-name", "", "Name of the security group of the cluster worker nodes, "+
+	"used when it cannot be discovered by its tags")
+
+// securityGroupID is the ID of a pre-created security group given to the Windows instances, instead of the discovered
+// worker security group, for accounts where the worker security group cannot be used
+var securityGroupID = flag.String("security-group-id", "", "ID of the security group of the cluster VPC given to "+
+	"the Windows instances, used instead of the discovered worker security group")
+
+// workerInstanceProfileARN is the ARN of the instance profile of the cluster worker nodes. It is used instead of the
+// instance profile derived from the infrastructure ID, in accounts where the worker instance profile is named differently.
+var workerInstanceProfileARN = flag.String("worker-instance-profile-arn", "", "ARN of the instance profile of the "+
+	"cluster worker nodes, used instead of the <infraID>-worker-profile instance profile")
+
+// spot makes the Windows instances run as interruptible AWS Spot instances
+var spot = flag.Bool("spot", false, "Run the Windows instances as Spot instances")
+
+// spotMaxPrice is the maximum hourly price of the Spot instances, the On-Demand price if unset
+var spotMaxPrice = flag.String("spot-max-price", "", "Maximum hourly price in USD of the Spot instances, "+
+	"defaults to the On-Demand price. Requires -spot.")
+
+// vpcID is the ID of the VPC of the cluster. It is used instead of the VPC discovered by the infrastructure ID tag,
+// which is ambiguous in shared accounts with several VPCs carrying the tag.
+var vpcID = flag.String("vpc-id", "", "ID of the VPC of the cluster, used instead of the VPC tagged with the "+
+	"infrastructure ID")
+
+// subnetID is the ID of the subnet the Windows instances are created in. It is used instead of the discovered private
+// subnet, in clusters with custom subnet naming or to pin the instances to an availability zone.
+var subnetID = flag.String("subnet-id", "", "ID of the subnet of the cluster VPC to create the Windows instances "+
+	"in, used instead of the discovered private subnet")
+
+// rootVolumeSize, rootVolumeType and rootVolumeIOPS configure the root EBS volume of the Windows instances, which
+// otherwise is the small volume of the AMI that throttles while pulling container images
+var (
+	rootVolumeSize = flag.Int64("root-volume-size", 0, "Size in GiB of the root volume of the Windows instances, "+
+		"defaults to the size of the AMI root volume")
+	rootVolumeType = flag.String("root-volume-type", "gp3", "EBS volume type of the root volume of the Windows "+
+		"instances. Possible values: gp2, gp3, io1, io2, standard")
+	rootVolumeIOPS = flag.Int64("root-volume-iops", 0, "Provisioned IOPS of the root volume of the Windows "+
+		"instances. Required for io1 and io2 volumes, only allowed for gp3, io1 and io2 volumes.")
+)
+
+// windowsVersion is the Windows Server version of the AMI the Windows instances are created from
+var windowsVersion = flag.String("windows-version", "2019", "Windows Server version of the AMI of the Windows "+
+	"instances. Possible values: 2019, 2022")
+
+// windowsAMINameFilters are the name filters of the latest released "Windows Server with Containers" AMIs, per Windows
+// Server version. The '?' match any character, as the AMIs are named with their creation date, e.g.
+// Windows_Server-2019-English-Full-ContainersLatest-2020.01.15.
+// The images of each version are only compatible with test container images of the same version, e.g.
+// "mcr.microsoft.com/powershell:lts-nanoserver-1809" for 2019. If the filters change, the test container images also
+// need to be changed.
+var windowsAMINameFilters = map[string]string{
+	"2019": "Windows_Server-2019-English-Full-ContainersLatest-????.??.??",
+	"2022": "Windows_Server-2022-English-Full-ContainersLatest-????.??.??",
+}
+
+// rootVolumeTypes are the EBS volume types that can be used as a root volume
+var rootVolumeTypes = []string{"gp2", "gp3", "io1", "io2", "standard"}
+
+// nameTemplate is the template of the MachineSet name, from which the names of the Windows instances are derived, for
+// clusters with a naming policy. The {infraID}, {zone} and {rand} placeholders are replaced by the infrastructure ID,
+// the availability zone and a random string.
+var nameTemplate = flag.String("name-template", "", "Template of the MachineSet name the Windows instances are "+
+	"named after, with the {infraID}, {zone} and {rand} placeholders")
+
+// checkDescribePermissions checks that the worker role is allowed the EC2 describe actions the kubelet uses to
+// look up its instance before the MachineSet is generated, so that a role missing them is reported before the Windows
+// instances fail to join. The volume and load balancer actions are performed by the control plane, not by the
+// workers, and are not checked.
+var checkDescribePermissions = flag.Bool("check-worker-describe-permissions", false, "Check that the worker "+
+	"IAM role is allowed the EC2 describe actions the kubelet uses to look up its instance before creating the "+
+	"Windows instances. Requires the iam:SimulatePrincipalPolicy permission.")
+
+// workerDescribeActions are the EC2 describe actions the kubelet and the in-tree AWS cloud provider perform with the
+// worker role to look up the instance of the Windows node
+var workerDescribeActions = []string{
+	"ec2:DescribeInstances",
+	"ec2:DescribeRegions",
+}
+
+// iamAPI is the subset of the IAM client used by the provider, allowing it to be faked in tests
+type iamAPI interface {
+	GetInstanceProfile(*iam.GetInstanceProfileInput) (*iam.GetInstanceProfileOutput, error)
+	GetRole(*iam.GetRoleInput) (*iam.GetRoleOutput, error)
+	ListInstanceProfilesForRole(*iam.ListInstanceProfilesForRoleInput) (*iam.ListInstanceProfilesForRoleOutput, error)
+	SimulatePrincipalPolicyPages(*iam.SimulatePrincipalPolicyInput, func(*iam.SimulatePolicyResponse, bool) bool) error
+}
+
+// awsProviderOptions holds the options the AWS provider is created with
+type awsProviderOptions struct {
+	// credentialPath is the path of the AWS credentials file, the default AWS credential chain is used if empty
+	credentialPath string
+	// credentialAccountID is the profile of the AWS credentials file used to create the instances
+	credentialAccountID string
+	// instanceType is the flavor of VM to be used
+	instanceType string
+	// region in which the Machine needs to be created
+	region string
+	// sshKeyPair is the key pair associated with the Windows VM
+	sshKeyPair string
+	// workerSGName is the name of the worker security group, used if it cannot be found by its tags
+	workerSGName string
+	// workerInstanceProfileARN is the ARN of the worker instance profile, used instead of the derived one if set
+	workerInstanceProfileARN string
+	// spot makes the instances run as Spot instances
+	spot bool
+	// spotMaxPrice is the maximum hourly price of the Spot instances, the On-Demand price if unset
+	spotMaxPrice string
+	// nameTemplate is the template of the MachineSet name, the default name is used if unset
+	nameTemplate string
+	// subnetID is the ID of the subnet the instances are created in, the private subnet is discovered if unset
+	subnetID string
+	// rootVolumeSize is the size in GiB of the root volume, the size of the AMI root volume if 0
+	rootVolumeSize int64
+	// rootVolumeIOPS is the provisioned IOPS of the root volume, the volume type default if 0
+	rootVolumeIOPS int64
+	// rootVolumeType is the EBS volume type of the root volume
+	rootVolumeType string
+	// vpcID is the ID of the cluster VPC, the VPC is discovered by its tags if unset
+	vpcID string
+	// securityGroupID is the ID of the security group of the instances, the worker one is discovered if unset
+	securityGroupID string
+	// windowsVersion is the Windows Server version of the AMI the instances are created from
+	windowsVersion string
+	// checkDescribePermissions checks the worker role is allowed workerDescribeActions before generating the MachineSet
+	checkDescribePermissions bool
+}
+
 type awsProvider struct {
 	// imageID is the AMI image-id that is used to create new Virtual Machines
 	imageID string
-	// instanceType is the flavor of VM to be used
-	instanceType string
 	// A client for IAM.
-	iam *iam.IAM
+	iam iamAPI
 	// A client for EC2. to query Windows AMI images
 	ec2 ec2iface.EC2API
 	// openShiftClient is the client of the existing OpenShift cluster.
 	openShiftClient *clusterinfo.OpenShift
-	// region in which the Machine needs to be created
-	region string
-	// sshKeyPair is the key pair associated with the Windows VM
-	sshKeyPair string
+	awsProviderOptions
 }
 
-// newSession uses AWS credentials to create and returns a session for interacting with EC2.
+// newSession uses AWS credentials to create and returns a session for interacting with EC2. If no credentials file is
+// given, the credentials are resolved by the default AWS credential chain, from the environment variables, the shared
+// configuration or the instance role.
 func newSession(credentialPath, credentialAccountID, region string) (*awssession.Session, error) {
+	if credentialPath == "" {
+		return awssession.NewSession(&aws.Config{Region: aws.String(region)})
+	}
 	if _, err := os.Stat(credentialPath); err != nil {
 		return nil, fmt.Errorf("failed to find AWS credentials from path '%v'", credentialPath)
 	}
+	if err := validateCredentialsProfile(credentialPath, credentialAccountID); err != nil {
+		return nil, err
+	}
 	return awssession.NewSession(&aws.Config{
 		Credentials: credentials.NewSharedCredentials(credentialPath, credentialAccountID),
 		Region:      aws.String(region),
 	})
 }
 
+// validateCredentialsProfile ensures that the given profile is defined in the AWS shared credentials file, so that
+// a misspelled or missing profile is reported up front instead of surfacing as an opaque API error later on
+func validateCredentialsProfile(credentialPath, profile string) error {
+	f, err := os.Open(credentialPath)
+	if err != nil {
+		return fmt.Errorf("unable to open AWS credentials file %s: %v", credentialPath, err)
+	}
+	defer f.Close()
+
+	var profiles []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "[") || !strings.HasSuffix(line, "]") {
+			continue
+		}
+		section := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "["), "]"))
+		if section == profile {
+			return nil
+		}
+		profiles = append(profiles, section)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read AWS credentials file %s: %v", credentialPath, err)
+	}
+	return fmt.Errorf("profile %s not found in credentials file %s, available profiles: [%s]", profile,
+		credentialPath, strings.Join(profiles, ", "))
+}
+
 // newAWSProvider returns the AWS implementations of the Cloud interface with AWS session in the same region as OpenShift Cluster.
-// credentialPath is the file path the AWS credentials file.
-// credentialAccountID is the account name the user uses to create VM instance.
-// The credentialAccountID should exist in the AWS credentials file pointing at one specific credential.
-func newAWSProvider(openShiftClient *clusterinfo.OpenShift, credentialPath,
-	credentialAccountID, instanceType, region, sshKeyPair string) (*awsProvider, error) {
-	session, err := newSession(credentialPath, credentialAccountID, region)
+// The credentialAccountID of the options should exist in the AWS credentials file pointing at one specific credential.
+func newAWSProvider(openShiftClient *clusterinfo.OpenShift, options awsProviderOptions) (*awsProvider, error) {
+	if options.spotMaxPrice != "" {
+		if !options.spot {
+			return nil, fmt.Errorf("a Spot maximum price is given without requesting Spot instances")
+		}
+		if _, err := strconv.ParseFloat(options.spotMaxPrice, 64); err != nil {
+			return nil, fmt.Errorf("invalid Spot maximum price %s: %v", options.spotMaxPrice, err)
+		}
+	}
+	if err := validateRootVolume(options.rootVolumeSize, options.rootVolumeIOPS, options.rootVolumeType); err != nil {
+		return nil, err
+	}
+	session, err := newSession(options.credentialPath, options.credentialAccountID, options.region)
 	if err != nil {
 		return nil, fmt.Errorf("could not create new AWS session: %v", err)
 	}
 	ec2Client := ec2.New(session, aws.NewConfig())
 	iamClient := iam.New(session, aws.NewConfig())
-	imageID, err := getLatestWindowsAMI(ec2Client)
+	imageID, err := getLatestWindowsAMI(ec2Client, options.windowsVersion)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get latest Windows AMI: %v", err)
 	}
 
-	return &awsProvider{imageID, instanceType,
-		iamClient,
-		ec2Client,
-		openShiftClient,
-		region,
-		sshKeyPair,
+	return &awsProvider{
+		imageID:            imageID,
+		iam:                iamClient,
+		ec2:                ec2Client,
+		openShiftClient:    openShiftClient,
+		awsProviderOptions: options,
 	}, nil
 }
 
@@ -93,12 +273,28 @@ func SetupAWSCloudProvider(region, sshKeyPair string) (*awsProvider, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize OpenShift client with error: %v", err)
 	}
-	// awsCredentials is set by OpenShift CI
-	awsCredentials := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
-	if awsCredentials == "" {
-		return nil, fmt.Errorf("AWS_SHARED_CREDENTIALS_FILE env var is empty")
-	}
-	awsProvider, err := newAWSProvider(oc, awsCredentials, "default", instanceType, region, sshKeyPair)
+	awsProvider, err := newAWSProvider(oc, awsProviderOptions{
+		// awsCredentials is set by OpenShift CI. When running elsewhere, the credentials can be given through the
+		// environment variables or the instance role instead.
+		credentialPath:           os.Getenv("AWS_SHARED_CREDENTIALS_FILE"),
+		credentialAccountID:      "default",
+		instanceType:             instanceType,
+		region:                   region,
+		sshKeyPair:               sshKeyPair,
+		workerSGName:             *workerSGName,
+		workerInstanceProfileARN: *workerInstanceProfileARN,
+		spot:                     *spot,
+		spotMaxPrice:             *spotMaxPrice,
+		nameTemplate:             *nameTemplate,
+		subnetID:                 *subnetID,
+		rootVolumeSize:           *rootVolumeSize,
+		rootVolumeIOPS:           *rootVolumeIOPS,
+		rootVolumeType:           *rootVolumeType,
+		vpcID:                    *vpcID,
+		securityGroupID:          *securityGroupID,
+		windowsVersion:           *windowsVersion,
+		checkDescribePermissions: *checkDescribePermissions,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error obtaining aws interface object: %v", err)
 	}
@@ -114,18 +310,16 @@ func (a *awsProvider) getInfraID() (string, error) {
 	return infraID, nil
 }
 
-// getLatestWindowsAMI returns the imageID of the latest released "Windows Server with Containers" image
-func getLatestWindowsAMI(ec2Client *ec2.EC2) (string, error) {
+// getLatestWindowsAMI returns the imageID of the latest released "Windows Server with Containers" image of the given
+// Windows Server version
+func getLatestWindowsAMI(ec2Client ec2iface.EC2API, windowsVersion string) (string, error) {
+	windowsAMIFilterValue, ok := windowsAMINameFilters[windowsVersion]
+	if !ok {
+		return "", fmt.Errorf("unsupported Windows Server version %s", windowsVersion)
+	}
 	// Have to create these variables, as the below functions require pointers to them
 	windowsAMIOwner := "amazon"
 	windowsAMIFilterName := "name"
-	// This filter will grab all ami's that match the exact name. The '?' indicate any character will match.
-	// The ami's will have the name format: Windows_Server-2019-English-Full-ContainersLatest-2020.01.15
-	// so the question marks will match the date of creation
-	// The image obtained by using windowsAMIFilterValue is compatible with  the test container image -
-	// "mcr.microsoft.com/powershell:lts-nanoserver-1809". If the windowsAMIFilterValue changes,
-	// the test container image also needs to be changed.
-	windowsAMIFilterValue := "Windows_Server-2019-English-Full-ContainersLatest-????.??.??"
 	searchFilter := ec2.Filter{Name: &windowsAMIFilterName, Values: []*string{&windowsAMIFilterValue}}
 
 	describedImages, err := ec2Client.DescribeImages(&ec2.DescribeImagesInput{
@@ -159,12 +353,23 @@ func getLatestWindowsAMI(ec2Client *ec2.EC2) (string, error) {
 }
 
 // getSubnet tries to find a subnet under the VPC and returns subnet or an error.
-// These subnets belongs to the OpenShift cluster.
+// These subnets belongs to the OpenShift cluster. If a subnet ID is given, that subnet is used instead, provided it
+// belongs to the cluster VPC.
 func (a *awsProvider) getSubnet(infraID string) (*ec2.Subnet, error) {
 	vpc, err := a.getVPCByInfrastructure(infraID)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get the VPC %v", err)
 	}
+
+	offerings, err := a.getWindowsInstanceOfferings()
+	if err != nil {
+		return nil, err
+	}
+
+	if a.subnetID != "" {
+		return a.getSubnetByID(*vpc.VpcId, offerings)
+	}
+
 	// search subnet by the vpcid owned by the vpcID
 	subnets, err := a.ec2.DescribeSubnets(&ec2.DescribeSubnetsInput{
 		Filters: []*ec2.Filter{
@@ -178,28 +383,6 @@ func (a *awsProvider) getSubnet(infraID string) (*ec2.Subnet, error) {
 		return nil, err
 	}
 
-	// Get the instance offerings that support Windows instances
-	scope := "Availability Zone"
-	productDescription := "Windows"
-	f := false
-	offerings, err := a.ec2.DescribeReservedInstancesOfferings(&ec2.DescribeReservedInstancesOfferingsInput{
-		Filters: []*ec2.Filter{
-			{
-				Name:   aws.String("scope"),
-				Values: []*string{&scope},
-			},
-		},
-		IncludeMarketplace: &f,
-		InstanceType:       &a.instanceType,
-		ProductDescription: &productDescription,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("error checking instance offerings of %s: %v", a.instanceType, err)
-	}
-	if offerings.ReservedInstancesOfferings == nil {
-		return nil, fmt.Errorf("no instance offerings returned for %s", a.instanceType)
-	}
-
 	// Finding required subnet within the vpc.
 	foundSubnet := false
 	requiredSubnet := "-private-"
@@ -212,13 +395,8 @@ func (a *awsProvider) getSubnet(infraID string) (*ec2.Subnet, error) {
 			if *tag.Key == "Name" && strings.Contains(*tag.Value, infraID+requiredSubnet) {
 				foundSubnet = true
 				// Ensure that the instance type we want is supported in the zone that the subnet is in
-				for _, instanceOffering := range offerings.ReservedInstancesOfferings {
-					if instanceOffering.AvailabilityZone == nil {
-						continue
-					}
-					if *instanceOffering.AvailabilityZone == *subnet.AvailabilityZone {
-						return subnet, nil
-					}
+				if isOfferedInZone(offerings, *subnet.AvailabilityZone) {
+					return subnet, nil
 				}
 			}
 		}
@@ -232,10 +410,80 @@ func (a *awsProvider) getSubnet(infraID string) (*ec2.Subnet, error) {
 	return nil, err
 }
 
-// getClusterWorkerSGID gets worker security group id from the existing cluster or returns an error.
-func (a *awsProvider) getClusterWorkerSGID(infraID string) (string, error) {
-	sg, err := a.ec2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+// getSubnetByID returns the subnet with the configured ID, ensuring it belongs to the given VPC and that the
+// instance type is offered in its availability zone
+func (a *awsProvider) getSubnetByID(vpcID string,
+	offerings []*ec2.ReservedInstancesOffering) (*ec2.Subnet, error) {
+	subnets, err := a.ec2.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		SubnetIds: aws.StringSlice([]string{a.subnetID}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting subnet %s: %v", a.subnetID, err)
+	}
+	if len(subnets.Subnets) != 1 {
+		return nil, fmt.Errorf("could not find subnet %s", a.subnetID)
+	}
+	subnet := subnets.Subnets[0]
+	if aws.StringValue(subnet.VpcId) != vpcID {
+		return nil, fmt.Errorf("subnet %s is in VPC %s, not in the cluster VPC %s", a.subnetID,
+			aws.StringValue(subnet.VpcId), vpcID)
+	}
+	if !isOfferedInZone(offerings, aws.StringValue(subnet.AvailabilityZone)) {
+		return nil, fmt.Errorf("subnet %s is in zone %s, which does not support %s instance type", a.subnetID,
+			aws.StringValue(subnet.AvailabilityZone), a.instanceType)
+	}
+	return subnet, nil
+}
+
+// getWindowsInstanceOfferings returns the instance offerings that support Windows instances of the instance type
+func (a *awsProvider) getWindowsInstanceOfferings() ([]*ec2.ReservedInstancesOffering, error) {
+	scope := "Availability Zone"
+	productDescription := "Windows"
+	f := false
+	offerings, err := a.ec2.DescribeReservedInstancesOfferings(&ec2.DescribeReservedInstancesOfferingsInput{
 		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("scope"),
+				Values: []*string{&scope},
+			},
+		},
+		IncludeMarketplace: &f,
+		InstanceType:       &a.instanceType,
+		ProductDescription: &productDescription,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error checking instance offerings of %s: %v", a.instanceType, err)
+	}
+	if offerings.ReservedInstancesOfferings == nil {
+		return nil, fmt.Errorf("no instance offerings returned for %s", a.instanceType)
+	}
+	return offerings.ReservedInstancesOfferings, nil
+}
+
+// isOfferedInZone returns true if one of the instance offerings is in the given availability zone
+func isOfferedInZone(offerings []*ec2.ReservedInstancesOffering, zone string) bool {
+	for _, instanceOffering := range offerings {
+		if instanceOffering.AvailabilityZone == nil {
+			continue
+		}
+		if *instanceOffering.AvailabilityZone == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// getClusterWorkerSGID gets worker security group id from the existing cluster or returns an error. The security
+// group is looked up by the installer tags, then by the cluster-api-provider-aws tags used in shared-VPC clusters,
+// and finally by the worker security group name, if given. If a security group ID is given, that security group is
+// used instead, provided it belongs to the cluster VPC.
+func (a *awsProvider) getClusterWorkerSGID(infraID string) (string, error) {
+	if a.securityGroupID != "" {
+		return a.getSecurityGroupByID(infraID)
+	}
+
+	filterSets := [][]*ec2.Filter{
+		{
 			{
 				Name:   aws.String("tag:Name"),
 				Values: aws.StringSlice([]string{fmt.Sprintf("%s-worker-sg", infraID)}),
@@ -245,18 +493,78 @@ func (a *awsProvider) getClusterWorkerSGID(infraID string) (string, error) {
 				Values: aws.StringSlice([]string{infraIDTagValue}),
 			},
 		},
+		{
+			{
+				Name:   aws.String("tag:" + capaClusterTagKeyPrefix + infraID),
+				Values: aws.StringSlice([]string{infraIDTagValue, "shared"}),
+			},
+			{
+				Name:   aws.String("tag:" + capaRoleTagKey),
+				Values: aws.StringSlice([]string{capaNodeRoleTagValue}),
+			},
+		},
+	}
+	if a.workerSGName != "" {
+		filterSets = append(filterSets, []*ec2.Filter{
+			{
+				Name:   aws.String("group-name"),
+				Values: aws.StringSlice([]string{a.workerSGName}),
+			},
+		})
+	}
+
+	for _, filters := range filterSets {
+		sg, err := a.ec2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+			Filters: filters,
+		})
+		if err != nil {
+			return "", err
+		}
+		if sg != nil && len(sg.SecurityGroups) > 0 {
+			return *sg.SecurityGroups[0].GroupId, nil
+		}
+	}
+	return "", fmt.Errorf("no security group is found for the cluster worker nodes")
+}
+
+// getSecurityGroupByID returns the ID of the configured security group, ensuring it exists in the cluster VPC
+func (a *awsProvider) getSecurityGroupByID(infraID string) (string, error) {
+	vpc, err := a.getVPCByInfrastructure(infraID)
+	if err != nil {
+		return "", fmt.Errorf("unable to get the VPC %v", err)
+	}
+	sg, err := a.ec2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		GroupIds: aws.StringSlice([]string{a.securityGroupID}),
 	})
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("error getting security group %s: %v", a.securityGroupID, err)
 	}
-	if sg == nil || len(sg.SecurityGroups) < 1 {
-		return "", fmt.Errorf("no security group is found for the cluster worker nodes")
+	if len(sg.SecurityGroups) != 1 {
+		return "", fmt.Errorf("could not find security group %s", a.securityGroupID)
 	}
-	return *sg.SecurityGroups[0].GroupId, nil
+	if aws.StringValue(sg.SecurityGroups[0].VpcId) != aws.StringValue(vpc.VpcId) {
+		return "", fmt.Errorf("security group %s is in VPC %s, not in the cluster VPC %s", a.securityGroupID,
+			aws.StringValue(sg.SecurityGroups[0].VpcId), aws.StringValue(vpc.VpcId))
+	}
+	return a.securityGroupID, nil
 }
 
-// GetVPCByInfrastructure finds the VPC of an infrastructure and returns the VPC struct or an error.
+// getVPCByInfrastructure returns the VPC of the cluster. It is the VPC with the configured ID if one is given, and
+// otherwise the VPC tagged with the infrastructure ID, which must be unique.
 func (a *awsProvider) getVPCByInfrastructure(infraID string) (*ec2.Vpc, error) {
+	if a.vpcID != "" {
+		res, err := a.ec2.DescribeVpcs(&ec2.DescribeVpcsInput{
+			VpcIds: aws.StringSlice([]string{a.vpcID}),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error getting VPC %s: %v", a.vpcID, err)
+		}
+		if len(res.Vpcs) != 1 {
+			return nil, fmt.Errorf("could not find VPC %s", a.vpcID)
+		}
+		return res.Vpcs[0], nil
+	}
+
 	res, err := a.ec2.DescribeVpcs(&ec2.DescribeVpcsInput{
 		Filters: []*ec2.Filter{
 			{
@@ -275,26 +583,110 @@ func (a *awsProvider) getVPCByInfrastructure(infraID string) (*ec2.Vpc, error) {
 	if len(res.Vpcs) < 1 {
 		return nil, fmt.Errorf("failed to find the VPC of the infrastructure")
 	} else if len(res.Vpcs) > 1 {
-		log.Printf("more than one VPC is found, using %s", *res.Vpcs[0].VpcId)
+		var vpcIDs []string
+		for _, vpc := range res.Vpcs {
+			vpcIDs = append(vpcIDs, aws.StringValue(vpc.VpcId))
+		}
+		return nil, fmt.Errorf("found more than one VPC of the infrastructure: %s, use -vpc-id to choose one",
+			strings.Join(vpcIDs, ", "))
 	}
 	return res.Vpcs[0], nil
 }
 
-// getIAMWorkerRole gets worker IAM information from the existing cluster including IAM arn or an error.
-// This function is exposed for testing purpose.
-func (a *awsProvider) getIAMWorkerRole(infraID string) (*ec2.IamInstanceProfileSpecification, error) {
+// getIAMWorkerRole returns the worker instance profile of the existing cluster, holding the worker roles
+func (a *awsProvider) getIAMWorkerRole(infraID string) (*iam.InstanceProfile, error) {
+	instanceProfile, err := a.getWorkerInstanceProfile(infraID)
+	if err != nil {
+		return nil, err
+	}
+	if len(instanceProfile.Roles) == 0 {
+		return nil, fmt.Errorf("instance profile %s has no roles", aws.StringValue(instanceProfile.InstanceProfileName))
+	}
+	return instanceProfile, nil
+}
+
+// getWorkerInstanceProfile returns the instance profile of the worker nodes. The profile given by ARN is used if set,
+// otherwise the <infraID>-worker-profile instance profile is looked up. If that profile does not exist, the instance
+// profiles associated with the <infraID>-worker-role role are used, as the profile and role can be named differently.
+func (a *awsProvider) getWorkerInstanceProfile(infraID string) (*iam.InstanceProfile, error) {
+	if a.workerInstanceProfileARN != "" {
+		// The instance profile name is the last element of the ARN resource, which may include a path
+		arnParts := strings.Split(a.workerInstanceProfileARN, "/")
+		return a.getInstanceProfile(arnParts[len(arnParts)-1])
+	}
+
+	profileName := fmt.Sprintf("%s-worker-profile", infraID)
+	instanceProfile, err := a.getInstanceProfile(profileName)
+	if err == nil || !isNoSuchEntity(err) {
+		return instanceProfile, err
+	}
+
+	roleName := fmt.Sprintf("%s-worker-role", infraID)
+	if _, err := a.iam.GetRole(&iam.GetRoleInput{RoleName: aws.String(roleName)}); err != nil {
+		if isNoSuchEntity(err) {
+			return nil, fmt.Errorf("neither the worker instance profile %s nor the worker role %s exist",
+				profileName, roleName)
+		}
+		return nil, fmt.Errorf("error getting worker role %s: %v", roleName, err)
+	}
+	profiles, err := a.iam.ListInstanceProfilesForRole(&iam.ListInstanceProfilesForRoleInput{
+		RoleName: aws.String(roleName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing instance profiles of worker role %s: %v", roleName, err)
+	}
+	if len(profiles.InstanceProfiles) == 0 {
+		return nil, fmt.Errorf("worker role %s exists but has no instance profile, use -worker-instance-profile-arn "+
+			"to give the worker instance profile", roleName)
+	}
+	return profiles.InstanceProfiles[0], nil
+}
+
+// getInstanceProfile returns the instance profile with the given name
+func (a *awsProvider) getInstanceProfile(name string) (*iam.InstanceProfile, error) {
 	iamspc, err := a.iam.GetInstanceProfile(&iam.GetInstanceProfileInput{
-		InstanceProfileName: aws.String(fmt.Sprintf("%s-worker-profile", infraID)),
+		InstanceProfileName: aws.String(name),
 	})
 	if err != nil {
 		return nil, err
 	}
-	return &ec2.IamInstanceProfileSpecification{
-		Arn: iamspc.InstanceProfile.Arn,
-		// The ARN itself is not good enough in the MachineSet spec. we need the id to map the worker
-		// IAM profile in MachineSet spec
-		Name: iamspc.InstanceProfile.InstanceProfileName,
-	}, nil
+	return iamspc.InstanceProfile, nil
+}
+
+// isNoSuchEntity returns true if the error is returned by IAM for a missing resource
+func isNoSuchEntity(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == iam.ErrCodeNoSuchEntityException
+	}
+	return false
+}
+
+// checkWorkerDescribePermissions simulates workerDescribeActions against every role of the given worker instance
+// profile and returns an error listing the denied actions
+func (a *awsProvider) checkWorkerDescribePermissions(instanceProfile *iam.InstanceProfile) error {
+	var denied []string
+	for _, role := range instanceProfile.Roles {
+		err := a.iam.SimulatePrincipalPolicyPages(&iam.SimulatePrincipalPolicyInput{
+			PolicySourceArn: role.Arn,
+			ActionNames:     aws.StringSlice(workerDescribeActions),
+		}, func(page *iam.SimulatePolicyResponse, lastPage bool) bool {
+			for _, result := range page.EvaluationResults {
+				if aws.StringValue(result.EvalDecision) != iam.PolicyEvaluationDecisionTypeAllowed {
+					denied = append(denied, fmt.Sprintf("%s (%s)", aws.StringValue(result.EvalActionName),
+						aws.StringValue(role.RoleName)))
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("error simulating policy of role %s: %v", aws.StringValue(role.RoleName), err)
+		}
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("worker IAM role is not allowed the describe actions of the kubelet: %s",
+			strings.Join(denied, ", "))
+	}
+	return nil
 }
 
 // GenerateMachineSet generates the machineset object which is aws provider specific
@@ -308,6 +700,11 @@ func (a *awsProvider) GenerateMachineSet(withWindowsLabel bool, replicas int32)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get instance profile %v", err)
 	}
+	if a.checkDescribePermissions {
+		if err = a.checkWorkerDescribePermissions(instanceProfile); err != nil {
+			return nil, err
+		}
+	}
 
 	sgID, err := a.getClusterWorkerSGID(clusterName)
 	if err != nil {
@@ -328,7 +725,16 @@ func (a *awsProvider) GenerateMachineSet(withWindowsLabel bool, replicas int32)
 		matchLabels[windowsLabel] = "Windows"
 		machineSetName = machineSetName + "with-windows-label-"
 	}
-	matchLabels["machine.openshift.io/cluster-api-machineset"] = machineSetName + *subnet.AvailabilityZone
+	selectorName := machineSetName + *subnet.AvailabilityZone
+	machineSetName = machineSetName + rand.String(4)
+	if a.nameTemplate != "" {
+		machineSetName, err = renderName(a.nameTemplate, clusterName, *subnet.AvailabilityZone, rand.String(4))
+		if err != nil {
+			return nil, fmt.Errorf("unable to render MachineSet name: %v", err)
+		}
+		selectorName = machineSetName
+	}
+	matchLabels["machine.openshift.io/cluster-api-machineset"] = selectorName
 
 	machineLabels := map[string]string{
 		"machine.openshift.io/cluster-api-machine-role": "worker",
@@ -345,7 +751,9 @@ func (a *awsProvider) GenerateMachineSet(withWindowsLabel bool, replicas int32)
 		},
 		InstanceType: a.instanceType,
 		IAMInstanceProfile: &awsprovider.AWSResourceReference{
-			ID: instanceProfile.Name,
+			// The ARN itself is not good enough in the MachineSet spec. we need the id to map the worker
+			// IAM profile in MachineSet spec
+			ID: instanceProfile.InstanceProfileName,
 		},
 		CredentialsSecret: &core.LocalObjectReference{
 			Name: "aws-cloud-credentials",
@@ -366,6 +774,10 @@ func (a *awsProvider) GenerateMachineSet(withWindowsLabel bool, replicas int32)
 		UserDataSecret: &core.LocalObjectReference{Name: "windows-user-data"},
 		KeyName:        &a.sshKeyPair,
 		PublicIP:       &publicIP,
+		// The Machine API requests a Spot instance when the Spot market options are set
+		SpotMarketOptions: a.spotMarketOptions(),
+		// A block device without a device name configures the root volume
+		BlockDevices: []awsprovider.BlockDeviceMappingSpec{{EBS: a.rootVolume()}},
 	}
 
 	rawBytes, err := json.Marshal(providerSpec)
@@ -376,7 +788,7 @@ func (a *awsProvider) GenerateMachineSet(withWindowsLabel bool, replicas int32)
 	// Set up the test machineSet
 	machineSet := &mapi.MachineSet{
 		ObjectMeta: meta.ObjectMeta{
-			Name:      machineSetName + rand.String(4),
+			Name:      machineSetName,
 			Namespace: "openshift-machine-api",
 			Labels: map[string]string{
 				mapi.MachineClusterIDLabel: clusterName,
@@ -401,3 +813,65 @@ func (a *awsProvider) GenerateMachineSet(withWindowsLabel bool, replicas int32)
 	}
 	return machineSet, nil
 }
+
+// spotMarketOptions returns the Spot market options of the Windows instances, nil if they run as On-Demand instances
+func (a *awsProvider) spotMarketOptions() *awsprovider.SpotMarketOptions {
+	if !a.spot {
+		return nil
+	}
+	options := &awsprovider.SpotMarketOptions{}
+	if a.spotMaxPrice != "" {
+		options.MaxPrice = aws.String(a.spotMaxPrice)
+	}
+	return options
+}
+
+// validateRootVolume returns an error if the root volume configuration is not supported by EBS
+func validateRootVolume(size, iops int64, volumeType string) error {
+	if size < 0 {
+		return fmt.Errorf("invalid root volume size %d", size)
+	}
+	if iops < 0 {
+		return fmt.Errorf("invalid root volume IOPS %d", iops)
+	}
+	switch volumeType {
+	case "io1", "io2":
+		if iops == 0 {
+			return fmt.Errorf("IOPS must be provisioned for %s root volumes", volumeType)
+		}
+	case "gp3":
+	case "gp2", "standard":
+		if iops != 0 {
+			return fmt.Errorf("IOPS cannot be provisioned for %s root volumes", volumeType)
+		}
+	default:
+		return fmt.Errorf("invalid root volume type %s, must be one of %s", volumeType,
+			strings.Join(rootVolumeTypes, ", "))
+	}
+	return nil
+}
+
+// rootVolume returns the EBS configuration of the root volume of the Windows instances
+func (a *awsProvider) rootVolume() *awsprovider.EBSBlockDeviceSpec {
+	volume := &awsprovider.EBSBlockDeviceSpec{VolumeType: aws.String(a.rootVolumeType)}
+	if a.rootVolumeSize != 0 {
+		volume.VolumeSize = aws.Int64(a.rootVolumeSize)
+	}
+	if a.rootVolumeIOPS != 0 {
+		volume.Iops = aws.Int64(a.rootVolumeIOPS)
+	}
+	return volume
+}
+
+// renderName replaces the placeholders of the given name template. The name must be a valid label value as the
+// MachineSet is selected by its name.
+func renderName(template, infraID, zone, random string) (string, error) {
+	name := strings.NewReplacer("{infraID}", infraID, "{zone}", zone, "{rand}", random).Replace(template)
+	if strings.ContainsAny(name, "{}") {
+		return "", fmt.Errorf("unknown placeholder in name template %s", template)
+	}
+	if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+		return "", fmt.Errorf("invalid name %s: %s", name, strings.Join(errs, ", "))
+	}
+	return name, nil
+}
@@ -0,0 +1,733 @@
+package aws
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	awsprovider "sigs.k8s.io/cluster-api-provider-aws/pkg/apis/awsprovider/v1beta1"
+)
+
+// TestValidateCredentialsProfile tests that a profile missing from the AWS credentials file is reported clearly
+func TestValidateCredentialsProfile(t *testing.T) {
+	credentialsContents := `[default]
+aws_access_key_id = dummy
+aws_secret_access_key = dummy
+
+[ci]
+aws_access_key_id = dummy
+aws_secret_access_key = dummy
+`
+	dir, err := ioutil.TempDir("", "aws")
+	require.NoError(t, err, "error creating temp directory")
+	// Ignore the return error as there is not much we can do if the temporary directory is not deleted
+	defer os.RemoveAll(dir)
+	credentialPath := filepath.Join(dir, "credentials")
+	require.NoError(t, ioutil.WriteFile(credentialPath, []byte(credentialsContents), 0600))
+
+	t.Run("profile present", func(t *testing.T) {
+		assert.NoError(t, validateCredentialsProfile(credentialPath, "ci"))
+	})
+	t.Run("profile missing", func(t *testing.T) {
+		err := validateCredentialsProfile(credentialPath, "dev")
+		require.Error(t, err, "no error when profile is missing from the credentials file")
+		assert.Contains(t, err.Error(), "profile dev not found in credentials file")
+		assert.Contains(t, err.Error(), "[default, ci]", "available profiles not listed")
+	})
+}
+
+// TestNewSession tests that the credentials are read from the given credentials file, or from the default AWS
+// credential chain if no file is given
+func TestNewSession(t *testing.T) {
+	credentialsContents := `[default]
+aws_access_key_id = file-key
+aws_secret_access_key = file-secret
+`
+	dir, err := ioutil.TempDir("", "aws")
+	require.NoError(t, err, "error creating temp directory")
+	// Ignore the return error as there is not much we can do if the temporary directory is not deleted
+	defer os.RemoveAll(dir)
+	credentialPath := filepath.Join(dir, "credentials")
+	require.NoError(t, ioutil.WriteFile(credentialPath, []byte(credentialsContents), 0600))
+	// The environment variables come first in the default credential chain, so that no instance role is looked up
+	t.Setenv("AWS_ACCESS_KEY_ID", "env-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+
+	tests := []struct {
+		name           string
+		credentialPath string
+		wantKeyID      string
+	}{
+		{
+			name:           "credentials file",
+			credentialPath: credentialPath,
+			wantKeyID:      "file-key",
+		},
+		{
+			name:      "default credential chain",
+			wantKeyID: "env-key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, err := newSession(tt.credentialPath, "default", "us-east-1")
+			require.NoError(t, err)
+			value, err := session.Config.Credentials.Get()
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantKeyID, value.AccessKeyID)
+			assert.Equal(t, "us-east-1", aws.StringValue(session.Config.Region))
+		})
+	}
+
+	t.Run("credentials file missing", func(t *testing.T) {
+		_, err := newSession(filepath.Join(dir, "missing"), "default", "us-east-1")
+		assert.Error(t, err)
+	})
+}
+
+// fakeIAM is an IAM client serving instance profiles and roles from memory, and returning fixed policy simulation
+// decisions
+type fakeIAM struct {
+	// decisions maps an IAM action to the simulated evaluation decision
+	decisions map[string]string
+	// instanceProfiles are the names of the existing instance profiles, all instance profiles exist if nil
+	instanceProfiles []string
+	// roleProfiles maps the names of the existing roles to the names of their instance profiles
+	roleProfiles map[string][]string
+}
+
+// newInstanceProfile returns an instance profile with the given name and the worker role
+func newInstanceProfile(name string) *iam.InstanceProfile {
+	return &iam.InstanceProfile{
+		Arn:                 aws.String("arn:aws:iam::123456789012:instance-profile/" + name),
+		InstanceProfileName: aws.String(name),
+		Roles: []*iam.Role{{
+			Arn:      aws.String("arn:aws:iam::123456789012:role/worker-role"),
+			RoleName: aws.String("worker-role"),
+		}},
+	}
+}
+
+func (f *fakeIAM) GetInstanceProfile(input *iam.GetInstanceProfileInput) (*iam.GetInstanceProfileOutput, error) {
+	if f.instanceProfiles != nil && !contains(f.instanceProfiles, *input.InstanceProfileName) {
+		return nil, awserr.New(iam.ErrCodeNoSuchEntityException, "instance profile not found", nil)
+	}
+	return &iam.GetInstanceProfileOutput{InstanceProfile: newInstanceProfile(*input.InstanceProfileName)}, nil
+}
+
+func (f *fakeIAM) GetRole(input *iam.GetRoleInput) (*iam.GetRoleOutput, error) {
+	if _, ok := f.roleProfiles[*input.RoleName]; !ok {
+		return nil, awserr.New(iam.ErrCodeNoSuchEntityException, "role not found", nil)
+	}
+	return &iam.GetRoleOutput{Role: &iam.Role{RoleName: input.RoleName}}, nil
+}
+
+func (f *fakeIAM) ListInstanceProfilesForRole(
+	input *iam.ListInstanceProfilesForRoleInput) (*iam.ListInstanceProfilesForRoleOutput, error) {
+	output := &iam.ListInstanceProfilesForRoleOutput{}
+	for _, name := range f.roleProfiles[*input.RoleName] {
+		output.InstanceProfiles = append(output.InstanceProfiles, newInstanceProfile(name))
+	}
+	return output, nil
+}
+
+func (f *fakeIAM) SimulatePrincipalPolicyPages(input *iam.SimulatePrincipalPolicyInput,
+	fn func(*iam.SimulatePolicyResponse, bool) bool) error {
+	page := &iam.SimulatePolicyResponse{}
+	for _, action := range input.ActionNames {
+		page.EvaluationResults = append(page.EvaluationResults, &iam.EvaluationResult{
+			EvalActionName: action,
+			EvalDecision:   aws.String(f.decisions[*action]),
+		})
+	}
+	fn(page, true)
+	return nil
+}
+
+// TestCheckWorkerDescribePermissions tests that describe actions denied to the worker role are reported
+func TestCheckWorkerDescribePermissions(t *testing.T) {
+	t.Run("all actions allowed", func(t *testing.T) {
+		a := &awsProvider{iam: &fakeIAM{decisions: map[string]string{
+			"ec2:DescribeInstances": iam.PolicyEvaluationDecisionTypeAllowed,
+			"ec2:DescribeRegions":   iam.PolicyEvaluationDecisionTypeAllowed,
+		}}}
+		assert.NoError(t, a.checkWorkerDescribePermissions(newInstanceProfile("infra-worker-profile")))
+	})
+	t.Run("action denied", func(t *testing.T) {
+		a := &awsProvider{iam: &fakeIAM{decisions: map[string]string{
+			"ec2:DescribeInstances": iam.PolicyEvaluationDecisionTypeImplicitDeny,
+			"ec2:DescribeRegions":   iam.PolicyEvaluationDecisionTypeAllowed,
+		}}}
+		err := a.checkWorkerDescribePermissions(newInstanceProfile("infra-worker-profile"))
+		require.Error(t, err, "no error when the worker role is missing permissions")
+		assert.Contains(t, err.Error(), "ec2:DescribeInstances (worker-role)")
+		assert.NotContains(t, err.Error(), "ec2:DescribeRegions")
+	})
+}
+
+// TestGetWorkerInstanceProfile tests that the worker instance profile is found when named differently from the role
+func TestGetWorkerInstanceProfile(t *testing.T) {
+	tests := []struct {
+		name                     string
+		iam                      *fakeIAM
+		workerInstanceProfileARN string
+		want                     string
+		wantErr                  string
+	}{
+		{
+			name: "derived instance profile",
+			iam:  &fakeIAM{instanceProfiles: []string{"infra-worker-profile"}},
+			want: "infra-worker-profile",
+		},
+		{
+			name:                     "explicit instance profile ARN",
+			iam:                      &fakeIAM{instanceProfiles: []string{"custom-profile"}},
+			workerInstanceProfileARN: "arn:aws:iam::123456789012:instance-profile/path/custom-profile",
+			want:                     "custom-profile",
+		},
+		{
+			name: "instance profile of the worker role",
+			iam: &fakeIAM{
+				instanceProfiles: []string{"custom-profile"},
+				roleProfiles:     map[string][]string{"infra-worker-role": {"custom-profile"}},
+			},
+			want: "custom-profile",
+		},
+		{
+			name: "worker role without instance profile",
+			iam: &fakeIAM{
+				instanceProfiles: []string{},
+				roleProfiles:     map[string][]string{"infra-worker-role": nil},
+			},
+			wantErr: "worker role infra-worker-role exists but has no instance profile",
+		},
+		{
+			name:    "neither instance profile nor role",
+			iam:     &fakeIAM{instanceProfiles: []string{}},
+			wantErr: "neither the worker instance profile infra-worker-profile nor the worker role infra-worker-role",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &awsProvider{iam: tt.iam,
+				awsProviderOptions: awsProviderOptions{workerInstanceProfileARN: tt.workerInstanceProfileARN}}
+			instanceProfile, err := a.getWorkerInstanceProfile("infra")
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, aws.StringValue(instanceProfile.InstanceProfileName))
+		})
+	}
+}
+
+// TestGetLatestWindowsAMI tests that the latest image of the requested Windows Server version is selected
+func TestGetLatestWindowsAMI(t *testing.T) {
+	image := func(id, name, creationDate string) *ec2.Image {
+		return &ec2.Image{ImageId: aws.String(id), Name: aws.String(name), CreationDate: aws.String(creationDate)}
+	}
+	ec2Client := &fakeEC2{images: []*ec2.Image{
+		image("ami-1", "Windows_Server-2019-English-Full-ContainersLatest-2022.01.12", "2022-01-12T07:52:11.000Z"),
+		image("ami-2", "Windows_Server-2019-English-Full-ContainersLatest-2022.02.09", "2022-02-09T08:01:42.000Z"),
+		image("ami-3", "Windows_Server-2022-English-Full-ContainersLatest-2022.03.09", "2022-03-09T06:45:10.000Z"),
+		image("ami-4", "Windows_Server-2022-English-Full-ContainersLatest-2022.02.09", "2022-02-09T06:12:37.000Z"),
+		image("ami-5", "Windows_Server-2022-English-Core-ContainersLatest-2022.04.13", "2022-04-13T06:30:00.000Z"),
+	}}
+	tests := []struct {
+		windowsVersion string
+		wantFilter     string
+		want           string
+		wantErr        bool
+	}{
+		{
+			windowsVersion: "2019",
+			wantFilter:     "Windows_Server-2019-English-Full-ContainersLatest-????.??.??",
+			want:           "ami-2",
+		},
+		{
+			windowsVersion: "2022",
+			wantFilter:     "Windows_Server-2022-English-Full-ContainersLatest-????.??.??",
+			want:           "ami-3",
+		},
+		{
+			windowsVersion: "2016",
+			wantErr:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.windowsVersion, func(t *testing.T) {
+			imageID, err := getLatestWindowsAMI(ec2Client, tt.windowsVersion)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, []string{tt.wantFilter}, ec2Client.imageNameFilters)
+			assert.Equal(t, tt.want, imageID)
+		})
+	}
+}
+
+// fakeEC2 is an EC2 client serving security groups, VPCs, subnets, instance offerings and images from memory
+type fakeEC2 struct {
+	ec2iface.EC2API
+	securityGroups []*ec2.SecurityGroup
+	vpcs           []*ec2.Vpc
+	subnets        []*ec2.Subnet
+	offerings      []*ec2.ReservedInstancesOffering
+	images         []*ec2.Image
+	// imageNameFilters records the name filters of the last DescribeImages call
+	imageNameFilters []string
+}
+
+// DescribeImages returns the images with a name matching one of the name filters
+func (f *fakeEC2) DescribeImages(input *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+	f.imageNameFilters = nil
+	for _, filter := range input.Filters {
+		if *filter.Name == "name" {
+			f.imageNameFilters = append(f.imageNameFilters, aws.StringValueSlice(filter.Values)...)
+		}
+	}
+	output := &ec2.DescribeImagesOutput{}
+	for _, image := range f.images {
+		for _, nameFilter := range f.imageNameFilters {
+			if matched, _ := path.Match(nameFilter, aws.StringValue(image.Name)); matched {
+				output.Images = append(output.Images, image)
+				break
+			}
+		}
+	}
+	return output, nil
+}
+
+// DescribeVpcs returns the VPCs with the given IDs, or all the VPCs if no ID is given, ignoring the filters
+func (f *fakeEC2) DescribeVpcs(input *ec2.DescribeVpcsInput) (*ec2.DescribeVpcsOutput, error) {
+	output := &ec2.DescribeVpcsOutput{}
+	for _, vpc := range f.vpcs {
+		if len(input.VpcIds) == 0 || contains(aws.StringValueSlice(input.VpcIds), aws.StringValue(vpc.VpcId)) {
+			output.Vpcs = append(output.Vpcs, vpc)
+		}
+	}
+	return output, nil
+}
+
+// DescribeSubnets returns the subnets with the given IDs, or all the subnets if no ID is given
+func (f *fakeEC2) DescribeSubnets(input *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	output := &ec2.DescribeSubnetsOutput{}
+	for _, subnet := range f.subnets {
+		if len(input.SubnetIds) == 0 || contains(aws.StringValueSlice(input.SubnetIds),
+			aws.StringValue(subnet.SubnetId)) {
+			output.Subnets = append(output.Subnets, subnet)
+		}
+	}
+	return output, nil
+}
+
+// DescribeReservedInstancesOfferings returns all the instance offerings, ignoring the filters
+func (f *fakeEC2) DescribeReservedInstancesOfferings(*ec2.DescribeReservedInstancesOfferingsInput) (
+	*ec2.DescribeReservedInstancesOfferingsOutput, error) {
+	return &ec2.DescribeReservedInstancesOfferingsOutput{ReservedInstancesOfferings: f.offerings}, nil
+}
+
+// DescribeSecurityGroups returns the security groups with the given IDs and matching all the given tag and group-name
+// filters
+func (f *fakeEC2) DescribeSecurityGroups(input *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput,
+	error) {
+	output := &ec2.DescribeSecurityGroupsOutput{}
+	for _, sg := range f.securityGroups {
+		matches := len(input.GroupIds) == 0 || contains(aws.StringValueSlice(input.GroupIds),
+			aws.StringValue(sg.GroupId))
+		for _, filter := range input.Filters {
+			var value string
+			if *filter.Name == "group-name" {
+				value = aws.StringValue(sg.GroupName)
+			} else {
+				for _, tag := range sg.Tags {
+					if "tag:"+aws.StringValue(tag.Key) == *filter.Name {
+						value = aws.StringValue(tag.Value)
+					}
+				}
+			}
+			matches = matches && value != "" && contains(aws.StringValueSlice(filter.Values), value)
+		}
+		if matches {
+			output.SecurityGroups = append(output.SecurityGroups, sg)
+		}
+	}
+	return output, nil
+}
+
+// contains returns true if value is in values
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// TestGetClusterWorkerSGID tests that the worker security group is discovered through each supported scheme
+func TestGetClusterWorkerSGID(t *testing.T) {
+	installerSG := &ec2.SecurityGroup{
+		GroupId:   aws.String("sg-installer"),
+		GroupName: aws.String("infra-worker-sg"),
+		Tags: []*ec2.Tag{
+			{Key: aws.String("Name"), Value: aws.String("infra-worker-sg")},
+			{Key: aws.String("kubernetes.io/cluster/infra"), Value: aws.String("owned")},
+		},
+	}
+	capaSG := &ec2.SecurityGroup{
+		GroupId:   aws.String("sg-capa"),
+		GroupName: aws.String("shared-node-sg"),
+		Tags: []*ec2.Tag{
+			{Key: aws.String("sigs.k8s.io/cluster-api-provider-aws/cluster/infra"), Value: aws.String("shared")},
+			{Key: aws.String("sigs.k8s.io/cluster-api-provider-aws/role"), Value: aws.String("node")},
+		},
+	}
+	namedSG := &ec2.SecurityGroup{
+		GroupId:   aws.String("sg-named"),
+		GroupName: aws.String("custom-worker-sg"),
+		VpcId:     aws.String("vpc-cluster"),
+	}
+	otherVPCSG := &ec2.SecurityGroup{
+		GroupId: aws.String("sg-other-vpc"),
+		VpcId:   aws.String("vpc-other"),
+	}
+
+	tests := []struct {
+		name            string
+		securityGroups  []*ec2.SecurityGroup
+		workerSGName    string
+		securityGroupID string
+		want            string
+		wantErr         bool
+	}{
+		{
+			name:           "installer tags",
+			securityGroups: []*ec2.SecurityGroup{capaSG, installerSG},
+			want:           "sg-installer",
+		},
+		{
+			name:           "cluster-api-provider-aws tags",
+			securityGroups: []*ec2.SecurityGroup{namedSG, capaSG},
+			want:           "sg-capa",
+		},
+		{
+			name:           "worker security group name",
+			securityGroups: []*ec2.SecurityGroup{namedSG},
+			workerSGName:   "custom-worker-sg",
+			want:           "sg-named",
+		},
+		{
+			name:           "not found",
+			securityGroups: []*ec2.SecurityGroup{namedSG},
+			wantErr:        true,
+		},
+		{
+			name:            "security group ID",
+			securityGroups:  []*ec2.SecurityGroup{installerSG, namedSG},
+			securityGroupID: "sg-named",
+			want:            "sg-named",
+		},
+		{
+			name:            "security group ID outside of the cluster VPC",
+			securityGroups:  []*ec2.SecurityGroup{installerSG, otherVPCSG},
+			securityGroupID: "sg-other-vpc",
+			wantErr:         true,
+		},
+		{
+			name:            "security group ID not found",
+			securityGroups:  []*ec2.SecurityGroup{installerSG},
+			securityGroupID: "sg-missing",
+			wantErr:         true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &awsProvider{
+				ec2: &fakeEC2{securityGroups: tt.securityGroups,
+					vpcs: []*ec2.Vpc{{VpcId: aws.String("vpc-cluster")}}},
+				awsProviderOptions: awsProviderOptions{workerSGName: tt.workerSGName,
+					securityGroupID: tt.securityGroupID},
+			}
+			sgID, err := a.getClusterWorkerSGID("infra")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, sgID)
+		})
+	}
+}
+
+// TestGetVPCByInfrastructure tests that an ambiguous VPC is reported instead of picking one, unless it is pinned by
+// its ID
+func TestGetVPCByInfrastructure(t *testing.T) {
+	tests := []struct {
+		name    string
+		vpcs    []string
+		vpcID   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "single VPC",
+			vpcs: []string{"vpc-cluster"},
+			want: "vpc-cluster",
+		},
+		{
+			name:    "multiple VPCs",
+			vpcs:    []string{"vpc-cluster", "vpc-other"},
+			wantErr: true,
+		},
+		{
+			name:  "multiple VPCs with a VPC ID",
+			vpcs:  []string{"vpc-cluster", "vpc-other"},
+			vpcID: "vpc-other",
+			want:  "vpc-other",
+		},
+		{
+			name:    "VPC ID not found",
+			vpcs:    []string{"vpc-cluster"},
+			vpcID:   "vpc-missing",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ec2Client := &fakeEC2{}
+			for _, id := range tt.vpcs {
+				ec2Client.vpcs = append(ec2Client.vpcs, &ec2.Vpc{VpcId: aws.String(id)})
+			}
+			a := &awsProvider{ec2: ec2Client, awsProviderOptions: awsProviderOptions{vpcID: tt.vpcID}}
+			vpc, err := a.getVPCByInfrastructure("infra")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, aws.StringValue(vpc.VpcId))
+		})
+	}
+}
+
+// TestGetSubnet tests that the subnet is discovered by name, or pinned by its ID when one is given
+func TestGetSubnet(t *testing.T) {
+	newSubnet := func(id, vpcID, zone, name string) *ec2.Subnet {
+		return &ec2.Subnet{
+			SubnetId:         aws.String(id),
+			VpcId:            aws.String(vpcID),
+			AvailabilityZone: aws.String(zone),
+			Tags:             []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String(name)}},
+		}
+	}
+	ec2Client := &fakeEC2{
+		vpcs: []*ec2.Vpc{{VpcId: aws.String("vpc-cluster")}},
+		subnets: []*ec2.Subnet{
+			newSubnet("subnet-private-a", "vpc-cluster", "us-east-1a", "infra-private-us-east-1a"),
+			newSubnet("subnet-custom-b", "vpc-cluster", "us-east-1b", "custom-b"),
+			newSubnet("subnet-custom-c", "vpc-cluster", "us-east-1c", "custom-c"),
+			newSubnet("subnet-other", "vpc-other", "us-east-1a", "other"),
+		},
+		offerings: []*ec2.ReservedInstancesOffering{
+			{AvailabilityZone: aws.String("us-east-1a")},
+			{AvailabilityZone: aws.String("us-east-1b")},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		subnetID string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name: "discovered private subnet",
+			want: "subnet-private-a",
+		},
+		{
+			name:     "explicit subnet",
+			subnetID: "subnet-custom-b",
+			want:     "subnet-custom-b",
+		},
+		{
+			name:     "explicit subnet in a zone without offerings",
+			subnetID: "subnet-custom-c",
+			wantErr:  true,
+		},
+		{
+			name:     "explicit subnet outside of the cluster VPC",
+			subnetID: "subnet-other",
+			wantErr:  true,
+		},
+		{
+			name:     "explicit subnet not found",
+			subnetID: "subnet-missing",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &awsProvider{ec2: ec2Client,
+				awsProviderOptions: awsProviderOptions{instanceType: "m5a.large", subnetID: tt.subnetID}}
+			subnet, err := a.getSubnet("infra")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, aws.StringValue(subnet.SubnetId))
+		})
+	}
+}
+
+// TestSpotMarketOptions tests that Spot instances are requested in the MachineSet provider spec only when enabled
+func TestSpotMarketOptions(t *testing.T) {
+	t.Run("On-Demand instances", func(t *testing.T) {
+		a := &awsProvider{}
+		assert.Nil(t, a.spotMarketOptions())
+	})
+	t.Run("Spot instances at the On-Demand price", func(t *testing.T) {
+		a := &awsProvider{awsProviderOptions: awsProviderOptions{spot: true}}
+		options := a.spotMarketOptions()
+		require.NotNil(t, options, "Spot instances not requested")
+		assert.Nil(t, options.MaxPrice)
+	})
+	t.Run("Spot instances with a maximum price", func(t *testing.T) {
+		a := &awsProvider{awsProviderOptions: awsProviderOptions{spot: true, spotMaxPrice: "0.15"}}
+		options := a.spotMarketOptions()
+		require.NotNil(t, options, "Spot instances not requested")
+		assert.Equal(t, "0.15", aws.StringValue(options.MaxPrice))
+	})
+}
+
+// TestValidateRootVolume tests that only root volume configurations supported by EBS are accepted
+func TestValidateRootVolume(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int64
+		iops       int64
+		volumeType string
+		wantErr    bool
+	}{
+		{
+			name:       "default gp3",
+			volumeType: "gp3",
+		},
+		{
+			name:       "gp3 with size and IOPS",
+			size:       128,
+			iops:       6000,
+			volumeType: "gp3",
+		},
+		{
+			name:       "io1 with IOPS",
+			iops:       3000,
+			volumeType: "io1",
+		},
+		{
+			name:       "io2 without IOPS",
+			volumeType: "io2",
+			wantErr:    true,
+		},
+		{
+			name:       "gp2 with IOPS",
+			iops:       3000,
+			volumeType: "gp2",
+			wantErr:    true,
+		},
+		{
+			name:       "negative size",
+			size:       -1,
+			volumeType: "gp3",
+			wantErr:    true,
+		},
+		{
+			name:       "unsupported root volume type",
+			volumeType: "st1",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRootVolume(tt.size, tt.iops, tt.volumeType)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// TestRootVolume tests that only the configured root volume settings are set in the MachineSet provider spec
+func TestRootVolume(t *testing.T) {
+	a := &awsProvider{awsProviderOptions: awsProviderOptions{rootVolumeType: "gp3"}}
+	assert.Equal(t, &awsprovider.EBSBlockDeviceSpec{VolumeType: aws.String("gp3")}, a.rootVolume())
+
+	a = &awsProvider{awsProviderOptions: awsProviderOptions{rootVolumeSize: 128, rootVolumeIOPS: 4000,
+		rootVolumeType: "io2"}}
+	assert.Equal(t, &awsprovider.EBSBlockDeviceSpec{VolumeSize: aws.Int64(128), Iops: aws.Int64(4000),
+		VolumeType: aws.String("io2")}, a.rootVolume())
+}
+
+// TestRenderName tests that the MachineSet name templates are rendered into valid names
+func TestRenderName(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "all placeholders",
+			template: "{infraID}-win-{zone}-{rand}",
+			want:     "cluster-x7k2p-win-us-east-1a-abcd",
+		},
+		{
+			name:     "fixed prefix",
+			template: "corp-windows-{rand}",
+			want:     "corp-windows-abcd",
+		},
+		{
+			name:     "unknown placeholder",
+			template: "{cluster}-{rand}",
+			wantErr:  true,
+		},
+		{
+			name:     "invalid characters",
+			template: "Windows_{rand}",
+			wantErr:  true,
+		},
+		{
+			name:     "too long",
+			template: "{infraID}-" + strings.Repeat("w", 60),
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, err := renderName(tt.template, "cluster-x7k2p", "us-east-1a", "abcd")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, name)
+		})
+	}
+}
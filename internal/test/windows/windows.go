@@ -1,13 +1,18 @@
 package windows
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
@@ -19,14 +24,22 @@ const (
 	// remotePowerShellCmdPrefix holds the PowerShell prefix that needs to be prefixed  for every remote PowerShell
 	// command executed on the remote Windows VM
 	remotePowerShellCmdPrefix = "powershell.exe -NonInteractive -ExecutionPolicy Bypass "
+	// DefaultConnectTimeout is the maximum time allowed to establish the ssh connection to the Windows VM
+	DefaultConnectTimeout = 30 * time.Second
 )
 
+// ErrRunTimeout is returned when a remote command does not complete within its timeout
+var ErrRunTimeout = errors.New("command did not complete in time")
+
 // Windows represents a Windows host.
 type Windows struct {
 	// Credentials is used for storing the credentials for Windows VMs created
 	Credentials *credentials.Credentials
 	// SSHClient contains the ssh client information to access the Windows VM via ssh
 	SSHClient *ssh.Client
+	// ConnectTimeout is the maximum time allowed to establish the ssh connection, DefaultConnectTimeout if unset.
+	// It does not limit the time taken by the commands run over the connection.
+	ConnectTimeout time.Duration
 }
 
 // WindowsVM is the interface for interacting with a Windows object created by the cloud provider
@@ -37,11 +50,19 @@ type WindowsVM interface {
 	// CopyFile copies the given file to the remote directory in the Windows VM. The remote directory is created if it
 	// does not exist
 	CopyFile(string, string) error
+	// CopyFileTo copies the local file to the given path in the Windows VM. The remote directory is created if it does
+	// not exist
+	CopyFileTo(string, string) error
+	// CopyFileFrom copies the file at the given path in the Windows VM to the given local path
+	CopyFileFrom(string, string) error
 	// Run executes the given command remotely on the Windows VM over a ssh connection and returns the combined output
 	// of stdout and stderr. If the bool is set, it implies that the cmd is to be execute in PowerShell. This function
 	// should be used in scenarios where you want to execute a command that runs in the background. In these cases we
 	// have observed that Run() returns before the command completes and as a result killing the process.
 	Run(string, bool) (string, error)
+	// RunWithTimeout executes the given command remotely on the Windows VM as Run does, and returns stdout and stderr
+	// separately. An error wrapping ErrRunTimeout is returned if the command does not complete within the timeout.
+	RunWithTimeout(string, bool, time.Duration) (string, string, error)
 	// GetCredentials returns the interface for accessing the VM credentials. It is up to the caller to check if non-nil
 	// Credentials are returned before usage.
 	GetCredentials() *credentials.Credentials
@@ -62,9 +83,34 @@ func (w *Windows) CopyFile(filePath, remoteDir string) error {
 
 	log.Printf("Copying %s file to Windows VM: %v", filePath, remoteDir)
 
-	f, err := os.Open(filePath)
+	return uploadFile(ftp, filePath, remoteDir, remoteDir+"\\"+filepath.Base(filePath))
+}
+
+func (w *Windows) CopyFileTo(localPath, remotePath string) error {
+	if w.SSHClient == nil {
+		return fmt.Errorf("CopyFileTo cannot be called without a SSH client")
+	}
+
+	ftp, err := sftp.NewClient(w.SSHClient)
 	if err != nil {
-		return fmt.Errorf("error opening %s file to be transferred: %v", filePath, err)
+		return fmt.Errorf("sftp client initialization failed: %v", err)
+	}
+	defer ftp.Close()
+
+	log.Printf("Copying %s file to Windows VM: %v", localPath, remotePath)
+	remoteDir := "."
+	// The remote path may use either separator
+	if i := strings.LastIndexAny(remotePath, `\/`); i > 0 {
+		remoteDir = remotePath[:i]
+	}
+	return uploadFile(ftp, localPath, remoteDir, remotePath)
+}
+
+// uploadFile streams the local file to the remote path, creating the remote directory holding it if needed
+func uploadFile(ftp *sftp.Client, localPath, remoteDir, remotePath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("error opening %s file to be transferred: %v", localPath, err)
 	}
 	defer f.Close()
 
@@ -72,22 +118,39 @@ func (w *Windows) CopyFile(filePath, remoteDir string) error {
 		return fmt.Errorf("error creating remote directory %s: %v", remoteDir, err)
 	}
 
-	remoteFile := remoteDir + "\\" + filepath.Base(filePath)
-	dstFile, err := ftp.Create(remoteFile)
+	dstFile, err := ftp.Create(remotePath)
 	if err != nil {
-		return fmt.Errorf("error initializing %s file on Windows VMs: %v", remoteFile, err)
+		return fmt.Errorf("error initializing %s file on Windows VMs: %v", remotePath, err)
 	}
 
 	_, err = io.Copy(dstFile, f)
 	if err != nil {
-		return fmt.Errorf("error copying %s to the Windows VM: %v", filePath, err)
+		dstFile.Close()
+		return fmt.Errorf("error copying %s to the Windows VM: %v", localPath, err)
 	}
 
 	// Forcefully close it so that we can execute the binary later
-	dstFile.Close()
+	if err = dstFile.Close(); err != nil {
+		return fmt.Errorf("error closing %s on the Windows VM: %v", remotePath, err)
+	}
 	return nil
 }
 
+func (w *Windows) CopyFileFrom(remotePath, localPath string) error {
+	if w.SSHClient == nil {
+		return fmt.Errorf("CopyFileFrom cannot be called without a SSH client")
+	}
+
+	ftp, err := sftp.NewClient(w.SSHClient)
+	if err != nil {
+		return fmt.Errorf("sftp client initialization failed: %v", err)
+	}
+	defer ftp.Close()
+
+	log.Printf("Copying %s file from Windows VM: %v", remotePath, localPath)
+	return w.copyFileFrom(ftp, remotePath, localPath)
+}
+
 func (w *Windows) CopyDirectory(localDir string, remoteDir string) error {
 	if w.SSHClient == nil {
 		return fmt.Errorf("CopyDirectory cannot be called without a SSH client")
@@ -127,17 +190,34 @@ func (w *Windows) CopyDirectory(localDir string, remoteDir string) error {
 }
 
 func (w *Windows) Run(cmd string, psCmd bool) (string, error) {
+	var out syncBuffer
+	// Run waits for the command to complete however long it takes, callers wanting a bound use RunWithTimeout
+	err := w.run(cmd, psCmd, 0, &out, &out)
+	return out.String(), err
+}
+
+func (w *Windows) RunWithTimeout(cmd string, psCmd bool, timeout time.Duration) (string, string, error) {
+	var stdout, stderr syncBuffer
+	err := w.run(cmd, psCmd, timeout, &stdout, &stderr)
+	return stdout.String(), stderr.String(), err
+}
+
+// run executes the given command remotely on the Windows VM, writing its stdout and stderr to the given writers. The
+// session is closed if the command does not complete within the timeout, leaving the command to the remote host. The
+// output may still be written to the writers after a timeout, until the session is closed. A zero timeout waits for
+// the command to complete without limit.
+func (w *Windows) run(cmd string, psCmd bool, timeout time.Duration, stdout, stderr io.Writer) error {
 	if w.SSHClient == nil {
-		return "", fmt.Errorf("Run cannot be called without a ssh client")
+		return fmt.Errorf("Run cannot be called without a ssh client")
 	}
 
 	session, err := w.SSHClient.NewSession()
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer func() {
 		// io.EOF is returned if you attempt to close a session that is already closed which typically happens given
-		// that CombinedOutput() internally closes the session.
+		// that Wait() internally closes the session.
 		if err := session.Close(); err != nil && !errors.Is(err, io.EOF) {
 			log.Printf("error closing SSH session: %v", err)
 		}
@@ -147,8 +227,45 @@ func (w *Windows) Run(cmd string, psCmd bool) (string, error) {
 		cmd = remotePowerShellCmdPrefix + cmd
 	}
 
-	out, err := session.CombinedOutput(cmd)
-	return string(out), err
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if err = session.Start(cmd); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+	// Receiving from the nil channel blocks forever, so that no timeout applies
+	var timedOut <-chan time.Time
+	if timeout > 0 {
+		timedOut = time.After(timeout)
+	}
+	select {
+	case err = <-done:
+		return err
+	case <-timedOut:
+		return fmt.Errorf("%w after %s: %s", ErrRunTimeout, timeout, cmd)
+	}
+}
+
+// syncBuffer is a buffer which can be written concurrently, by both stdout and stderr of a session, and read while
+// the session output is still being written after a timeout
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
 }
 
 func (w *Windows) GetCredentials() *credentials.Credentials {
@@ -170,7 +287,11 @@ func (w *Windows) GetSSHClient() error {
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
 
-	sshClient, err := ssh.Dial("tcp", w.Credentials.IPAddress()+":22", config)
+	timeout := w.ConnectTimeout
+	if timeout == 0 {
+		timeout = DefaultConnectTimeout
+	}
+	sshClient, err := dialSSH(net.JoinHostPort(w.Credentials.IPAddress(), "22"), config, timeout)
 	if err != nil {
 		return fmt.Errorf("failed to dial to ssh server: %s", err)
 	}
@@ -178,6 +299,30 @@ func (w *Windows) GetSSHClient() error {
 	return nil
 }
 
+// dialSSH connects to the ssh server at the given address. Both the TCP connection and the ssh handshake must
+// complete within the timeout, so that a filtered port or an unresponsive server fails fast.
+func dialSSH(address string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// Clear the deadline, the commands run over the connection are not bound by the connect timeout
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		clientConn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(clientConn, chans, reqs), nil
+}
+
 func (w *Windows) Reinitialize() error {
 	if err := w.GetSSHClient(); err != nil {
 		return fmt.Errorf("failed to reinitialize ssh client: %v", err)
@@ -228,31 +373,33 @@ func (w *Windows) RetrieveDirectories(remoteDir string, localDir string) error {
 	return nil
 }
 
-// copyFileFrom copies a file from remote directory to the local directory.
+// copyFileFrom streams a file from the remote path to the local path.
 func (w *Windows) copyFileFrom(sftp *sftp.Client, remotePath, localPath string) error {
-	localFile, err := os.Create(localPath)
-	if err != nil {
-		return fmt.Errorf("error creating file locally: %v", err)
-	}
 	// TODO: Check if there is some performance implication of multiple Open calls.
 	remoteFile, err := sftp.Open(remotePath)
 	if err != nil {
 		return fmt.Errorf("error while opening remote file on the Windows VM: %v", err)
 	}
-	// logging the errors instead of returning to allow closing of files
-	_, err = io.Copy(localFile, remoteFile)
+	defer func() {
+		if err := remoteFile.Close(); err != nil {
+			log.Printf("error closing file on the remote host %s", remotePath)
+		}
+	}()
+	localFile, err := os.Create(localPath)
 	if err != nil {
-		log.Printf("error retrieving file %v from Windows VM: %v", localPath, err)
+		return fmt.Errorf("error creating file locally: %v", err)
+	}
+	defer func() {
+		if err := localFile.Close(); err != nil {
+			log.Printf("error closing file %s locally", localPath)
+		}
+	}()
+	if _, err = io.Copy(localFile, remoteFile); err != nil {
+		return fmt.Errorf("error retrieving file %v from Windows VM: %v", remotePath, err)
 	}
 	// flush memory
 	if err = localFile.Sync(); err != nil {
-		log.Printf("error flusing memory: %v", err)
-	}
-	if err := remoteFile.Close(); err != nil {
-		log.Printf("error closing file on the remote host %s", localPath)
-	}
-	if err := localFile.Close(); err != nil {
-		log.Printf("error closing file %s locally", localPath)
+		return fmt.Errorf("error flushing %s: %v", localPath, err)
 	}
 	return nil
 }
@@ -0,0 +1,206 @@
+package windows
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// TestDialSSHTimeout tests that connecting to a server which accepts the connection but never answers the ssh
+// handshake fails once the connect timeout is reached
+func TestDialSSHTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// Hold the connection open without answering
+			defer conn.Close()
+		}
+	}()
+
+	config := &ssh.ClientConfig{User: "Administrator", HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+	start := time.Now()
+	_, err = dialSSH(listener.Addr().String(), config, 200*time.Millisecond)
+	require.Error(t, err, "connecting to an unresponsive server succeeded")
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second), "connect timeout not respected")
+}
+
+// startSSHServer starts a ssh server with the given host key, accepting any client. The sleep command blocks until
+// the session is closed, and any other command writes "stdout: <command>" to stdout and "stderr" to stderr. The sftp
+// subsystem serves the local filesystem.
+func startSSHServer(t *testing.T, hostKey ssh.Signer) net.Listener {
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(hostKey)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serverConn, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+				if err != nil {
+					return
+				}
+				defer serverConn.Close()
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					go serveSession(newChannel)
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+// serveSession runs the command of a session channel of the ssh server started by startSSHServer
+func serveSession(newChannel ssh.NewChannel) {
+	if newChannel.ChannelType() != "session" {
+		newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	for req := range requests {
+		if req.Type == "subsystem" {
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			return
+		}
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			req.Reply(false, nil)
+			return
+		}
+		req.Reply(true, nil)
+		if payload.Command == "sleep" {
+			// Block until the client closes the session, which closes the requests
+			continue
+		}
+		channel.Write([]byte("stdout: " + payload.Command))
+		channel.Stderr().Write([]byte("stderr"))
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		return
+	}
+}
+
+// TestRunWithTimeout tests that the output of a remote command is returned, and that a command which does not complete
+// within the timeout returns a timeout error instead of blocking
+func TestRunWithTimeout(t *testing.T) {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	require.NoError(t, err)
+	listener := startSSHServer(t, hostSigner)
+	defer listener.Close()
+
+	config := &ssh.ClientConfig{User: "Administrator", HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+	client, err := dialSSH(listener.Addr().String(), config, 5*time.Second)
+	require.NoError(t, err)
+	defer client.Close()
+	w := &Windows{SSHClient: client}
+
+	t.Run("command completes", func(t *testing.T) {
+		stdout, stderr, err := w.RunWithTimeout("hostname", false, 5*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, "stdout: hostname", stdout)
+		assert.Equal(t, "stderr", stderr)
+	})
+	t.Run("PowerShell command completes", func(t *testing.T) {
+		stdout, _, err := w.RunWithTimeout("hostname", true, 5*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, "stdout: "+remotePowerShellCmdPrefix+"hostname", stdout)
+	})
+	t.Run("command sleeps longer than the timeout", func(t *testing.T) {
+		start := time.Now()
+		_, _, err := w.RunWithTimeout("sleep", false, 200*time.Millisecond)
+		require.Error(t, err, "command blocking past the timeout succeeded")
+		assert.True(t, errors.Is(err, ErrRunTimeout), "unexpected error %v", err)
+		assert.Less(t, int64(time.Since(start)), int64(5*time.Second), "run timeout not respected")
+	})
+	t.Run("Run combines stdout and stderr", func(t *testing.T) {
+		out, err := w.Run("hostname", false)
+		require.NoError(t, err)
+		assert.Contains(t, out, "stdout: hostname")
+		assert.Contains(t, out, "stderr")
+	})
+}
+
+// TestCopyFileToAndFrom tests that a file uploaded to the Windows VM is downloaded back with the same contents
+func TestCopyFileToAndFrom(t *testing.T) {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	require.NoError(t, err)
+	listener := startSSHServer(t, hostSigner)
+	defer listener.Close()
+
+	config := &ssh.ClientConfig{User: "Administrator", HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+	client, err := dialSSH(listener.Addr().String(), config, 5*time.Second)
+	require.NoError(t, err)
+	defer client.Close()
+	w := &Windows{SSHClient: client}
+
+	dir, err := ioutil.TempDir("", "windows")
+	require.NoError(t, err, "error creating temp directory")
+	// Ignore the return error as there is not much we can do if the temporary directory is not deleted
+	defer os.RemoveAll(dir)
+	// The file spans several sftp packets, so that it is streamed in chunks
+	contents := make([]byte, 1<<20)
+	_, err = rand.Read(contents)
+	require.NoError(t, err)
+	localPath := filepath.Join(dir, "kubelet.exe")
+	require.NoError(t, ioutil.WriteFile(localPath, contents, 0644))
+
+	// The test server serves the local filesystem, the remote directory is created by the upload
+	remotePath := filepath.Join(dir, "remote", "k", "kubelet.exe")
+	require.NoError(t, w.CopyFileTo(localPath, remotePath), "error uploading file")
+	downloadPath := filepath.Join(dir, "downloaded.exe")
+	require.NoError(t, w.CopyFileFrom(remotePath, downloadPath), "error downloading file")
+
+	downloaded, err := ioutil.ReadFile(downloadPath)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(contents, downloaded), "downloaded contents differ from the uploaded ones")
+
+	t.Run("missing remote file", func(t *testing.T) {
+		err := w.CopyFileFrom(filepath.Join(dir, "remote", "missing"), filepath.Join(dir, "missing"))
+		assert.Error(t, err, "no error downloading a missing file")
+		assert.NoFileExists(t, filepath.Join(dir, "missing"), "local file created for a missing remote file")
+	})
+}
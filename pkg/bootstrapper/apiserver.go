@@ -0,0 +1,121 @@
+package bootstrapper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// apiServerCheckTimeout is the maximum duration to wait for a connection to the API server to be established
+const apiServerCheckTimeout = 10 * time.Second
+
+// kubeconfig holds the fields of a kubeconfig needed to find the API server it points to
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server string `yaml:"server"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// kubeconfigServer returns the server URL of the cluster used by the current context of the given kubeconfig. If the
+// kubeconfig has no current context, it must have a single cluster.
+func kubeconfigServer(contents []byte) (string, error) {
+	var config kubeconfig
+	if err := yaml.Unmarshal(contents, &config); err != nil {
+		return "", fmt.Errorf("could not unmarshal kubeconfig: %v", err)
+	}
+
+	if config.CurrentContext == "" {
+		if len(config.Clusters) != 1 {
+			return "", fmt.Errorf("kubeconfig has no current context and %d clusters", len(config.Clusters))
+		}
+		return config.Clusters[0].Cluster.Server, nil
+	}
+	for _, context := range config.Contexts {
+		if context.Name != config.CurrentContext {
+			continue
+		}
+		for _, cluster := range config.Clusters {
+			if cluster.Name == context.Context.Cluster {
+				return cluster.Cluster.Server, nil
+			}
+		}
+		return "", fmt.Errorf("kubeconfig has no cluster %s", context.Context.Cluster)
+	}
+	return "", fmt.Errorf("kubeconfig has no context %s", config.CurrentContext)
+}
+
+// bootstrapKubeconfig returns the contents of the bootstrap kubeconfig the kubelet is set up with, taken from the
+// given setup if translated from the ignition, or else from the install directory
+func (wmcb *winNodeBootstrapper) bootstrapKubeconfig(setup *kubeletSetup) ([]byte, error) {
+	path := filepath.Join(wmcb.installDir, "bootstrap-kubeconfig")
+	if contents, ok := setup.ignitionFiles[path]; ok {
+		return contents, nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read kubeconfig: %v", err)
+	}
+	return contents, nil
+}
+
+// checkBootstrapAPIServer returns an error if the API server of the bootstrap kubeconfig of the given setup is not
+// reachable
+func (wmcb *winNodeBootstrapper) checkBootstrapAPIServer(setup *kubeletSetup) error {
+	contents, err := wmcb.bootstrapKubeconfig(setup)
+	if err != nil {
+		return fmt.Errorf("could not find the API server of the bootstrap kubeconfig: %v", err)
+	}
+	server, err := kubeconfigServer(contents)
+	if err != nil {
+		return fmt.Errorf("could not find the API server of the bootstrap kubeconfig: %v", err)
+	}
+	if err = checkAPIServer(server, apiServerCheckTimeout); err != nil {
+		return fmt.Errorf("API server %s is not reachable, the kubelet would not be able to join the cluster: %v",
+			server, err)
+	}
+	return nil
+}
+
+// checkAPIServer opens a TCP connection to the host and port of the given API server URL, and returns an error if the
+// connection cannot be established within the timeout. The port defaults to the one of the URL scheme.
+func checkAPIServer(server string, timeout time.Duration) error {
+	serverURL, err := url.Parse(server)
+	if err != nil {
+		return fmt.Errorf("invalid API server URL %s: %v", server, err)
+	}
+	if serverURL.Hostname() == "" {
+		return fmt.Errorf("invalid API server URL %s: no host", server)
+	}
+	port := serverURL.Port()
+	if port == "" {
+		switch serverURL.Scheme {
+		case "https":
+			port = "443"
+		case "http":
+			port = "80"
+		default:
+			return fmt.Errorf("invalid API server URL %s: no port", server)
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(serverURL.Hostname(), port), timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -1,27 +1,41 @@
 package bootstrapper
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
 	_ "embed"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
 
+	"github.com/coreos/go-semver/semver"
 	ignitionCfgv24tov31 "github.com/coreos/ign-converter/translate/v24tov31"
 	ignitionCfgv2_4 "github.com/coreos/ignition/config/v2_4"
 	ignitionCfgv2_4Types "github.com/coreos/ignition/config/v2_4/types"
 	ignitionCfgError "github.com/coreos/ignition/v2/config/shared/errors"
 	ignitionCfgv3 "github.com/coreos/ignition/v2/config/v3_1"
 	ignitionCfgv3Types "github.com/coreos/ignition/v2/config/v3_1/types"
+	ignitionCfgValidate "github.com/coreos/ignition/v2/config/validate"
 	"github.com/pkg/errors"
 	"github.com/vincent-petithory/dataurl"
 	"golang.org/x/sys/windows/svc/mgr"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	logger "sigs.k8s.io/controller-runtime/pkg/log"
 
 	"github.com/openshift/windows-machine-config-bootstrapper/pkg/cloud"
 )
@@ -49,8 +63,12 @@ const (
 	kubeletSystemdName = "kubelet.service"
 	// serviceWaitTime is amount of wait time required for the Windows service API to complete stop requests
 	serviceWaitTime = time.Second * 20
-	// certDirectory is where the kubelet will look for certificates
-	certDirectory = "c:\\var\\lib\\kubelet\\pki\\"
+	// certDirectory is where the kubelet will look for certificates, relative to the root of the install dir's drive
+	certDirectory = "\\var\\lib\\kubelet\\pki\\"
+	// logDirectory is where the kubelet logs are written, relative to the root of the install dir's drive
+	logDirectory = "\\var\\log\\kubelet"
+	// defaultDrive is the drive used for the kubelet directories if the install dir does not specify one
+	defaultDrive = "c:"
 	// cloudConfigOption is kubelet CLI option for cloud configuration
 	cloudConfigOption = "cloud-config"
 	// windowsTaints defines the taints that need to be applied on the Windows nodes.
@@ -64,30 +82,155 @@ const (
 		      	value: "Windows"
 		      	effect: "NoSchedule"
 	*/
-	windowsTaints = "os=Windows:NoSchedule"
+	windowsTaints = windowsTaintPrefix + "NoSchedule"
+	// windowsTaintPrefix is the key and value of the os=Windows taint, which is followed by its effect
+	windowsTaintPrefix = windowsTaintKey + "=Windows:"
+	// windowsTaintKey is the key of the os=Windows taint, no other taint may use it
+	windowsTaintKey = "os"
+	// cordonedTaintKey is the key of the taint the node registers with when started cordoned. A dedicated taint is used
+	// as the node lifecycle controller removes the node.kubernetes.io/unschedulable taint from schedulable nodes.
+	cordonedTaintKey = "node.openshift.io/cordoned"
+	// cordonedTaint keeps workloads off a node started cordoned until it is removed from the node
+	cordonedTaint = cordonedTaintKey + "=true:NoSchedule"
 	// nodeLabel contains the os specific label that will be applied to the Windows node object. This can be used to
 	// identify the nodes managed by WSU and future operators. (We could have gotten this from boostrap kubeconfig too
 	// however the label value is resolved on the host side, making it convenient when we run WMCB within a container)
-	nodeLabel = "node.openshift.io/os_id=Windows"
+	nodeLabel = nodeLabelKey + "=Windows"
+	// nodeLabelKey is the key of the os specific label, which cannot be overridden by the node labels given to WMCB
+	nodeLabelKey = "node.openshift.io/os_id"
+	// machineConfigPoolLabel is the label holding the name of the machine config pool the Windows node belongs to,
+	// allowing the nodes to be grouped per pool
+	machineConfigPoolLabel = "machineconfiguration.openshift.io/pool"
 	// managedServicePrefix indicates that the service being described is managed by OpenShift. This ensures that all
 	// services created as part of Node configuration can be searched for by checking their description for this string
 	managedServicePrefix = "OpenShift managed"
 	// containerdEndpointValue is the default value for containerd endpoint required to be updated in kubelet arguments
 	containerdEndpointValue = "npipe://./pipe/containerd-containerd"
+	// defaultStreamingConnectionIdleTimeout is the idle time after which the kubelet closes streaming connections, e.g.
+	// of exec and port-forward sessions. It is lower than the kubelet default of 4h as recommended by the CIS benchmark.
+	defaultStreamingConnectionIdleTimeout = 5 * time.Minute
+	// dockerPipe is the named pipe of the Docker engine
+	dockerPipe = "docker_engine"
+	// ServiceModeCreate makes initialize-kubelet fail if the kubelet service already exists
+	ServiceModeCreate = "create"
+	// ServiceModeUpdate makes initialize-kubelet fail if the kubelet service does not exist
+	ServiceModeUpdate = "update"
+	// ServiceModeEnsure makes initialize-kubelet create the kubelet service if it does not exist, and update it
+	// otherwise
+	ServiceModeEnsure = "ensure"
+	// defaultMaxPods is the maximum number of pods the kubelet runs when not configured otherwise
+	defaultMaxPods = 250
+	// defaultSystemReservedCPU is the CPU reserved for system daemons when not configured otherwise
+	defaultSystemReservedCPU = "500m"
+	// defaultSystemReservedMemory is the memory reserved for system daemons when not configured otherwise
+	defaultSystemReservedMemory = "1Gi"
+	// proxyEnvFile is the ignition file holding the cluster wide proxy settings of the worker nodes
+	proxyEnvFile = "/etc/mco/proxy.env"
+)
+
+// defaultFeatureGates are the feature gates of the kubelet configuration, unless overridden by the kubelet systemd
+// unit
+var defaultFeatureGates = map[string]bool{
+	"LegacyNodeRoleBehavior":         false,
+	"NodeDisruptionExclusion":        true,
+	"RotateKubeletServerCertificate": true,
+	"SCTPSupport":                    true,
+	"ServiceNodeExclusion":           true,
+	"SupportPodPidsLimit":            true,
+}
+
+// proxyEnvVars are the environment variables configuring the proxy used by the kubelet
+var proxyEnvVars = []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"}
+
+// log is the logger of the bootstrapper, for the issues that do not prevent bootstrapping the node
+var log = logger.Log.WithName("bootstrapper")
+
+// deriveNodeName returns the node name expected on the given platform. It is replaced in tests, so that they do not
+// reach the metadata servers of the platforms.
+var deriveNodeName = cloud.DeriveNodeName
+
+// BootstrapResult describes the changes InitializeKubelet made to the Windows node
+type BootstrapResult struct {
+	// KubeletArgs are the args the kubelet service runs with
+	KubeletArgs []string
+	// ServiceCreated is true if the kubelet service was created, and false if the existing service was updated
+	ServiceCreated bool
+	// WrittenFiles are the paths of the files written to initialize the kubelet
+	WrittenFiles []string
+	// Changed is false if the kubelet service was already running with the desired args, environment and files, in
+	// which case it was left untouched
+	Changed bool
+}
+
+var (
+	// ErrKubeletServiceExists is returned when the kubelet service is expected to be created but already exists
+	ErrKubeletServiceExists = errors.New("kubelet service already exists")
+	// ErrKubeletServiceMissing is returned when the kubelet service is expected to be updated but does not exist
+	ErrKubeletServiceMissing = errors.New("kubelet service does not exist")
 )
 
 // These regex are global, so that we only need to compile them once
 var (
-	// cloudProviderRegex searches for the cloud provider option given to the kubelet
-	cloudProviderRegex = regexp.MustCompile(`--cloud-provider=(\w*)`)
+	// kubeletArgRegex searches for the options given to the kubelet in the form --name=value
+	kubeletArgRegex = regexp.MustCompile(`--([\w-]+)=(\S*)`)
+	// environmentFileRegex searches for the environment files referenced by a systemd unit, which may be prefixed
+	// with "-" to mark them as optional
+	environmentFileRegex = regexp.MustCompile(`(?m)^EnvironmentFile=-?(\S+)`)
+	// environmentRegex searches for the environment variable declarations of a systemd unit
+	environmentRegex = regexp.MustCompile(`(?m)^Environment=(.*)$`)
+	// environmentAssignmentRegex searches for the NAME=value assignments of an environment variable declaration,
+	// which are separated by spaces and may be surrounded by double quotes
+	environmentAssignmentRegex = regexp.MustCompile(`"([^"]*)"|(\S+)`)
+	// variableReferenceRegex searches for ${NAME} and $NAME environment variable references
+	variableReferenceRegex = regexp.MustCompile(`\$\{\w+\}|\$\w+`)
+	// featureGatesRegex searches for the feature gates given to the kubelet in its systemd unit
+	featureGatesRegex = regexp.MustCompile(`--feature-gates=(\S+)`)
+)
 
-	// cloudConfigRegex searches for the cloud config option given to the kubelet. We are assuming that the file has a
-	// conf extension.
-	cloudConfigRegex = regexp.MustCompile(`--` + cloudConfigOption + `=(\/.*conf)`)
+// KubeletArgTransformer transforms the value of an arg given to the kubelet in the ignition file's kubelet systemd
+// unit into the name and value of the arg to be given to the Windows kubelet. Returning an empty name drops the arg.
+type KubeletArgTransformer func(value string) (name, newValue string)
 
-	// verbosityRegex searches for the verbosity option given to the kubelet
-	verbosityRegex = regexp.MustCompile(`--v=(\w*)`)
-)
+// keepKubeletArg returns a transformer passing the value of the arg along to the Windows kubelet under the given name
+func keepKubeletArg(name string) KubeletArgTransformer {
+	return func(value string) (string, string) {
+		return name, value
+	}
+}
+
+// dropKubeletArg is a transformer dropping the arg
+func dropKubeletArg(string) (string, string) {
+	return "", ""
+}
+
+// defaultKubeletArgTransformers are the transformers applied to the args of the kubelet systemd unit. Args without a
+// transformer are dropped. The Linux args which are known to be dropped are listed explicitly along with the reason.
+var defaultKubeletArgTransformers = map[string]KubeletArgTransformer{
+	"cloud-provider":  keepKubeletArg("cloud-provider"),
+	cloudConfigOption: keepKubeletArg(cloudConfigOption),
+	"v":               keepKubeletArg("v"),
+	// The kubelet configuration and kubeconfig files are generated by WMCB in the Windows install directory
+	"config":               dropKubeletArg,
+	"bootstrap-kubeconfig": dropKubeletArg,
+	"kubeconfig":           dropKubeletArg,
+	// The container runtime on Windows is containerd, reachable through a named pipe
+	"container-runtime":          dropKubeletArg,
+	"container-runtime-endpoint": dropKubeletArg,
+	// The Linux node labels are resolved by systemd, WMCB sets the Windows specific labels
+	"node-labels": dropKubeletArg,
+	// The volume plugin directory is a Linux path, and FlexVolume plugins are not deployed on Windows nodes
+	"volume-plugin-dir": dropKubeletArg,
+	// The image garbage collection settings of Linux workers do not apply to Windows images
+	"minimum-container-ttl-duration": dropKubeletArg,
+}
+
+// platformCloudProviders maps the lowercased platform types to the in-tree kubelet cloud provider for the platform
+var platformCloudProviders = map[string]string{
+	"aws":     "aws",
+	"azure":   "azure",
+	"gcp":     "gce",
+	"vsphere": "vsphere",
+}
 
 //go:embed templates/kubelet_config.json
 var baseConfig string
@@ -103,34 +246,288 @@ type winNodeBootstrapper struct {
 	// ignitionFilePath is the path to the ignition file which is used to set up worker nodes
 	// https://github.com/coreos/ignition/blob/spec2x/doc/getting-started.md
 	ignitionFilePath string
+	// machineConfigPath is the path to a worker MachineConfig, whose embedded ignition is used instead of the
+	// ignition file
+	machineConfigPath string
 	// initialKubeletPath is the path to the kubelet that we'll be using to bootstrap this node
 	initialKubeletPath string
 	// nodeIP is the IP that should be used as the node object's IP. If unset, kubelet will determine the IP itself.
 	nodeIP string
-	// clusterDNS is the IP address of the DNS server used for all containers
+	// clusterDNS is the comma separated list of IP addresses of the DNS servers used for all containers
 	clusterDNS string
 	// TODO: When more services are added consider decomposing the services to a separate Service struct with common functions
 	// kubeletSVC is a pointer to the kubeletService struct
 	kubeletSVC *kubeletService
 	// svcMgr is used to interact with the Windows service API
 	svcMgr *mgr.Mgr
+	// services is used to manage the Windows services through svcMgr
+	services serviceManager
 	// installDir is the directory the the kubelet service will be installed
 	installDir string
 	// logDir is the directory that captures log outputs of Kubelet
 	// TODO: make this directory available in Artifacts
 	logDir string
+	// logFileMaxSize is the size in MB at which the kubelet log file is rotated, the kubelet default is used if 0
+	logFileMaxSize int
+	// certDir is the directory where the kubelet looks for certificates
+	certDir string
+	// staticPodDir is the directory where the kubelet looks for static pod manifests
+	staticPodDir string
 	// kubeletArgs is a slice of the arguments that will be passed to the kubelet
 	kubeletArgs []string
 	// platformType contains type of the platform where the cluster is deployed
 	platformType string
+	// enforceNodeAllocatable is the list of node allocatable enforcement levels passed to the kubelet config
+	enforceNodeAllocatable []string
+	// tlsCipherSuites is the list of cipher suites allowed for the kubelet's serving TLS
+	tlsCipherSuites []string
+	// tlsMinVersion is the minimum TLS version supported by the kubelet's server
+	tlsMinVersion string
+	// serviceMode determines how an existing or missing kubelet service is handled when initializing the kubelet
+	serviceMode string
+	// streamingConnectionIdleTimeout is the idle time after which the kubelet closes streaming connections
+	streamingConnectionIdleTimeout time.Duration
+	// containerRuntimeEndpoint is the endpoint of the container runtime, containerdEndpointValue if unset
+	containerRuntimeEndpoint string
+	// runtimeServiceName is the name of the container runtime service the kubelet service depends on. It is derived
+	// from the container runtime endpoint if unset.
+	runtimeServiceName string
+	// featureGates are the kubelet feature gates set in the kubelet systemd unit
+	featureGates map[string]bool
+	// archiveKubeletLog preserves the kubelet log of an existing kubelet service when initializing the kubelet
+	archiveKubeletLog bool
+	// kubeletArgTransformers are transformers overriding the default ones for the kubelet systemd unit args
+	kubeletArgTransformers map[string]KubeletArgTransformer
+	// serviceEnv holds the environment variables, as KEY=value pairs, that the kubelet service is started with
+	serviceEnv []string
+	// checkDNS enables checking that the cluster DNS server is reachable before the kubelet service is set up
+	checkDNS bool
+	// checkAPIServer enables checking that the API server of the bootstrap kubeconfig is reachable before the kubelet
+	// service is set up
+	checkAPIServer bool
+	// extraKubeletArgs are args appended to the generated kubelet args, overriding generated args with the same name
+	extraKubeletArgs []string
+	// maxPods is the maximum number of pods the kubelet runs. The default is used if unset.
+	maxPods int
+	// systemReservedCPU is the CPU reserved for system daemons. The default is used if unset.
+	systemReservedCPU string
+	// systemReservedMemory is the memory reserved for system daemons. The default is used if unset.
+	systemReservedMemory string
+	// startCordoned registers the node with the cordoned taint
+	startCordoned bool
+	// machineConfigPool is the name of the machine config pool the node is labelled with, if any
+	machineConfigPool string
+	// extraNodeLabels are labels applied to the node in addition to the ones WMCB applies
+	extraNodeLabels map[string]string
+	// registerWithTaints are taints the node registers with in addition to the os=Windows taint
+	registerWithTaints []string
+	// containerdPath is the path of the containerd binary whose version is checked
+	containerdPath string
+	// minContainerdVersion is the minimum containerd version required by the kubelet. No check is done if unset.
+	minContainerdVersion string
+	// skipNodeNameLookup leaves the hostname-override arg out instead of querying the metadata servers for the node
+	// name, so that validating the inputs has no side effects
+	skipNodeNameLookup bool
+}
+
+// Option sets optional configuration on the winNodeBootstrapper created by NewWinNodeBootstrapper
+type Option func(*winNodeBootstrapper)
+
+// WithEnforceNodeAllocatable sets the node allocatable enforcement levels, pods or none. By default no node allocatable
+// level is enforced on Windows.
+func WithEnforceNodeAllocatable(enforceNodeAllocatable []string) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.enforceNodeAllocatable = enforceNodeAllocatable
+	}
+}
+
+// WithTLSConfig restricts the cipher suites and the minimum TLS version used by the kubelet's server. Empty values
+// leave the kubelet defaults in place.
+func WithTLSConfig(tlsCipherSuites []string, tlsMinVersion string) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.tlsCipherSuites = tlsCipherSuites
+		wmcb.tlsMinVersion = tlsMinVersion
+	}
+}
+
+// WithMaxPods sets the maximum number of pods the kubelet runs. The default of 250 is used if maxPods is 0.
+func WithMaxPods(maxPods int) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.maxPods = maxPods
+	}
+}
+
+// WithSystemReserved sets the CPU and memory reserved for system daemons, given as resource quantities. The defaults
+// of 500m CPU and 1Gi memory are used for the unset values.
+func WithSystemReserved(cpu, memory string) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.systemReservedCPU = cpu
+		wmcb.systemReservedMemory = memory
+	}
+}
+
+// WithStartCordoned makes the kubelet register the node with a NoSchedule taint, so that no workloads are scheduled on
+// it until the taint is removed, which WMCB leaves to the cluster side, e.g. WMCO. The kubelet only applies this when
+// registering the node.
+func WithStartCordoned(startCordoned bool) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.startCordoned = startCordoned
+	}
+}
+
+// WithNodeLabels sets extra labels applied to the node, e.g. its zone or instance type. They take precedence over the
+// labels WMCB applies, except for the os_id label that identifies the Windows nodes.
+func WithNodeLabels(nodeLabels map[string]string) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.extraNodeLabels = nodeLabels
+	}
+}
+
+// WithRegisterWithTaints sets extra taints, in the form key=value:effect, the node registers with. The os=Windows taint
+// is always applied, with the NoSchedule effect unless an os=Windows taint with another effect is given.
+func WithRegisterWithTaints(registerWithTaints []string) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.registerWithTaints = registerWithTaints
+	}
+}
+
+// WithMachineConfigPool labels the node with the name of the machine config pool it belongs to, so that Windows nodes
+// can be managed per pool. Like other node labels, it is applied by the kubelet when registering the node.
+func WithMachineConfigPool(machineConfigPool string) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.machineConfigPool = machineConfigPool
+	}
+}
+
+// WithStaticPodDir sets the directory where the kubelet looks for static pod manifests. It defaults to
+// etc\kubernetes\manifests in the install dir.
+func WithStaticPodDir(staticPodDir string) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		if staticPodDir != "" {
+			wmcb.staticPodDir = staticPodDir
+		}
+	}
+}
+
+// WithLogDir sets the directory the kubelet log is written to. It defaults to \var\log\kubelet on the drive of the
+// install directory.
+func WithLogDir(logDir string) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		if logDir != "" {
+			wmcb.logDir = logDir
+		}
+	}
+}
+
+// WithLogFileMaxSize sets the size in MB at which the kubelet log file is rotated. The kubelet default of 1800 MB is
+// used if the size is 0.
+func WithLogFileMaxSize(logFileMaxSize int) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.logFileMaxSize = logFileMaxSize
+	}
+}
+
+// WithServiceMode sets how InitializeKubelet handles the kubelet service. ServiceModeCreate requires the service to
+// not exist, ServiceModeUpdate requires it to exist and ServiceModeEnsure, the default, accepts both.
+func WithServiceMode(serviceMode string) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.serviceMode = serviceMode
+	}
+}
+
+// WithKubeletLogArchive makes InitializeKubelet archive the log of an existing kubelet service to
+// kubelet.log.<timestamp> before restarting it, so that the logs of each initialization can be told apart
+func WithKubeletLogArchive(archiveKubeletLog bool) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.archiveKubeletLog = archiveKubeletLog
+	}
+}
+
+// WithStreamingConnectionIdleTimeout sets the idle time after which the kubelet closes streaming connections, such as
+// exec and port-forward sessions. The default of 5 minutes is used if the timeout is 0.
+func WithStreamingConnectionIdleTimeout(timeout time.Duration) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.streamingConnectionIdleTimeout = timeout
+	}
+}
+
+// WithContainerRuntimeEndpoint sets the npipe:// or tcp:// endpoint of the container runtime used by the kubelet,
+// e.g. for a custom containerd pipe name. It defaults to the containerd named pipe.
+func WithContainerRuntimeEndpoint(containerRuntimeEndpoint string) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.containerRuntimeEndpoint = containerRuntimeEndpoint
+	}
+}
+
+// WithRuntimeServiceName sets the name of the Windows service of the container runtime the kubelet service depends on,
+// e.g. for a runtime registered under a custom name. It defaults to containerd, or docker for the Docker engine pipe.
+func WithRuntimeServiceName(runtimeServiceName string) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.runtimeServiceName = runtimeServiceName
+	}
+}
+
+// WithDNSCheck makes InitializeKubelet check that the cluster DNS server answers DNS queries from the Windows host
+// before setting up the kubelet service. It requires the cluster DNS to be given.
+func WithDNSCheck(checkDNS bool) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.checkDNS = checkDNS
+	}
+}
+
+// WithAPIServerCheck sets whether InitializeKubelet checks that the API server of the bootstrap kubeconfig given in the
+// ignition accepts connections from the Windows host before setting up the kubelet service. The check is disabled by
+// default, as the API server may not be reachable until the kubelet is started, e.g. through a proxy it sets up.
+func WithAPIServerCheck(checkAPIServer bool) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.checkAPIServer = checkAPIServer
+	}
+}
+
+// WithExtraKubeletArgs appends the given args, in the form --name=value or --name, to the kubelet args. An extra arg
+// takes precedence over the args generated by WMCB and derived from the ignition file, and over earlier extra args,
+// with the same name.
+func WithExtraKubeletArgs(extraKubeletArgs []string) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.extraKubeletArgs = append(wmcb.extraKubeletArgs, extraKubeletArgs...)
+	}
+}
+
+// WithContainerdVersionCheck makes InitializeKubelet check that the version of the containerd binary at the given
+// path is at least the given minimum version before setting up the kubelet service
+func WithContainerdVersionCheck(containerdPath, minContainerdVersion string) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.containerdPath = containerdPath
+		wmcb.minContainerdVersion = minContainerdVersion
+	}
+}
+
+// WithMachineConfig sets the path to a worker MachineConfig, whose embedded ignition is used to set up the node in
+// place of an ignition file
+func WithMachineConfig(machineConfigPath string) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		wmcb.machineConfigPath = machineConfigPath
+	}
+}
+
+// WithKubeletArgTransformer registers a transformer for the given arg of the kubelet systemd unit, overriding the
+// default handling of the arg. This allows Linux kubelet args to be mapped to Windows kubelet args, or dropped.
+func WithKubeletArgTransformer(name string, transformer KubeletArgTransformer) Option {
+	return func(wmcb *winNodeBootstrapper) {
+		if wmcb.kubeletArgTransformers == nil {
+			wmcb.kubeletArgTransformers = make(map[string]KubeletArgTransformer)
+		}
+		wmcb.kubeletArgTransformers[name] = transformer
+	}
 }
 
 // NewWinNodeBootstrapper takes the dir to install the kubelet to, the verbosity and paths to the ignition and kubelet
-// files, an optional node IP, an optional clusterDNS, along with the CNI options as inputs, and generates the
-// winNodeBootstrapper object. The CNI options are populated only in the configure-cni command. The inputs to
-// NewWinNodeBootstrapper are ignored while using the uninstall kubelet functionality.
+// files, an optional node IP, an optional comma separated clusterDNS list, along with the CNI options as inputs, and generates the
+// winNodeBootstrapper object. The CNI options are populated only in the configure-cni command. Any additional
+// optional configuration is given through opts. The inputs to NewWinNodeBootstrapper are ignored while using the
+// uninstall kubelet functionality.
 func NewWinNodeBootstrapper(k8sInstallDir, ignitionFile, kubeletPath, kubeletVerbosity, nodeIP, clusterDNS,
-	platformType string) (*winNodeBootstrapper, error) {
+	platformType string, opts ...Option) (*winNodeBootstrapper, error) {
 	// If nodeIP is set, ensure that it is a valid IP
 	if nodeIP != "" {
 		if parsed := net.ParseIP(nodeIP); parsed == nil {
@@ -138,42 +535,245 @@ func NewWinNodeBootstrapper(k8sInstallDir, ignitionFile, kubeletPath, kubeletVer
 		}
 	}
 
-	// If clusterDNS is set, ensure that it is a valid IP
-	if clusterDNS != "" {
-		if parsed := net.ParseIP(clusterDNS); parsed == nil {
-			return nil, fmt.Errorf("clusterDNS value %s is not a valid IP format", clusterDNS)
+	// If clusterDNS is set, ensure that each entry is a valid IP
+	for _, dnsServer := range splitClusterDNS(clusterDNS) {
+		if parsed := net.ParseIP(dnsServer); parsed == nil {
+			return nil, fmt.Errorf("clusterDNS value %s is not a valid IP format", dnsServer)
 		}
 	}
 
-	svcMgr, err := mgr.Connect()
-	if err != nil {
-		return nil, fmt.Errorf("could not connect to Windows SCM: %s", err)
-	}
 	bootstrapper := winNodeBootstrapper{
 		kubeconfigPath:     filepath.Join(k8sInstallDir, "kubeconfig"),
 		kubeletConfPath:    filepath.Join(k8sInstallDir, "kubelet.conf"),
 		kubeletVerbosity:   kubeletVerbosity,
 		ignitionFilePath:   ignitionFile,
 		installDir:         k8sInstallDir,
-		logDir:             "C:\\var\\log\\kubelet",
+		logDir:             installDrive(k8sInstallDir) + logDirectory,
+		certDir:            installDrive(k8sInstallDir) + certDirectory,
+		staticPodDir:       filepath.Join(k8sInstallDir, "etc", "kubernetes", "manifests"),
 		initialKubeletPath: kubeletPath,
-		svcMgr:             svcMgr,
 		nodeIP:             nodeIP,
 		clusterDNS:         clusterDNS,
 		platformType:       platformType,
+		serviceMode:        ServiceModeEnsure,
+	}
+	for _, opt := range opts {
+		opt(&bootstrapper)
+	}
+
+	if err := validateEnforceNodeAllocatable(bootstrapper.enforceNodeAllocatable); err != nil {
+		return nil, err
+	}
+
+	if err := validateTLSConfig(bootstrapper.tlsCipherSuites, bootstrapper.tlsMinVersion); err != nil {
+		return nil, err
+	}
+
+	if err := validateTaints(bootstrapper.registerWithTaints); err != nil {
+		return nil, err
+	}
+
+	for _, arg := range bootstrapper.extraKubeletArgs {
+		if !strings.HasPrefix(arg, "--") || kubeletArgName(arg) == "--" {
+			return nil, fmt.Errorf("invalid extra kubelet arg %s, must be in the form --name=value or --name", arg)
+		}
+	}
+
+	for key, value := range bootstrapper.extraNodeLabels {
+		errs := append(validation.IsQualifiedName(key), validation.IsValidLabelValue(value)...)
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("invalid node label %s=%s: %s", key, value, strings.Join(errs, ", "))
+		}
+	}
+
+	if bootstrapper.machineConfigPool != "" {
+		if errs := validation.IsDNS1123Label(bootstrapper.machineConfigPool); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid machine config pool %s: %s", bootstrapper.machineConfigPool,
+				strings.Join(errs, ", "))
+		}
+	}
+
+	if err := validateKubeletResources(bootstrapper.maxPods, bootstrapper.systemReservedCPU,
+		bootstrapper.systemReservedMemory); err != nil {
+		return nil, err
+	}
+
+	if bootstrapper.minContainerdVersion != "" {
+		if _, err := semver.NewVersion(bootstrapper.minContainerdVersion); err != nil {
+			return nil, fmt.Errorf("invalid minimum containerd version %s: %v", bootstrapper.minContainerdVersion,
+				err)
+		}
+	}
+
+	if bootstrapper.logFileMaxSize < 0 {
+		return nil, fmt.Errorf("invalid kubelet log file max size %d, must not be negative",
+			bootstrapper.logFileMaxSize)
+	}
+
+	if bootstrapper.streamingConnectionIdleTimeout < 0 {
+		return nil, fmt.Errorf("invalid streaming connection idle timeout %s, must not be negative",
+			bootstrapper.streamingConnectionIdleTimeout)
+	}
+
+	if bootstrapper.containerRuntimeEndpoint != "" {
+		if err := validateContainerRuntimeEndpoint(bootstrapper.containerRuntimeEndpoint); err != nil {
+			return nil, err
+		}
+	}
+
+	if ignitionFile != "" && bootstrapper.machineConfigPath != "" {
+		return nil, fmt.Errorf("only one of the ignition file and the MachineConfig can be given")
+	}
+
+	if bootstrapper.checkDNS && clusterDNS == "" {
+		return nil, fmt.Errorf("clusterDNS must be set to check that it is reachable")
+	}
+
+	switch bootstrapper.serviceMode {
+	case ServiceModeCreate, ServiceModeUpdate, ServiceModeEnsure:
+	default:
+		return nil, fmt.Errorf("invalid service mode %s, must be one of %s, %s or %s", bootstrapper.serviceMode,
+			ServiceModeCreate, ServiceModeUpdate, ServiceModeEnsure)
+	}
+
+	svcMgr, err := mgr.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to Windows SCM: %s", err)
 	}
+	bootstrapper.svcMgr = svcMgr
+	bootstrapper.services = winServiceManager{svcMgr}
 
 	// If there is already a kubelet service running, find and assign it
-	bootstrapper.kubeletSVC, err = assignExistingKubelet(svcMgr)
+	bootstrapper.kubeletSVC, err = assignExistingKubelet(bootstrapper.services)
 	if err != nil {
 		return nil, fmt.Errorf("could not assign existing kubelet service: %v", err)
 	}
 	return &bootstrapper, nil
 }
 
+// splitClusterDNS returns the IP addresses in the comma separated clusterDNS list
+func splitClusterDNS(clusterDNS string) []string {
+	var dnsServers []string
+	for _, dnsServer := range strings.Split(clusterDNS, ",") {
+		if dnsServer = strings.TrimSpace(dnsServer); dnsServer != "" {
+			dnsServers = append(dnsServers, dnsServer)
+		}
+	}
+	return dnsServers
+}
+
+// installDrive returns the drive of the given install dir, so that the kubelet directories are created on the same
+// drive as the install dir. The default drive is returned if the install dir does not specify one.
+func installDrive(installDir string) string {
+	if len(installDir) >= 2 && installDir[1] == ':' {
+		return installDir[:2]
+	}
+	return defaultDrive
+}
+
+// validateEnforceNodeAllocatable ensures that the given node allocatable enforcement levels are supported on Windows.
+// The system-reserved and kube-reserved levels are enforced through cgroups, which do not exist on Windows, and require
+// cgroupsPerQOS which is disabled on Windows.
+func validateEnforceNodeAllocatable(enforceNodeAllocatable []string) error {
+	for _, level := range enforceNodeAllocatable {
+		switch level {
+		case "pods":
+		case "none":
+			if len(enforceNodeAllocatable) > 1 {
+				return fmt.Errorf("enforce node allocatable level none cannot be combined with other levels")
+			}
+		case "system-reserved", "kube-reserved":
+			return fmt.Errorf("enforce node allocatable level %s is not supported on Windows, which has no cgroups",
+				level)
+		default:
+			return fmt.Errorf("invalid enforce node allocatable level %s", level)
+		}
+	}
+	return nil
+}
+
+// validateKubeletResources returns an error if the maximum number of pods is negative, or if the system reserved
+// resources are not valid resource quantities
+func validateKubeletResources(maxPods int, systemReservedCPU, systemReservedMemory string) error {
+	if maxPods < 0 {
+		return fmt.Errorf("invalid max pods %d, must not be negative", maxPods)
+	}
+	for name, quantity := range map[string]string{"cpu": systemReservedCPU, "memory": systemReservedMemory} {
+		if quantity == "" {
+			continue
+		}
+		if _, err := resource.ParseQuantity(quantity); err != nil {
+			return fmt.Errorf("invalid system reserved %s %s: %v", name, quantity, err)
+		}
+	}
+	return nil
+}
+
+// validateTLSConfig ensures that the given cipher suites and minimum TLS version are accepted by the kubelet
+func validateTLSConfig(tlsCipherSuites []string, tlsMinVersion string) error {
+	// The kubelet accepts the cipher suite names as they are defined in crypto/tls
+	knownCipherSuites := make(map[string]bool)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		knownCipherSuites[suite.Name] = true
+	}
+	for _, cipherSuite := range tlsCipherSuites {
+		if !knownCipherSuites[cipherSuite] {
+			return fmt.Errorf("unknown TLS cipher suite %s", cipherSuite)
+		}
+	}
+
+	switch tlsMinVersion {
+	case "", "VersionTLS10", "VersionTLS11", "VersionTLS12", "VersionTLS13":
+	default:
+		return fmt.Errorf("invalid TLS min version %s, must be one of VersionTLS10, VersionTLS11, VersionTLS12 or "+
+			"VersionTLS13", tlsMinVersion)
+	}
+	return nil
+}
+
+// validateTaints ensures that the given taints are in the form key=value:effect accepted by the kubelet. The os key is
+// reserved for the os=Windows taint, and no two taints may have the same key and effect, as the kubelet would reject
+// them.
+func validateTaints(taints []string) error {
+	seen := make(map[string]string, len(taints))
+	for _, taint := range taints {
+		keyValue, effect, hasEffect := strings.Cut(taint, ":")
+		key, value, hasValue := strings.Cut(keyValue, "=")
+		if !hasEffect || !hasValue {
+			return fmt.Errorf("invalid taint %s, must be in the form key=value:effect", taint)
+		}
+		errs := append(validation.IsQualifiedName(key), validation.IsValidLabelValue(value)...)
+		if len(errs) > 0 {
+			return fmt.Errorf("invalid taint %s: %s", taint, strings.Join(errs, ", "))
+		}
+		switch effect {
+		case "NoSchedule", "PreferNoSchedule", "NoExecute":
+		default:
+			return fmt.Errorf("invalid taint %s, the effect must be one of NoSchedule, PreferNoSchedule or NoExecute",
+				taint)
+		}
+		if key == windowsTaintKey && !strings.HasPrefix(taint, windowsTaintPrefix) {
+			return fmt.Errorf("invalid taint %s, the %s key is reserved for the %s taint", taint, key,
+				strings.TrimSuffix(windowsTaintPrefix, ":"))
+		}
+		if other, ok := seen[taintKeyEffect(taint)]; ok {
+			return fmt.Errorf("invalid taint %s, it has the same key and effect as %s", taint, other)
+		}
+		seen[taintKeyEffect(taint)] = taint
+	}
+	return nil
+}
+
+// taintKeyEffect returns the key and effect of the given taint in the form key:effect, which identify a taint
+func taintKeyEffect(taint string) string {
+	keyValue, effect, _ := strings.Cut(taint, ":")
+	key, _, _ := strings.Cut(keyValue, "=")
+	return key + ":" + effect
+}
+
 // assignExistingKubelet finds the existing kubelet service from the Windows Service Manager,
 // assigns its value to the kubeletService struct and returns it.
-func assignExistingKubelet(svcMgr *mgr.Mgr) (*kubeletService, error) {
+func assignExistingKubelet(svcMgr serviceManager) (*kubeletService, error) {
 	ksvc, err := svcMgr.OpenService(KubeletServiceName)
 	if err != nil {
 		// Do not return error if the service is not installed.
@@ -206,14 +806,32 @@ type fileTranslation struct {
 type kubeletConf struct {
 	// ClientCAFile specifies location to client certificate
 	ClientCAFile string
-	// ClusterDNS is the IP address of the DNS server used for all containers
+	// ClusterDNS is the list of IP addresses of the DNS servers used for all containers
 	ClusterDNS string
+	// EnforceNodeAllocatable is the list of node allocatable enforcement levels
+	EnforceNodeAllocatable string
+	// TLSCipherSuites is the list of cipher suites allowed for the kubelet's serving TLS
+	TLSCipherSuites string
+	// TLSMinVersion is the minimum TLS version supported by the kubelet's server
+	TLSMinVersion string
+	// MaxPods is the maximum number of pods the kubelet runs
+	MaxPods int
+	// SystemReservedCPU is the CPU reserved for system daemons
+	SystemReservedCPU string
+	// SystemReservedMemory is the memory reserved for system daemons
+	SystemReservedMemory string
+	// StaticPodPath is the directory where the kubelet looks for static pod manifests
+	StaticPodPath string
+	// FeatureGates is the list of the feature gates enabled or disabled for the kubelet
+	FeatureGates string
+	// StreamingConnectionIdleTimeout is the idle time after which the kubelet closes streaming connections
+	StreamingConnectionIdleTimeout string
 }
 
-// createKubeletConf creates config file for kubelet, with Windows specific configuration
+// renderKubeletConf returns the contents of the config file for kubelet, with Windows specific configuration
 // Add values in kubelet_config.json files, for additional static fields.
 // Add fields in kubeletConf struct for variable fields
-func (wmcb *winNodeBootstrapper) createKubeletConf() ([]byte, error) {
+func (wmcb *winNodeBootstrapper) renderKubeletConf() ([]byte, error) {
 	kubeletConfTmpl := template.New("kubeletconf")
 
 	// Parse the template
@@ -223,29 +841,46 @@ func (wmcb *winNodeBootstrapper) createKubeletConf() ([]byte, error) {
 	}
 	// Fill up the config file, using kubeletConf struct
 	variableFields := kubeletConf{
-		ClientCAFile: strings.Join(append(strings.Split(wmcb.installDir, `\`), `kubelet-ca.crt`), `\\`),
+		ClientCAFile:  strings.Join(append(strings.Split(wmcb.installDir, `\`), `kubelet-ca.crt`), `\\`),
+		TLSMinVersion: wmcb.tlsMinVersion,
+		// escape the path separators for valid JSON format
+		StaticPodPath:                  strings.ReplaceAll(wmcb.staticPodDir, `\`, `\\`),
+		MaxPods:                        defaultMaxPods,
+		SystemReservedCPU:              defaultSystemReservedCPU,
+		SystemReservedMemory:           defaultSystemReservedMemory,
+		FeatureGates:                   renderFeatureGates(wmcb.featureGates),
+		StreamingConnectionIdleTimeout: defaultStreamingConnectionIdleTimeout.String(),
 	}
-	// check clusterDNS
-	if wmcb.clusterDNS != "" {
-		// surround with double-quotes for valid JSON format
-		variableFields.ClusterDNS = "\"" + wmcb.clusterDNS + "\""
+	if wmcb.streamingConnectionIdleTimeout != 0 {
+		variableFields.StreamingConnectionIdleTimeout = wmcb.streamingConnectionIdleTimeout.String()
 	}
-	// Create kubelet.conf file
-	kubeletConfPath := filepath.Join(wmcb.installDir, "kubelet.conf")
-	kubeletConfFile, err := os.Create(kubeletConfPath)
-	if err != nil {
-		return nil, fmt.Errorf("error creating %s: %v", kubeletConfPath, err)
+	if wmcb.maxPods != 0 {
+		variableFields.MaxPods = wmcb.maxPods
 	}
-	err = kubeletConfTmpl.Execute(kubeletConfFile, variableFields)
-	if err != nil {
-		return nil, fmt.Errorf("error writing data to %v file: %v", kubeletConfPath, err)
+	if wmcb.systemReservedCPU != "" {
+		variableFields.SystemReservedCPU = wmcb.systemReservedCPU
 	}
-
-	kubeletConfData, err := ioutil.ReadFile(kubeletConfFile.Name())
-	if err != nil {
-		return nil, fmt.Errorf("error reading data from %v file: %v", kubeletConfPath, err)
+	if wmcb.systemReservedMemory != "" {
+		variableFields.SystemReservedMemory = wmcb.systemReservedMemory
+	}
+	if len(wmcb.enforceNodeAllocatable) > 0 {
+		// surround each level with double-quotes for valid JSON format
+		variableFields.EnforceNodeAllocatable = "\"" + strings.Join(wmcb.enforceNodeAllocatable, "\",\"") + "\""
+	}
+	if len(wmcb.tlsCipherSuites) > 0 {
+		// surround each cipher suite with double-quotes for valid JSON format
+		variableFields.TLSCipherSuites = "\"" + strings.Join(wmcb.tlsCipherSuites, "\",\"") + "\""
+	}
+	// check clusterDNS
+	if dnsServers := splitClusterDNS(wmcb.clusterDNS); len(dnsServers) > 0 {
+		// surround each DNS server with double-quotes for valid JSON format
+		variableFields.ClusterDNS = "\"" + strings.Join(dnsServers, "\",\"") + "\""
+	}
+	var kubeletConfData bytes.Buffer
+	if err = kubeletConfTmpl.Execute(&kubeletConfData, variableFields); err != nil {
+		return nil, err
 	}
-	return kubeletConfData, nil
+	return kubeletConfData.Bytes(), nil
 }
 
 // translateFile decodes an ignition "Storage.Files.Contents.Source" field and transforms it via the function provided.
@@ -283,28 +918,67 @@ func convertIgnition2to3(ign2config ignitionCfgv2_4Types.Config) (ignitionCfgv3T
 	return ign3_1config, nil
 }
 
-// parseIgnitionFileContents parses the ignition file contents gathering the required kubelet args, and writing
-// the contents of the described files to the k8s installation directory
-func (wmcb *winNodeBootstrapper) parseIgnitionFileContents(ignitionFileContents []byte,
-	filesToTranslate map[string]fileTranslation) error {
+// parseIgnitionConfig parses the raw ignition file contents into the Ignition spec v3.1 config we operate on. Spec
+// v3.3 and v3.2 configs are read as v3.1 configs and must not use the fields added by those specs, and spec v2.x
+// configs are converted to v3.1.
+func parseIgnitionConfig(ignitionFileContents []byte) (ignitionCfgv3Types.Config, error) {
 	// Parse raw file contents for Ignition spec v3.1 config
 	configuration, report, err := ignitionCfgv3.Parse(ignitionFileContents)
-	if err != nil && err.Error() == ignitionCfgError.ErrUnknownVersion.Error() {
-		// the Ignition config spec v2.4 parser supports parsing all spec versions up to 2.4
-		configV2, reportV2, errV2 := ignitionCfgv2_4.Parse(ignitionFileContents)
-		if errV2 != nil || reportV2.IsFatal() {
-			return errors.Errorf("failed to parse Ign spec v2 config: %v\nReport: %v", errV2, reportV2)
+	if err == nil && !report.IsFatal() {
+		return configuration, nil
+	}
+	if err == nil || err.Error() != ignitionCfgError.ErrUnknownVersion.Error() {
+		return ignitionCfgv3Types.Config{}, errors.Errorf("failed to parse Ign spec v3.1 config: %v\nReport: %v",
+			err, report)
+	}
+
+	var versionedConfig struct {
+		Ignition struct {
+			Version string `json:"version"`
+		} `json:"ignition"`
+	}
+	if err := json.Unmarshal(ignitionFileContents, &versionedConfig); err != nil {
+		return ignitionCfgv3Types.Config{}, errors.Errorf("failed to get Ign config version: %v", err)
+	}
+	switch version := versionedConfig.Ignition.Version; version {
+	case "3.3.0", "3.2.0":
+		// The vendored Ignition library predates spec v3.2. The storage files and systemd units we read from the
+		// config are unchanged since v3.1, so the config is decoded into the v3.1 types and validated against that
+		// spec. Fields added by the later specs are rejected, as their contents would otherwise be silently lost.
+		var laterConfig ignitionCfgv3Types.Config
+		decoder := json.NewDecoder(bytes.NewReader(ignitionFileContents))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&laterConfig); err != nil {
+			return ignitionCfgv3Types.Config{}, errors.Errorf("failed to parse Ign spec v%s config as v3.1: %v",
+				version, err)
 		}
-		configuration, err = convertIgnition2to3(configV2)
-		if err != nil {
-			return err
+		laterConfig.Ignition.Version = ignitionCfgv3Types.MaxVersion.String()
+		if report := ignitionCfgValidate.ValidateWithContext(laterConfig, nil); report.IsFatal() {
+			return ignitionCfgv3Types.Config{}, errors.Errorf("invalid Ign spec v%s config: %v\nReport: %v",
+				version, ignitionCfgError.ErrInvalid, report)
 		}
-	} else if err != nil || report.IsFatal() {
-		return errors.Errorf("failed to parse Ign spec v3.1 config: %v\nReport: %v", err, report)
+		return laterConfig, nil
+	}
+
+	// the Ignition config spec v2.4 parser supports parsing all spec versions up to 2.4
+	configV2, reportV2, errV2 := ignitionCfgv2_4.Parse(ignitionFileContents)
+	if errV2 != nil || reportV2.IsFatal() {
+		return ignitionCfgv3Types.Config{}, errors.Errorf("failed to parse Ign spec v2 config: %v\nReport: %v",
+			errV2, reportV2)
+	}
+	return convertIgnition2to3(configV2)
+}
+
+// translateIgnition parses the ignition file contents gathering the required kubelet args, and returns the translated
+// contents of the described files by destination path
+func (wmcb *winNodeBootstrapper) translateIgnition(ignitionFileContents []byte,
+	filesToTranslate map[string]fileTranslation) (map[string][]byte, error) {
+	configuration, err := parseIgnitionConfig(ignitionFileContents)
+	if err != nil {
+		return nil, err
 	}
 
 	// Find the kubelet systemd service specified in the ignition file and grab the variable arguments
-	// TODO: Refactor this to handle environment variables in argument values
 	var kubeletUnit *ignitionCfgv3Types.Unit
 	for _, unit := range configuration.Systemd.Units {
 		if unit.Name == kubeletSystemdName {
@@ -313,149 +987,545 @@ func (wmcb *winNodeBootstrapper) parseIgnitionFileContents(ignitionFileContents
 		}
 	}
 	if kubeletUnit == nil {
-		return errors.Errorf("ignition missing kubelet systemd unit file")
+		return nil, errors.Errorf("ignition missing kubelet systemd unit file")
 	}
-	args, err := wmcb.parseKubeletArgs(*kubeletUnit)
+	unitEnv, err := wmcb.unitEnvironment(configuration, *kubeletUnit)
 	if err != nil {
-		return errors.Wrap(err, "error parsing kubelet systemd unit args")
+		return nil, errors.Wrap(err, "error parsing kubelet systemd unit environment")
 	}
-
-	// TODO: This is being done because this function is trying to handle both file creation and kubelet arg parsing.
-	//       The cloud-config file translation is dependent on the file path given by the ignition file, but for the
-	//       kubelet args we want to alter that path. Because of how this function is structured right now, this is
-	//       resulting in the altering of the path to be delayed, in order to not have to parse the kubelet unit again.
-	//       This should not have been done this way, the setting of the args map should be contained to
-	//       parseKubeletArgs. This should be corrected as part of https://issues.redhat.com/browse/WINC-670
-	// Check for the presence of "--cloud-config" option and if it is present append the value to
-	// filesToTranslate. This option is only present for Azure and hence we cannot assume it as a file that
-	// requires translation across clouds.
-	if cloudConfigPath, ok := args[cloudConfigOption]; ok {
-		cloudConfigFilename := filepath.Base(cloudConfigPath)
-		// Check if we were able to get a valid filename. Read filepath.Base() godoc for explanation.
-		if cloudConfigFilename == "." || os.IsPathSeparator(cloudConfigFilename[0]) {
-			return fmt.Errorf("could not get cloud config filename from %s", cloudConfigPath)
-		}
-		// As the cloud-config option is a path it must be changed to point to the local file
-		localCloudConfigDestination := filepath.Join(wmcb.installDir, cloudConfigFilename)
-		args[cloudConfigOption] = localCloudConfigDestination
-
-		// Ensure that we create the cloud-config file
-		filesToTranslate[cloudConfigPath] = fileTranslation{
-			dest: localCloudConfigDestination,
-		}
+	// Expand the environment variable references in the arg values
+	expandedUnit := *kubeletUnit
+	if expandedUnit.Contents != nil {
+		expandedContents := expandUnitEnvironment(*expandedUnit.Contents, unitEnv)
+		expandedUnit.Contents = &expandedContents
+	}
+	args, err := wmcb.parseKubeletArgs(expandedUnit)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing kubelet systemd unit args")
+	}
+	cloudConfigTranslation, err := wmcb.localizeCloudConfig(args)
+	if err != nil {
+		return nil, err
+	}
+	// Ensure that we create the cloud config file
+	for path, translation := range cloudConfigTranslation {
+		filesToTranslate[path] = translation
+	}
+	wmcb.featureGates, err = parseUnitFeatureGates(expandedUnit)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing kubelet feature gates")
+	}
+	if err = wmcb.ensureCloudProvider(args); err != nil {
+		return nil, err
+	}
+	wmcb.serviceEnv, err = wmcb.parseServiceEnv(configuration, *kubeletUnit)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing kubelet service environment")
 	}
 
 	// Generate the full list of kubelet arguments from the arguments present in the ignition file
 	wmcb.kubeletArgs, err = wmcb.generateInitialKubeletArgs(args)
 	if err != nil {
-		return fmt.Errorf("cannot generate initial kubelet args: %w", err)
+		return nil, fmt.Errorf("cannot generate initial kubelet args: %w", err)
 	}
 
-	// For each new file in the ignition file check if is a file we are interested in, if so, decode, transform,
-	// and write it to the destination path
+	// For each new file in the ignition file check if is a file we are interested in, if so, decode and transform it
+	translatedFiles := make(map[string]bool)
+	translatedContents := make(map[string][]byte)
 	for _, ignFile := range configuration.Storage.Files {
 		if filePair, ok := filesToTranslate[ignFile.Node.Path]; ok {
+			translatedFiles[ignFile.Node.Path] = true
 			if ignFile.Contents.Source == nil {
-				return fmt.Errorf("could not process %s: File is empty", ignFile.Node.Path)
+				return nil, fmt.Errorf("could not process %s: File is empty", ignFile.Node.Path)
 			}
 
 			newContents, err := wmcb.translateFile(*ignFile.Contents.Source, filePair.translationFunc)
 			if err != nil {
-				return fmt.Errorf("could not process %s: %s", ignFile.Node.Path, err)
-			}
-			if err = ioutil.WriteFile(filePair.dest, newContents, 0644); err != nil {
-				return fmt.Errorf("could not write to %s: %s", filePair.dest, err)
+				return nil, fmt.Errorf("could not process %s: %s", ignFile.Node.Path, err)
 			}
+			translatedContents[filePair.dest] = newContents
 		}
 	}
 
-	return nil
+	// Proceeding without one of the expected files would create a node that cannot join the cluster
+	var missingFiles []string
+	for path := range filesToTranslate {
+		if !translatedFiles[path] {
+			missingFiles = append(missingFiles, path)
+		}
+	}
+	if len(missingFiles) > 0 {
+		sort.Strings(missingFiles)
+		return nil, fmt.Errorf("expected files missing from the ignition storage: %s", strings.Join(missingFiles, ", "))
+	}
+	return translatedContents, nil
 }
 
-// parseKubeletArgs returns args we are interested in from the kubelet systemd unit file
-func (wmcb *winNodeBootstrapper) parseKubeletArgs(unit ignitionCfgv3Types.Unit) (map[string]string, error) {
+// parseUnitFeatureGates returns the feature gates given to the kubelet in its systemd unit
+func parseUnitFeatureGates(unit ignitionCfgv3Types.Unit) (map[string]bool, error) {
 	if unit.Contents == nil {
-		return nil, fmt.Errorf("could not process %s: Unit is empty", unit.Name)
+		return nil, nil
+	}
+	var featureGates map[string]bool
+	for _, results := range featureGatesRegex.FindAllStringSubmatch(*unit.Contents, -1) {
+		for _, featureGate := range strings.Split(results[1], ",") {
+			if featureGate = strings.TrimSpace(featureGate); featureGate == "" {
+				continue
+			}
+			nameValue := strings.SplitN(featureGate, "=", 2)
+			if len(nameValue) != 2 {
+				return nil, fmt.Errorf("invalid feature gate %s, must be in the form name=true|false", featureGate)
+			}
+			enabled, err := strconv.ParseBool(nameValue[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of feature gate %s: %v", nameValue[0], err)
+			}
+			if featureGates == nil {
+				featureGates = make(map[string]bool)
+			}
+			featureGates[nameValue[0]] = enabled
+		}
 	}
+	return featureGates, nil
+}
 
-	kubeletArgs := make(map[string]string)
-	results := cloudProviderRegex.FindStringSubmatch(*unit.Contents)
-	if len(results) == 2 {
-		kubeletArgs["cloud-provider"] = results[1]
+// renderFeatureGates returns the JSON object members of the default kubelet feature gates merged with the given
+// feature gates, which take priority, sorted by name
+func renderFeatureGates(featureGates map[string]bool) string {
+	merged := make(map[string]bool)
+	for name, enabled := range defaultFeatureGates {
+		merged[name] = enabled
+	}
+	for name, enabled := range featureGates {
+		merged[name] = enabled
+	}
+	var names []string
+	for name := range merged {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	var members []string
+	for _, name := range names {
+		members = append(members, fmt.Sprintf("%q:%t", name, merged[name]))
+	}
+	return strings.Join(members, ",")
+}
 
-	// Check for the presence of "--cloud-config" option and if it is present append the value to
-	// filesToTranslate. This option is only present for Azure and hence we cannot assume it as a file that
-	// requires translation across clouds.
-	results = cloudConfigRegex.FindStringSubmatch(*unit.Contents)
-	if len(results) == 2 {
-		kubeletArgs[cloudConfigOption] = results[1]
+// parseKubeletArgs returns args we are interested in from the kubelet systemd unit file, transformed for the Windows
+// kubelet
+func (wmcb *winNodeBootstrapper) parseKubeletArgs(unit ignitionCfgv3Types.Unit) (map[string]string, error) {
+	if unit.Contents == nil {
+		return nil, fmt.Errorf("could not process %s: Unit is empty", unit.Name)
 	}
 
-	results = verbosityRegex.FindStringSubmatch(*unit.Contents)
-	if len(results) == 2 {
-		kubeletArgs["v"] = results[1]
+	kubeletArgs := make(map[string]string)
+	for _, results := range kubeletArgRegex.FindAllStringSubmatch(*unit.Contents, -1) {
+		transformer, ok := wmcb.kubeletArgTransformers[results[1]]
+		if !ok {
+			transformer, ok = defaultKubeletArgTransformers[results[1]]
+		}
+		if !ok {
+			continue
+		}
+		if name, value := transformer(results[2]); name != "" {
+			kubeletArgs[name] = value
+		}
 	}
 	return kubeletArgs, nil
 }
 
-// initializeKubeletFiles initializes the files required by the kubelet
-func (wmcb *winNodeBootstrapper) initializeKubeletFiles() error {
-	filesToTranslate := map[string]fileTranslation{
-		"/etc/kubernetes/kubeconfig": {
-			dest: filepath.Join(wmcb.installDir, "bootstrap-kubeconfig"),
-		},
-		"/etc/kubernetes/kubelet-ca.crt": {
-			dest: filepath.Join(wmcb.installDir, "kubelet-ca.crt"),
-		},
+// localizeCloudConfig changes the --cloud-config arg, if present, to point to the install dir, and returns the
+// translation of the cloud config file of the ignition to the install dir. The kubelet of any platform can be given a
+// cloud config, so it is not assumed to be present.
+func (wmcb *winNodeBootstrapper) localizeCloudConfig(args map[string]string) (map[string]fileTranslation, error) {
+	cloudConfigPath, ok := args[cloudConfigOption]
+	if !ok {
+		return nil, nil
 	}
+	cloudConfigFilename := filepath.Base(cloudConfigPath)
+	// Check if we were able to get a valid filename. Read filepath.Base() godoc for explanation.
+	if cloudConfigFilename == "." || os.IsPathSeparator(cloudConfigFilename[0]) {
+		return nil, fmt.Errorf("could not get cloud config filename from %s", cloudConfigPath)
+	}
+	localCloudConfigDestination := filepath.Join(wmcb.installDir, cloudConfigFilename)
+	args[cloudConfigOption] = localCloudConfigDestination
+	return map[string]fileTranslation{
+		cloudConfigPath: {dest: localCloudConfigDestination},
+	}, nil
+}
 
-	// Create the manifest directory needed by kubelet for the static pods, we shouldn't override if the pod manifest
-	// directory already exists
-	podManifestDirectory := filepath.Join(wmcb.installDir, "etc", "kubernetes", "manifests")
-	if _, err := os.Stat(podManifestDirectory); os.IsNotExist(err) {
-		err := os.MkdirAll(podManifestDirectory, os.ModeDir)
-		if err != nil {
-			return fmt.Errorf("could not make pod manifest directory: %s", err)
+// unitEnvironment returns the environment variables set for the systemd unit by its Environment= declarations and
+// by the files referenced by its EnvironmentFile= declarations that are present in the ignition config. As with
+// systemd, variables from environment files take priority over declared variables, and later declarations take
+// priority over earlier ones.
+func (wmcb *winNodeBootstrapper) unitEnvironment(configuration ignitionCfgv3Types.Config,
+	unit ignitionCfgv3Types.Unit) (map[string]string, error) {
+	contents := unitContents(unit)
+	env := make(map[string]string)
+	for _, declaration := range environmentRegex.FindAllStringSubmatch(contents, -1) {
+		for _, results := range environmentAssignmentRegex.FindAllStringSubmatch(declaration[1], -1) {
+			assignment := results[1] + results[2]
+			if keyValue := strings.SplitN(assignment, "=", 2); len(keyValue) == 2 {
+				env[keyValue[0]] = keyValue[1]
+			}
 		}
 	}
 
-	err := os.MkdirAll(wmcb.installDir, os.ModeDir)
-	if err != nil {
-		return fmt.Errorf("could not make install directory: %s", err)
+	var envFiles []string
+	for _, results := range environmentFileRegex.FindAllStringSubmatch(contents, -1) {
+		envFiles = append(envFiles, results[1])
 	}
-
-	_, err = wmcb.createKubeletConf()
+	fileEnv, err := wmcb.readEnvironmentFiles(configuration, envFiles)
 	if err != nil {
-		return fmt.Errorf("error creating kubelet configuration %v", err)
+		return nil, err
 	}
+	for name, value := range fileEnv {
+		env[name] = value
+	}
+	return env, nil
+}
 
+// unitContents returns the contents of the systemd unit followed by the contents of its drop-ins
+func unitContents(unit ignitionCfgv3Types.Unit) string {
+	var contents []string
+	if unit.Contents != nil {
+		contents = append(contents, *unit.Contents)
+	}
+	for _, dropin := range unit.Dropins {
+		if dropin.Contents != nil {
+			contents = append(contents, *dropin.Contents)
+		}
+	}
+	return strings.Join(contents, "\n")
+}
+
+// readEnvironmentFiles returns the variables set in the given environment files that are present in the ignition
+// config. Variables from later files take priority.
+func (wmcb *winNodeBootstrapper) readEnvironmentFiles(configuration ignitionCfgv3Types.Config,
+	envFiles []string) (map[string]string, error) {
+	files := make(map[string]ignitionCfgv3Types.File)
+	for _, ignFile := range configuration.Storage.Files {
+		files[ignFile.Node.Path] = ignFile
+	}
+	env := make(map[string]string)
+	for _, envFile := range envFiles {
+		ignFile, ok := files[envFile]
+		if !ok || ignFile.Contents.Source == nil {
+			continue
+		}
+		contents, err := wmcb.translateFile(*ignFile.Contents.Source, nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not process %s: %s", envFile, err)
+		}
+		for _, line := range strings.Split(string(contents), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			keyValue := strings.SplitN(line, "=", 2)
+			if len(keyValue) != 2 {
+				continue
+			}
+			env[strings.TrimSpace(keyValue[0])] = strings.Trim(strings.TrimSpace(keyValue[1]), `"'`)
+		}
+	}
+	return env, nil
+}
+
+// expandUnitEnvironment returns the contents of the systemd unit with the ${NAME} and $NAME references to the given
+// environment variables replaced by their values. References to unknown variables are left as is.
+func expandUnitEnvironment(unitContents string, env map[string]string) string {
+	return variableReferenceRegex.ReplaceAllStringFunc(unitContents, func(reference string) string {
+		name := strings.Trim(reference, "${}")
+		if value, ok := env[name]; ok {
+			return value
+		}
+		return reference
+	})
+}
+
+// parseServiceEnv returns the environment variables, as sorted KEY=value pairs, that the kubelet service is started
+// with. As there is no systemd on Windows, these are the variables set for the kubelet systemd unit, along with the
+// proxy settings of the dedicated proxy ignition file which take priority.
+func (wmcb *winNodeBootstrapper) parseServiceEnv(configuration ignitionCfgv3Types.Config,
+	unit ignitionCfgv3Types.Unit) ([]string, error) {
+	unitEnv, err := wmcb.unitEnvironment(configuration, unit)
+	if err != nil {
+		return nil, err
+	}
+	proxyFileEnv, err := wmcb.readEnvironmentFiles(configuration, []string{proxyEnvFile})
+	if err != nil {
+		return nil, err
+	}
+
+	serviceEnv := make(map[string]string)
+	for name, value := range unitEnv {
+		serviceEnv[proxyEnvName(name)] = value
+	}
+	for name, value := range proxyFileEnv {
+		if name = proxyEnvName(name); isProxyEnvVar(name) {
+			serviceEnv[name] = value
+		}
+	}
+
+	var env []string
+	for name, value := range serviceEnv {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env, nil
+}
+
+// proxyEnvName returns the upper case name of the proxy environment variables, and the given name otherwise. Both the
+// upper and lower case variants of the proxy variables are in use, Windows variables are case insensitive so both
+// are given to the kubelet under the upper case name.
+func proxyEnvName(name string) string {
+	if isProxyEnvVar(strings.ToUpper(name)) {
+		return strings.ToUpper(name)
+	}
+	return name
+}
+
+// isProxyEnvVar returns true if the given name is the name of a proxy environment variable
+func isProxyEnvVar(name string) bool {
+	for _, proxyEnvVar := range proxyEnvVars {
+		if name == proxyEnvVar {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureCloudProvider ensures that a cloud provider is set when a cloud config is given to the kubelet. If the
+// ignition file does not specify the cloud provider, it is derived from the platform type.
+func (wmcb *winNodeBootstrapper) ensureCloudProvider(args map[string]string) error {
+	if _, ok := args[cloudConfigOption]; !ok {
+		return nil
+	}
+	if cloudProvider, ok := args["cloud-provider"]; ok && cloudProvider != "" {
+		return nil
+	}
+	cloudProvider, ok := platformCloudProviders[strings.ToLower(wmcb.platformType)]
+	if !ok {
+		return fmt.Errorf("--%s is set without --cloud-provider, and no cloud provider is known for platform "+
+			"type '%s'", cloudConfigOption, wmcb.platformType)
+	}
+	args["cloud-provider"] = cloudProvider
+	return nil
+}
+
+// kubeletSetup holds the files the kubelet is set up with, generated from the ignition and the options. Generating it
+// parses the ignition, which also sets the kubelet args, service environment and feature gates, and derives the node
+// name, so it is generated once per run and shared by the steps that need it.
+type kubeletSetup struct {
+	// ignitionFiles holds the contents of the files translated from the ignition, by the path they are written to
+	ignitionFiles map[string][]byte
+	// kubeletConf holds the contents of kubelet.conf, which depends on the feature gates of the ignition
+	kubeletConf []byte
+}
+
+// generateKubeletSetup parses the ignition, if one was given, and generates the files required by the kubelet
+// without writing them
+func (wmcb *winNodeBootstrapper) generateKubeletSetup() (*kubeletSetup, error) {
+	setup := &kubeletSetup{ignitionFiles: make(map[string][]byte)}
+	if wmcb.ignitionFilePath != "" || wmcb.machineConfigPath != "" {
+		ignitionFileContents, err := wmcb.readIgnition()
+		if err != nil {
+			return nil, err
+		}
+		setup.ignitionFiles, err = wmcb.translateIgnition(ignitionFileContents, wmcb.kubeletFilesToTranslate())
+		if err != nil {
+			return nil, fmt.Errorf("could not parse ignition file: %s", err)
+		}
+	}
+
+	// The kubelet configuration is generated after parsing the ignition, which holds the kubelet feature gates
+	var err error
+	setup.kubeletConf, err = wmcb.renderKubeletConf()
+	if err != nil {
+		return nil, fmt.Errorf("error generating kubelet configuration: %v", err)
+	}
+	return setup, nil
+}
+
+// files returns the contents of the files of the setup by the path they are written to, kubelet.conf being written to
+// the given install directory
+func (setup *kubeletSetup) files(installDir string) map[string][]byte {
+	files := make(map[string][]byte, len(setup.ignitionFiles)+1)
+	for path, contents := range setup.ignitionFiles {
+		files[path] = contents
+	}
+	files[filepath.Join(installDir, "kubelet.conf")] = setup.kubeletConf
+	return files
+}
+
+// initializeKubeletFiles initializes the files required by the kubelet from the given setup, and returns the paths of
+// the files written
+func (wmcb *winNodeBootstrapper) initializeKubeletFiles(setup *kubeletSetup) ([]string, error) {
+	// Create the manifest directory needed by kubelet for the static pods, we shouldn't override if the pod manifest
+	// directory already exists
+	if _, err := os.Stat(wmcb.staticPodDir); os.IsNotExist(err) {
+		err := os.MkdirAll(wmcb.staticPodDir, os.ModeDir)
+		if err != nil {
+			return nil, fmt.Errorf("could not make pod manifest directory: %s", err)
+		}
+	}
+
+	err := os.MkdirAll(wmcb.installDir, os.ModeDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not make install directory: %s", err)
+	}
+
+	var writtenFiles []string
 	if wmcb.initialKubeletPath != "" {
-		err = copyFile(wmcb.initialKubeletPath, filepath.Join(wmcb.installDir, "kubelet.exe"))
+		kubeletPath := filepath.Join(wmcb.installDir, "kubelet.exe")
+		err = copyFile(wmcb.initialKubeletPath, kubeletPath)
 		if err != nil {
-			return fmt.Errorf("could not copy kubelet: %s", err)
+			return nil, fmt.Errorf("could not copy kubelet: %s", err)
 		}
+		writtenFiles = append(writtenFiles, kubeletPath)
 	}
 
 	// Create log directory
 	err = os.MkdirAll(wmcb.logDir, os.ModeDir)
 	if err != nil {
-		return fmt.Errorf("could not make %s directory: %v", wmcb.logDir, err)
+		return nil, fmt.Errorf("could not make %s directory: %v", wmcb.logDir, err)
 	}
 
-	// Populate destination directory with the files we need
-	if wmcb.ignitionFilePath != "" {
-		ignitionFileContents, err := ioutil.ReadFile(wmcb.ignitionFilePath)
+	// Populate destination directory with the files we need, kubelet.conf last
+	var translatedFiles []string
+	for path := range setup.ignitionFiles {
+		translatedFiles = append(translatedFiles, path)
+	}
+	sort.Strings(translatedFiles)
+	files := setup.files(wmcb.installDir)
+	for _, path := range append(translatedFiles, filepath.Join(wmcb.installDir, "kubelet.conf")) {
+		if err = ioutil.WriteFile(path, files[path], 0644); err != nil {
+			return nil, fmt.Errorf("error writing data to %v file: %v", path, err)
+		}
+		writtenFiles = append(writtenFiles, path)
+	}
+	return writtenFiles, nil
+}
+
+// kubeletFilesToTranslate returns the ignition files required by the kubelet, by their path in the ignition
+func (wmcb *winNodeBootstrapper) kubeletFilesToTranslate() map[string]fileTranslation {
+	return map[string]fileTranslation{
+		"/etc/kubernetes/kubeconfig": {
+			dest: filepath.Join(wmcb.installDir, "bootstrap-kubeconfig"),
+		},
+		"/etc/kubernetes/kubelet-ca.crt": {
+			dest: filepath.Join(wmcb.installDir, "kubelet-ca.crt"),
+		},
+	}
+}
+
+// desiredKubeletFileHashes returns the hashes of the contents of the kubelet binary and of the files of the given
+// setup, by the path initializeKubeletFiles writes them to
+func (wmcb *winNodeBootstrapper) desiredKubeletFileHashes(setup *kubeletSetup) (map[string]string, error) {
+	hashes := make(map[string]string)
+	if wmcb.initialKubeletPath != "" {
+		hash, err := fileHash(wmcb.initialKubeletPath)
 		if err != nil {
-			return fmt.Errorf("could not read ignition file: %s", err)
+			return nil, fmt.Errorf("could not read kubelet: %s", err)
+		}
+		hashes[filepath.Join(wmcb.installDir, "kubelet.exe")] = hash
+	}
+	for path, contents := range setup.files(wmcb.installDir) {
+		hashes[path] = contentHash(contents)
+	}
+	return hashes, nil
+}
+
+// kubeletUpToDate reports whether the kubelet service already runs with the args, environment and files of the given
+// setup, given its existing command. The kubelet is not up to date if any of its files is missing.
+func (wmcb *winNodeBootstrapper) kubeletUpToDate(existingCmd string, setup *kubeletSetup) (bool, error) {
+	desiredFiles, err := wmcb.desiredKubeletFileHashes(setup)
+	if err != nil {
+		return false, err
+	}
+	// The existing environment is compared even if no environment is desired, as a stale one has to be removed
+	existingEnv, err := wmcb.services.ServiceEnvironment(KubeletServiceName)
+	if err != nil {
+		return false, err
+	}
+	existingFiles := make(map[string]string, len(desiredFiles))
+	for path := range desiredFiles {
+		hash, err := fileHash(path)
+		if os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("could not read %s: %v", path, err)
 		}
+		existingFiles[path] = hash
+	}
+	return kubeletStateHash(existingCmd, existingEnv, existingFiles) ==
+		kubeletStateHash(wmcb.kubeletCommand(wmcb.kubeletArgs), wmcb.serviceEnv, desiredFiles), nil
+}
+
+// kubeletStateHash returns a hash identifying the state the kubelet runs with, given its service command and
+// environment, and the hashes of its files by path. Quoting is ignored in the command, as in kubeletDrift.
+func kubeletStateHash(command string, env []string, fileHashes map[string]string) string {
+	h := sha256.New()
+	// The null character cannot be part of the fields, it separates them
+	for _, field := range normalizeKubeletCommand(command) {
+		h.Write([]byte(field + "\x00"))
+	}
+	h.Write([]byte("\x00"))
+	for _, variable := range env {
+		h.Write([]byte(variable + "\x00"))
+	}
+	h.Write([]byte("\x00"))
+	paths := make([]string, 0, len(fileHashes))
+	for path := range fileHashes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		h.Write([]byte(path + "\x00" + fileHashes[path] + "\x00"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
 
-		err = wmcb.parseIgnitionFileContents(ignitionFileContents, filesToTranslate)
+// fileHash returns the hex encoded SHA-256 hash of the contents of the given file
+func fileHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// contentHash returns the hex encoded SHA-256 hash of the given contents
+func contentHash(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:])
+}
+
+// readIgnition returns the contents of the ignition file, or the ignition embedded in the MachineConfig if one was
+// given instead
+func (wmcb *winNodeBootstrapper) readIgnition() ([]byte, error) {
+	if wmcb.machineConfigPath == "" {
+		ignitionFileContents, err := ioutil.ReadFile(wmcb.ignitionFilePath)
 		if err != nil {
-			return fmt.Errorf("could not parse ignition file: %s", err)
+			return nil, fmt.Errorf("could not read ignition file: %s", err)
 		}
+		return ignitionFileContents, nil
 	}
-	return nil
+	machineConfigContents, err := ioutil.ReadFile(wmcb.machineConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read MachineConfig: %s", err)
+	}
+	ignitionFileContents, err := ignitionFromMachineConfig(machineConfigContents)
+	if err != nil {
+		return nil, fmt.Errorf("could not extract ignition from MachineConfig: %s", err)
+	}
+	return ignitionFileContents, nil
 }
 
 // generateInitialKubeletArgs returns the kubelet args required during initial kubelet start up. args should be a map
@@ -469,7 +1539,7 @@ func (wmcb *winNodeBootstrapper) generateInitialKubeletArgs(args map[string]stri
 		"--config=" + wmcb.kubeletConfPath,
 		"--bootstrap-kubeconfig=" + filepath.Join(wmcb.installDir, "bootstrap-kubeconfig"),
 		"--kubeconfig=" + wmcb.kubeconfigPath,
-		"--cert-dir=" + certDirectory,
+		"--cert-dir=" + wmcb.certDir,
 		"--windows-service",
 		"--logtostderr=false",
 		"--log-file=" + filepath.Join(wmcb.logDir, "kubelet.log"),
@@ -477,11 +1547,11 @@ func (wmcb *winNodeBootstrapper) generateInitialKubeletArgs(args map[string]stri
 		// Windows nodes.
 		// TODO: Write a `against the cluster` e2e test which checks for the Windows node object created
 		// and check for taint.
-		"--register-with-taints=" + windowsTaints,
+		"--register-with-taints=" + wmcb.taints(),
 		// Label that WMCB uses
-		"--node-labels=" + nodeLabel,
+		"--node-labels=" + wmcb.nodeLabels(args["node-labels"]),
 		"--container-runtime=remote",
-		"--container-runtime-endpoint=" + containerdEndpointValue,
+		"--container-runtime-endpoint=" + wmcb.runtimeEndpoint(),
 		"--resolv-conf=",
 	}
 	if cloudProvider, ok := args["cloud-provider"]; ok {
@@ -504,62 +1574,252 @@ func (wmcb *winNodeBootstrapper) generateInitialKubeletArgs(args map[string]stri
 	if cloudConfigValue, ok := args[cloudConfigOption]; ok {
 		kubeletArgs = append(kubeletArgs, "--"+cloudConfigOption+"="+cloudConfigValue)
 	}
-	if nodeWorkerLabel, ok := args["node-labels"]; ok {
-		kubeletArgs = append(kubeletArgs, "--"+"node-labels"+"="+nodeWorkerLabel)
+	// Pass along any other args produced by the kubelet arg transformers
+	var transformedArgs []string
+	for name, value := range args {
+		switch name {
+		case "cloud-provider", "v", cloudConfigOption, "node-labels":
+		default:
+			transformedArgs = append(transformedArgs, "--"+name+"="+value)
+		}
 	}
+	sort.Strings(transformedArgs)
+	kubeletArgs = append(kubeletArgs, transformedArgs...)
 	if wmcb.nodeIP != "" {
 		kubeletArgs = append(kubeletArgs, "--node-ip="+wmcb.nodeIP)
 	}
+	if wmcb.logFileMaxSize != 0 {
+		kubeletArgs = append(kubeletArgs, "--log-file-max-size="+strconv.Itoa(wmcb.logFileMaxSize))
+	}
 
-	hostname, err := cloud.GetKubeletHostnameOverride(wmcb.platformType)
-	if err != nil {
-		return nil, err
+	if !wmcb.skipNodeNameLookup {
+		hostname, err := deriveNodeName(wmcb.platformType)
+		if err != nil {
+			return nil, err
+		}
+		if hostname != "" {
+			kubeletArgs = append(kubeletArgs, "--hostname-override="+hostname)
+		}
+	}
+
+	return overrideKubeletArgs(kubeletArgs, wmcb.extraKubeletArgs), nil
+}
+
+// taints returns the taints the node registers with, as a comma separated list. The os=Windows taints given by the
+// user replace the default one, allowing its effect to be changed. A taint with the same key and effect as a previous
+// one is left out, as the kubelet rejects such duplicates.
+func (wmcb *winNodeBootstrapper) taints() string {
+	var taints []string
+	for _, taint := range wmcb.registerWithTaints {
+		if strings.HasPrefix(taint, windowsTaintPrefix) {
+			taints = append(taints, taint)
+		}
+	}
+	if len(taints) == 0 {
+		taints = append(taints, windowsTaints)
+	}
+	for _, taint := range wmcb.registerWithTaints {
+		if !strings.HasPrefix(taint, windowsTaintPrefix) {
+			taints = append(taints, taint)
+		}
 	}
-	if hostname != "" {
-		kubeletArgs = append(kubeletArgs, "--hostname-override="+hostname)
+	if wmcb.startCordoned {
+		taints = append(taints, cordonedTaint)
 	}
 
-	return kubeletArgs, nil
+	seen := make(map[string]bool, len(taints))
+	unique := taints[:0]
+	for _, taint := range taints {
+		if !seen[taintKeyEffect(taint)] {
+			seen[taintKeyEffect(taint)] = true
+			unique = append(unique, taint)
+		}
+	}
+	return strings.Join(unique, ",")
+}
+
+// nodeLabels returns the labels that WMCB applies to the node, as a comma separated list of name=value pairs. The
+// given labels of the kubelet systemd unit, only set if a transformer keeps the node-labels arg, are overridden by the
+// machine config pool label, which is overridden by the extra node labels. The os_id label is always applied first.
+func (wmcb *winNodeBootstrapper) nodeLabels(unitLabels string) string {
+	labels := make(map[string]string)
+	for _, label := range strings.Split(unitLabels, ",") {
+		// A label given without a value, e.g. node-role.kubernetes.io/worker, has an empty value
+		if key, value, _ := strings.Cut(label, "="); key != "" {
+			labels[key] = value
+		}
+	}
+	if wmcb.machineConfigPool != "" {
+		labels[machineConfigPoolLabel] = wmcb.machineConfigPool
+	}
+	for key, value := range wmcb.extraNodeLabels {
+		labels[key] = value
+	}
+	delete(labels, nodeLabelKey)
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	nodeLabels := []string{nodeLabel}
+	for _, key := range keys {
+		nodeLabels = append(nodeLabels, key+"="+labels[key])
+	}
+	return strings.Join(nodeLabels, ",")
+}
+
+// overrideKubeletArgs appends each of the extra args to the kubelet args, removing the args with the same name that
+// precede it
+func overrideKubeletArgs(kubeletArgs, extraKubeletArgs []string) []string {
+	for _, extraArg := range extraKubeletArgs {
+		name := kubeletArgName(extraArg)
+		var args []string
+		for _, arg := range kubeletArgs {
+			if kubeletArgName(arg) != name {
+				args = append(args, arg)
+			}
+		}
+		kubeletArgs = append(args, extraArg)
+	}
+	return kubeletArgs
+}
+
+// kubeletArgName returns the name of the given kubelet arg, including the leading dashes
+func kubeletArgName(arg string) string {
+	return strings.SplitN(arg, "=", 2)[0]
 }
 
 // ensureKubeletService creates a new kubelet service to our specifications if it is not already present, else
 // it updates the existing kubelet service with our specifications.
 func (wmcb *winNodeBootstrapper) ensureKubeletService() error {
+	c := wmcb.kubeletServiceConfig()
+	c.Dependencies = installedServices(wmcb.services, c.Dependencies)
+
+	serviceExists := wmcb.kubeletSVC != nil
+	if !serviceExists {
+		if err := wmcb.createKubeletService(c); err != nil {
+			return fmt.Errorf("failed to create kubelet service : %v ", err)
+		}
+	}
+
+	// The environment has to be set before the service is restarted by the update for the kubelet to pick it up. It
+	// is set even if empty, to clear the variables of a previous configuration, e.g. a proxy that has been removed.
+	if err := wmcb.services.SetServiceEnvironment(KubeletServiceName, wmcb.serviceEnv); err != nil {
+		return fmt.Errorf("failed to set environment of kubelet service: %v", err)
+	}
+
+	if serviceExists {
+		if err := wmcb.updateKubeletService(c, wmcb.kubeletArgs); err != nil {
+			return fmt.Errorf("failed to update kubelet service : %v ", err)
+		}
+	}
+
+	if err := wmcb.kubeletSVC.setRecoveryActions(); err != nil {
+		return fmt.Errorf("failed to set recovery actions for Windows service %s : %v", KubeletServiceName, err)
+	}
+	return nil
+}
+
+// kubeletServiceConfig returns the Windows service config the kubelet service should have
+func (wmcb *winNodeBootstrapper) kubeletServiceConfig() mgr.Config {
 	// Mostly default values here
-	c := mgr.Config{
+	return mgr.Config{
 		ServiceType: 0,
 		// StartAutomatic will start the service again if the node restarts
 		StartType:      mgr.StartAutomatic,
 		ErrorControl:   0,
 		LoadOrderGroup: "",
 		TagId:          0,
-		// set dependency on containerd
-		Dependencies:     []string{"containerd"},
+		// set dependency on the container runtime
+		Dependencies:     wmcb.runtimeServiceDependencies(),
 		ServiceStartName: "",
 		DisplayName:      "",
 		Password:         "",
 		Description:      fmt.Sprintf("%s kubelet", managedServicePrefix),
 	}
+}
 
-	if wmcb.kubeletSVC == nil {
-		if err := wmcb.createKubeletService(c); err != nil {
-			return fmt.Errorf("failed to create kubelet service : %v ", err)
+// runtimeEndpoint returns the endpoint of the container runtime used by the kubelet
+func (wmcb *winNodeBootstrapper) runtimeEndpoint() string {
+	if wmcb.containerRuntimeEndpoint == "" {
+		return containerdEndpointValue
+	}
+	return wmcb.containerRuntimeEndpoint
+}
+
+// validateContainerRuntimeEndpoint returns an error if the given endpoint is not a named pipe or TCP endpoint
+func validateContainerRuntimeEndpoint(endpoint string) error {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid container runtime endpoint %s: %v", endpoint, err)
+	}
+	switch endpointURL.Scheme {
+	case "npipe":
+		// Both the npipe://./pipe/<name> and npipe:////./pipe/<name> forms are accepted by the kubelet
+		pipePath := strings.TrimPrefix(endpointURL.Path, "//.")
+		if path.Dir(pipePath) != "/pipe" || path.Base(pipePath) == "pipe" {
+			return fmt.Errorf("invalid container runtime endpoint %s, must be in the form npipe://./pipe/<name>",
+				endpoint)
 		}
-	} else {
-		if err := wmcb.updateKubeletService(c, wmcb.kubeletArgs); err != nil {
-			return fmt.Errorf("failed to update kubelet service : %v ", err)
+	case "tcp":
+		if endpointURL.Host == "" {
+			return fmt.Errorf("invalid container runtime endpoint %s, must be in the form tcp://<host>:<port>",
+				endpoint)
+		}
+	case "unix", "":
+		// Linux CRI sockets are the usual mistake, containerd on Windows listens on a named pipe instead
+		return fmt.Errorf("invalid container runtime endpoint %s, unix sockets are not supported on Windows, "+
+			"containerd is reached through a named pipe such as %s", endpoint, containerdEndpointValue)
+	default:
+		return fmt.Errorf("invalid container runtime endpoint %s, must be a npipe:// or tcp:// URL", endpoint)
+	}
+	return nil
+}
+
+// runtimeServiceDependencies returns the Windows services the kubelet depends on to reach the container runtime
+func (wmcb *winNodeBootstrapper) runtimeServiceDependencies() []string {
+	if wmcb.runtimeServiceName != "" {
+		return []string{wmcb.runtimeServiceName}
+	}
+	return runtimeServiceDependencies(wmcb.runtimeEndpoint())
+}
+
+// installedServices returns the given services, omitting those that are not installed. A dependency on a service that
+// is not installed would prevent the dependent service from being created, so a warning is logged instead.
+func installedServices(svcMgr serviceManager, names []string) []string {
+	var installed []string
+	for _, name := range names {
+		service, err := svcMgr.OpenService(name)
+		if err != nil && strings.Contains(err.Error(), "service does not exist") {
+			log.Info("warning: omitting dependency on service that is not installed", "service", name)
+			continue
+		}
+		if service != nil {
+			service.Close()
 		}
+		installed = append(installed, name)
 	}
+	return installed
+}
 
-	if err := wmcb.kubeletSVC.setRecoveryActions(); err != nil {
-		return fmt.Errorf("failed to set recovery actions for Windows service %s : %v", KubeletServiceName, err)
+// runtimeServiceDependencies returns the Windows services the kubelet depends on to reach the container runtime at the
+// given endpoint. The Docker engine is reached through its own named pipe, any other named pipe is served by
+// containerd, and a TCP endpoint is not served by a local service the kubelet can depend on.
+func runtimeServiceDependencies(endpoint string) []string {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil || endpointURL.Scheme != "npipe" {
+		return nil
 	}
-	return nil
+	if path.Base(endpointURL.Path) == dockerPipe {
+		return []string{"docker"}
+	}
+	return []string{"containerd"}
 }
 
 // createKubeletService creates a new kubelet service to our specifications
 func (wmcb *winNodeBootstrapper) createKubeletService(c mgr.Config) error {
-	ksvc, err := wmcb.svcMgr.CreateService(KubeletServiceName, filepath.Join(wmcb.installDir, "kubelet.exe"), c,
+	ksvc, err := wmcb.services.CreateService(KubeletServiceName, filepath.Join(wmcb.installDir, "kubelet.exe"), c,
 		wmcb.kubeletArgs...)
 	if err != nil {
 		return err
@@ -589,14 +1849,7 @@ func (wmcb *winNodeBootstrapper) updateKubeletService(config mgr.Config, kubelet
 	existingConfig.DisplayName = config.DisplayName
 	existingConfig.StartType = config.StartType
 
-	// Create kubelet command to populate config.BinaryPathName
-	// Add a space after kubelet.exe followed by the stand alone args
-	kubeletcmd := filepath.Join(wmcb.installDir, "kubelet.exe") + " "
-	// Add rest of the args
-	for _, args := range kubeletArgs {
-		kubeletcmd += args + " "
-	}
-	existingConfig.BinaryPathName = strings.TrimSpace(kubeletcmd)
+	existingConfig.BinaryPathName = wmcb.kubeletCommand(kubeletArgs)
 
 	// Update service config and restart
 	if err := wmcb.kubeletSVC.refresh(existingConfig); err != nil {
@@ -604,7 +1857,7 @@ func (wmcb *winNodeBootstrapper) updateKubeletService(config mgr.Config, kubelet
 	}
 
 	// Update dependents field if there is any change
-	dependents, err := updateKubeletDependents(wmcb.svcMgr)
+	dependents, err := updateKubeletDependents(wmcb.services)
 	if err != nil {
 		return fmt.Errorf("error updating kubelet dependents field %v", err)
 	}
@@ -613,43 +1866,401 @@ func (wmcb *winNodeBootstrapper) updateKubeletService(config mgr.Config, kubelet
 	return nil
 }
 
+// kubeletCommand returns the kubelet command, used to populate the BinaryPathName of the kubelet service config
+func (wmcb *winNodeBootstrapper) kubeletCommand(kubeletArgs []string) string {
+	// Create kubelet command to populate config.BinaryPathName
+	// Add a space after kubelet.exe followed by the stand alone args
+	kubeletcmd := filepath.Join(wmcb.installDir, "kubelet.exe") + " "
+	// Add rest of the args
+	for _, args := range kubeletArgs {
+		kubeletcmd += args + " "
+	}
+	return strings.TrimSpace(kubeletcmd)
+}
+
 // InitializeKubelet performs the initial kubelet configuration. It sets up the install directory, creates the kubelet
-// service, and then starts the kubelet service
-func (wmcb *winNodeBootstrapper) InitializeKubelet() error {
+// service, and then starts the kubelet service. An existing kubelet service already running with the args, environment
+// and files that would be generated is left running untouched. The returned result describes what was done, for
+// diagnostics.
+func (wmcb *winNodeBootstrapper) InitializeKubelet() (*BootstrapResult, error) {
 	var err error
 
+	if err = checkServiceMode(wmcb.serviceMode, wmcb.kubeletSVC != nil); err != nil {
+		return nil, err
+	}
+
+	if wmcb.checkDNS {
+		for _, dnsServer := range splitClusterDNS(wmcb.clusterDNS) {
+			if err = checkDNSServer(net.JoinHostPort(dnsServer, "53"), dnsCheckTimeout); err != nil {
+				return nil, fmt.Errorf("cluster DNS %s is not reachable: %v", dnsServer, err)
+			}
+		}
+	}
+
+	if wmcb.minContainerdVersion != "" {
+		if err = ensureContainerdVersion(wmcb.containerdPath, wmcb.minContainerdVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	// The ignition is parsed once, the API server check, the comparison with an existing kubelet and the written
+	// files all use the same generated setup
+	setup, err := wmcb.generateKubeletSetup()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize kubelet: %v", err)
+	}
+
+	// The API server is checked before an existing kubelet is stopped, so that the kubelet is left running if the
+	// node could not join the cluster anyway
+	if wmcb.checkAPIServer {
+		if err = wmcb.checkBootstrapAPIServer(setup); err != nil {
+			return nil, err
+		}
+	}
+
 	if wmcb.kubeletSVC != nil {
+		// Leave the kubelet running if it would be restarted with the same args, environment and files
+		existingConfig, err := wmcb.kubeletSVC.config()
+		if err != nil {
+			return nil, fmt.Errorf("no existing config found")
+		}
+		upToDate, err := wmcb.kubeletUpToDate(existingConfig.BinaryPathName, setup)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize kubelet: %v", err)
+		}
+		if upToDate {
+			if err = wmcb.kubeletSVC.start(); err != nil {
+				return nil, fmt.Errorf("failed to start kubelet windows service: %v", err)
+			}
+			return &BootstrapResult{KubeletArgs: wmcb.kubeletArgs}, nil
+		}
+
 		// Stop kubelet service if it is in Running state. This is required to access kubelet files
 		// without getting 'The process cannot access the file because it is being used by another process.' error
-		err := wmcb.kubeletSVC.stop()
+		err = wmcb.kubeletSVC.stop()
 		if err != nil {
-			return fmt.Errorf("failed to stop kubelet service: %v", err)
+			return nil, fmt.Errorf("failed to stop kubelet service: %v", err)
+		}
+		if wmcb.archiveKubeletLog {
+			if err = archiveKubeletLog(wmcb.logDir, time.Now()); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	err = wmcb.initializeKubeletFiles()
+	writtenFiles, err := wmcb.initializeKubeletFiles(setup)
 	if err != nil {
-		return fmt.Errorf("failed to initialize kubelet: %v", err)
+		return nil, fmt.Errorf("failed to initialize kubelet: %v", err)
 	}
 
+	serviceCreated := wmcb.kubeletSVC == nil
 	err = wmcb.ensureKubeletService()
 	if err != nil {
-		return fmt.Errorf("failed to ensure that kubelet windows service is present: %v", err)
+		return nil, fmt.Errorf("failed to ensure that kubelet windows service is present: %v", err)
 	}
 	err = wmcb.kubeletSVC.start()
 	if err != nil {
-		return fmt.Errorf("failed to start kubelet windows service: %v", err)
+		return nil, fmt.Errorf("failed to start kubelet windows service: %v", err)
+	}
+	return &BootstrapResult{
+		KubeletArgs:    wmcb.kubeletArgs,
+		ServiceCreated: serviceCreated,
+		WrittenFiles:   writtenFiles,
+		Changed:        true,
+	}, nil
+}
+
+// Validate parses the ignition and generates the kubelet files and args into a temporary directory, and returns the
+// generated kubelet args. Neither the kubelet service nor the install directory are touched, allowing to check that
+// the kubelet can be initialized with the given inputs. No network checks or metadata server lookups are done, so the
+// returned args lack the hostname-override arg of the platforms requiring it. The paths in the returned args are
+// within the temporary directory, which is removed before returning.
+func (wmcb *winNodeBootstrapper) Validate() ([]string, error) {
+	if wmcb.initialKubeletPath != "" {
+		if _, err := os.Stat(wmcb.initialKubeletPath); err != nil {
+			return nil, fmt.Errorf("could not find kubelet: %v", err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "wmcb")
+	if err != nil {
+		return nil, fmt.Errorf("could not create temporary directory: %v", err)
+	}
+	// Ignore the return error as there is not much we can do if the temporary directory is not deleted
+	defer os.RemoveAll(dir)
+
+	validation := wmcb.validationCopy(dir)
+	setup, err := validation.generateKubeletSetup()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize kubelet: %v", err)
+	}
+	if _, err = validation.initializeKubeletFiles(setup); err != nil {
+		return nil, fmt.Errorf("failed to initialize kubelet: %v", err)
+	}
+	return validation.kubeletArgs, nil
+}
+
+// validationCopy returns a copy of the bootstrapper generating the kubelet files into the given directory. The copy
+// shares no slices or maps with the bootstrapper, has no service manager connection, and neither checks the network
+// nor looks up the node name.
+func (wmcb *winNodeBootstrapper) validationCopy(dir string) *winNodeBootstrapper {
+	validation := *wmcb
+	validation.installDir = dir
+	validation.kubeconfigPath = filepath.Join(dir, "kubeconfig")
+	validation.kubeletConfPath = filepath.Join(dir, "kubelet.conf")
+	validation.logDir = filepath.Join(dir, "log")
+	validation.staticPodDir = filepath.Join(dir, "manifests")
+	// The kubelet has been checked to exist, there is no need to copy it
+	validation.initialKubeletPath = ""
+	validation.kubeletSVC = nil
+	validation.svcMgr = nil
+	validation.services = nil
+	validation.checkDNS = false
+	validation.checkAPIServer = false
+	validation.skipNodeNameLookup = true
+
+	validation.kubeletArgs = copyStrings(wmcb.kubeletArgs)
+	validation.enforceNodeAllocatable = copyStrings(wmcb.enforceNodeAllocatable)
+	validation.tlsCipherSuites = copyStrings(wmcb.tlsCipherSuites)
+	validation.serviceEnv = copyStrings(wmcb.serviceEnv)
+	validation.extraKubeletArgs = copyStrings(wmcb.extraKubeletArgs)
+	validation.registerWithTaints = copyStrings(wmcb.registerWithTaints)
+	if wmcb.featureGates != nil {
+		validation.featureGates = make(map[string]bool, len(wmcb.featureGates))
+		for gate, enabled := range wmcb.featureGates {
+			validation.featureGates[gate] = enabled
+		}
+	}
+	if wmcb.kubeletArgTransformers != nil {
+		validation.kubeletArgTransformers = make(map[string]KubeletArgTransformer, len(wmcb.kubeletArgTransformers))
+		for name, transformer := range wmcb.kubeletArgTransformers {
+			validation.kubeletArgTransformers[name] = transformer
+		}
+	}
+	if wmcb.extraNodeLabels != nil {
+		validation.extraNodeLabels = make(map[string]string, len(wmcb.extraNodeLabels))
+		for label, value := range wmcb.extraNodeLabels {
+			validation.extraNodeLabels[label] = value
+		}
+	}
+	return &validation
+}
+
+// copyStrings returns a copy of the given slice, nil if it is nil
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+// archiveKubeletLog renames the kubelet log in the given directory to kubelet.log.<timestamp>, if it exists
+func archiveKubeletLog(logDir string, now time.Time) error {
+	logFile := filepath.Join(logDir, "kubelet.log")
+	if _, err := os.Stat(logFile); os.IsNotExist(err) {
+		return nil
+	}
+	archive := logFile + "." + now.UTC().Format("20060102T150405Z")
+	if err := os.Rename(logFile, archive); err != nil {
+		return fmt.Errorf("could not archive kubelet log: %v", err)
 	}
 	return nil
 }
 
-// Disconnect removes all connections to the Windows service manager api, and allows services to be deleted
-func (wmcb *winNodeBootstrapper) Disconnect() error {
-	if err := wmcb.kubeletSVC.disconnect(); err != nil {
+// checkServiceMode returns an error if the presence of the kubelet service is not allowed by the service mode
+func checkServiceMode(serviceMode string, serviceExists bool) error {
+	switch serviceMode {
+	case ServiceModeCreate:
+		if serviceExists {
+			return ErrKubeletServiceExists
+		}
+	case ServiceModeUpdate:
+		if !serviceExists {
+			return ErrKubeletServiceMissing
+		}
+	}
+	return nil
+}
+
+// ReconcileKubelet ensures that an already initialized kubelet matches the configuration generated from the current
+// options and ignition file. Only the kubelet service arguments and environment, kubelet.conf and the cloud config are
+// updated, and the kubelet is restarted only if any of them changed. Returns true if any changes were applied.
+func (wmcb *winNodeBootstrapper) ReconcileKubelet() (bool, error) {
+	if wmcb.kubeletSVC == nil {
+		return false, fmt.Errorf("kubelet service is not present, initialize-kubelet must be run first")
+	}
+
+	// Generate the kubelet args, environment and cloud config. The bootstrap kubeconfig and CA are left untouched as
+	// they are only used when the node is first initialized.
+	desiredFiles := make(map[string][]byte)
+	if wmcb.ignitionFilePath != "" || wmcb.machineConfigPath != "" {
+		ignitionFileContents, err := wmcb.readIgnition()
+		if err != nil {
+			return false, err
+		}
+		desiredFiles, err = wmcb.translateIgnition(ignitionFileContents, map[string]fileTranslation{})
+		if err != nil {
+			return false, fmt.Errorf("could not parse ignition file: %s", err)
+		}
+	}
+
+	// The kubelet configuration is generated after parsing the ignition, which holds the kubelet feature gates
+	desiredConf, err := wmcb.renderKubeletConf()
+	if err != nil {
+		return false, fmt.Errorf("error generating kubelet configuration: %v", err)
+	}
+	desiredFiles[wmcb.kubeletConfPath] = desiredConf
+	existingFiles := make(map[string][]byte, len(desiredFiles))
+	for path := range desiredFiles {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return false, fmt.Errorf("error reading %s: %v", path, err)
+		}
+		existingFiles[path] = contents
+	}
+	existingConfig, err := wmcb.kubeletSVC.config()
+	if err != nil {
+		return false, fmt.Errorf("no existing config found")
+	}
+	existingEnv, err := wmcb.services.ServiceEnvironment(KubeletServiceName)
+	if err != nil {
+		return false, err
+	}
+
+	argsChanged, envChanged, filesChanged := kubeletDrift(existingConfig.BinaryPathName,
+		wmcb.kubeletCommand(wmcb.kubeletArgs), existingEnv, wmcb.serviceEnv, existingFiles, desiredFiles)
+	if !argsChanged && !envChanged && !filesChanged {
+		return false, nil
+	}
+
+	// Stop the kubelet service before writing its files, as it could be holding them open
+	if err := wmcb.kubeletSVC.stop(); err != nil {
+		return false, fmt.Errorf("unable to stop kubelet service: %v", err)
+	}
+	for path, contents := range desiredFiles {
+		if bytes.Equal(existingFiles[path], contents) {
+			continue
+		}
+		if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+			return false, fmt.Errorf("error writing data to %v file: %v", path, err)
+		}
+	}
+	if envChanged {
+		if err := wmcb.services.SetServiceEnvironment(KubeletServiceName, wmcb.serviceEnv); err != nil {
+			return false, fmt.Errorf("failed to set environment of kubelet service: %v", err)
+		}
+	}
+	if argsChanged {
+		// updateKubeletService restarts the kubelet with the new args
+		c := wmcb.kubeletServiceConfig()
+		c.Dependencies = installedServices(wmcb.services, c.Dependencies)
+		if err := wmcb.updateKubeletService(c, wmcb.kubeletArgs); err != nil {
+			return false, fmt.Errorf("failed to update kubelet service : %v ", err)
+		}
+		return true, nil
+	}
+	if err := wmcb.kubeletSVC.start(); err != nil {
+		return false, fmt.Errorf("failed to start kubelet windows service: %v", err)
+	}
+	return true, nil
+}
+
+// kubeletDrift reports whether the existing kubelet command, service environment and files, by path, differ from the
+// desired ones. Quoting is ignored when comparing the commands, as the service manager quotes the binary path on
+// service creation.
+func kubeletDrift(existingCmd, desiredCmd string, existingEnv, desiredEnv []string, existingFiles,
+	desiredFiles map[string][]byte) (argsChanged, envChanged, filesChanged bool) {
+	existingFields := normalizeKubeletCommand(existingCmd)
+	desiredFields := normalizeKubeletCommand(desiredCmd)
+	if len(existingFields) != len(desiredFields) {
+		argsChanged = true
+	} else {
+		for i := range existingFields {
+			if existingFields[i] != desiredFields[i] {
+				argsChanged = true
+				break
+			}
+		}
+	}
+	// The environment is sorted, the null character cannot be part of the variables
+	envChanged = strings.Join(existingEnv, "\x00") != strings.Join(desiredEnv, "\x00")
+	for path, contents := range desiredFiles {
+		if !bytes.Equal(existingFiles[path], contents) {
+			filesChanged = true
+			break
+		}
+	}
+	return argsChanged, envChanged, filesChanged
+}
+
+// normalizeKubeletCommand returns the fields of the kubelet command without quotes, as the service manager quotes the
+// binary path on service creation
+func normalizeKubeletCommand(cmd string) []string {
+	return strings.Fields(strings.ReplaceAll(cmd, "\"", ""))
+}
+
+// VerifyCloudProvider checks that the running kubelet service was started with the cloud provider expected for the
+// platform type, and that the cloud config it was given exists. A mismatch leaves the node working, but without cloud
+// integration such as load balancers and volumes.
+func (wmcb *winNodeBootstrapper) VerifyCloudProvider() error {
+	if wmcb.kubeletSVC == nil {
+		return ErrKubeletServiceMissing
+	}
+	config, err := wmcb.kubeletSVC.config()
+	if err != nil {
+		return fmt.Errorf("could not get kubelet service config: %v", err)
+	}
+	cloudConfig, err := verifyCloudProviderArgs(config.BinaryPathName, wmcb.platformType)
+	if err != nil {
 		return err
 	}
+	if cloudConfig != "" {
+		if _, err := os.Stat(cloudConfig); err != nil {
+			return fmt.Errorf("kubelet cloud config is not accessible: %v", err)
+		}
+	}
+	return nil
+}
+
+// verifyCloudProviderArgs checks that the cloud provider given in the kubelet command is the one expected for the
+// platform type, either the in-tree provider of the platform or an external one. A platform without a known cloud
+// provider expects none. Returns the cloud config given in the command, if any.
+func verifyCloudProviderArgs(kubeletCmd, platformType string) (string, error) {
+	args := make(map[string]string)
+	for _, results := range kubeletArgRegex.FindAllStringSubmatch(strings.ReplaceAll(kubeletCmd, "\"", ""), -1) {
+		args[results[1]] = results[2]
+	}
+	cloudProvider := args["cloud-provider"]
+	cloudConfig := args[cloudConfigOption]
+
+	expected, known := platformCloudProviders[strings.ToLower(platformType)]
+	switch {
+	case !known && cloudProvider != "":
+		return "", fmt.Errorf("kubelet is running with cloud provider '%s', but platform type '%s' has no cloud "+
+			"provider", cloudProvider, platformType)
+	case known && cloudProvider != expected && cloudProvider != "external":
+		return "", fmt.Errorf("kubelet is running with cloud provider '%s', but platform type '%s' expects '%s'",
+			cloudProvider, platformType, expected)
+	case cloudProvider == "" && cloudConfig != "":
+		return "", fmt.Errorf("kubelet is running with --%s but without --cloud-provider", cloudConfigOption)
+	}
+	return cloudConfig, nil
+}
+
+// Disconnect removes all connections to the Windows service manager api, and allows services to be deleted. It is
+// safe to call when no kubelet service has been assigned, or when the bootstrapper is already disconnected.
+func (wmcb *winNodeBootstrapper) Disconnect() error {
+	if wmcb.kubeletSVC != nil {
+		if err := wmcb.kubeletSVC.disconnect(); err != nil {
+			return err
+		}
+	}
+	if wmcb.svcMgr == nil {
+		return nil
+	}
 	err := wmcb.svcMgr.Disconnect()
 	wmcb.svcMgr = nil
+	wmcb.services = nil
 	return err
 }
 
@@ -666,6 +2277,106 @@ func (wmcb *winNodeBootstrapper) UninstallKubelet() error {
 	return nil
 }
 
+// nodeName returns the name the kubelet registers the node with
+func (wmcb *winNodeBootstrapper) nodeName() (string, error) {
+	nodeName, err := deriveNodeName(wmcb.platformType)
+	if err != nil {
+		return "", fmt.Errorf("could not derive the node name: %v", err)
+	}
+	if nodeName != "" {
+		return nodeName, nil
+	}
+	// The kubelet registers the node with its lowercased hostname by default
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("could not get the hostname: %v", err)
+	}
+	return strings.ToLower(hostname), nil
+}
+
+// ConfigureHybridOverlay creates or updates the hybrid-overlay-node service running the given binary, and starts it.
+// The VXLAN port of the hybrid overlay network is the hybrid-overlay-node default if vxlanPort is empty. The kubelet
+// must be initialized first, as hybrid-overlay-node authenticates with the kubelet kubeconfig and depends on the
+// kubelet service.
+func (wmcb *winNodeBootstrapper) ConfigureHybridOverlay(binaryPath, vxlanPort string) error {
+	if wmcb.kubeletSVC == nil {
+		return fmt.Errorf("kubelet service is not present, initialize-kubelet must be run first")
+	}
+	nodeName, err := wmcb.nodeName()
+	if err != nil {
+		return err
+	}
+	logDir := installDrive(wmcb.installDir) + hybridOverlayLogDirectory
+	if err = os.MkdirAll(logDir, os.ModeDir); err != nil {
+		return fmt.Errorf("could not make %s directory: %v", logDir, err)
+	}
+
+	hybridOverlay, err := newHybridOverlayService(wmcb.services, binaryPath, nodeName,
+		wmcb.kubeconfigPath, logDir, vxlanPort)
+	if err != nil {
+		return err
+	}
+	if err = hybridOverlay.ensure(); err != nil {
+		return err
+	}
+	// The kubelet service stops its dependents before stopping itself
+	wmcb.kubeletSVC.dependents, err = updateKubeletDependents(wmcb.services)
+	if err != nil {
+		return fmt.Errorf("error updating kubelet dependents field %v", err)
+	}
+	return nil
+}
+
+// UninstallHybridOverlay stops and removes the hybrid-overlay-node service, if it exists
+func (wmcb *winNodeBootstrapper) UninstallHybridOverlay() error {
+	hybridOverlay := &managedService{svcMgr: wmcb.services, name: HybridOverlayServiceName}
+	if err := hybridOverlay.remove(); err != nil {
+		return fmt.Errorf("failed to stop and remove %s service: %v", HybridOverlayServiceName, err)
+	}
+	return nil
+}
+
+// ConfigureKubeProxy creates or updates the kube-proxy service running the given binary, and starts it. kube-proxy
+// programs the cluster Services into the given HNS network, reaching the pods from the given source VIP. The
+// hybrid-overlay-node service must be configured first, as it creates the HNS network.
+func (wmcb *winNodeBootstrapper) ConfigureKubeProxy(binaryPath, networkName, sourceVIP, clusterCIDR string) error {
+	if wmcb.kubeletSVC == nil {
+		return fmt.Errorf("kubelet service is not present, initialize-kubelet must be run first")
+	}
+	nodeName, err := wmcb.nodeName()
+	if err != nil {
+		return err
+	}
+	logDir := installDrive(wmcb.installDir) + kubeProxyLogDirectory
+	if err = os.MkdirAll(logDir, os.ModeDir); err != nil {
+		return fmt.Errorf("could not make %s directory: %v", logDir, err)
+	}
+
+	kubeProxy, err := newKubeProxyService(wmcb.services, binaryPath, nodeName, wmcb.kubeconfigPath,
+		logDir, networkName, sourceVIP, clusterCIDR)
+	if err != nil {
+		return err
+	}
+	if err = kubeProxy.ensure(); err != nil {
+		return err
+	}
+	// The kubelet service stops its dependents before stopping itself
+	wmcb.kubeletSVC.dependents, err = updateKubeletDependents(wmcb.services)
+	if err != nil {
+		return fmt.Errorf("error updating kubelet dependents field %v", err)
+	}
+	return nil
+}
+
+// UninstallKubeProxy stops and removes the kube-proxy service, if it exists
+func (wmcb *winNodeBootstrapper) UninstallKubeProxy() error {
+	kubeProxy := &managedService{svcMgr: wmcb.services, name: KubeProxyServiceName}
+	if err := kubeProxy.remove(); err != nil {
+		return fmt.Errorf("failed to stop and remove %s service: %v", KubeProxyServiceName, err)
+	}
+	return nil
+}
+
 func copyFile(src, dest string) error {
 	from, err := os.Open(src)
 	if err != nil {
@@ -685,18 +2396,20 @@ func copyFile(src, dest string) error {
 
 // updateKubeletDependents updates the dependents field of the kubeletService struct
 // to reflect current list of dependent services. This function assumes that the kubelet service is running
-func updateKubeletDependents(svcMgr *mgr.Mgr) ([]*mgr.Service, error) {
-	var dependents []*mgr.Service
-	// If there is already a kubelet service running, find it
-	dependentSvc, err := svcMgr.OpenService(kubeletDependentSvc)
-	if err != nil {
-		// Do not return error if the services are not installed.
-		if !strings.Contains(err.Error(), "service does not exist") {
-			return nil, fmt.Errorf("error getting dependent services for kubelet %v", err)
+func updateKubeletDependents(svcMgr serviceManager) ([]windowsService, error) {
+	var dependents []windowsService
+	// kube-proxy depends on hybrid-overlay-node, so it is listed first to be stopped first
+	for _, name := range []string{KubeProxyServiceName, kubeletDependentSvc} {
+		dependentSvc, err := svcMgr.OpenService(name)
+		if err != nil {
+			// Do not return error if the services are not installed.
+			if !strings.Contains(err.Error(), "service does not exist") {
+				return nil, fmt.Errorf("error getting dependent services for kubelet %v", err)
+			}
+		}
+		if dependentSvc != nil {
+			dependents = append(dependents, dependentSvc)
 		}
-	}
-	if dependentSvc != nil {
-		dependents = append(dependents, dependentSvc)
 	}
 	return dependents, nil
 }
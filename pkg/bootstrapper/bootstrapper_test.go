@@ -1,15 +1,24 @@
 package bootstrapper
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	ignitionCfgv3Types "github.com/coreos/ignition/v2/config/v3_1/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
 )
 
 // cniTest holds the location of the directories and files required for running some of the CNI tests
@@ -103,7 +112,15 @@ rqLuyNO+hCh/ZclPL+UiGJH1dlQ=
 // TestCreateKubeletConf tests that we are creating the kubelet configuration in a way that allows it to run on windows
 func TestCreateKubeletConf(t *testing.T) {
 	type args struct {
-		clusterDNS string
+		clusterDNS             string
+		enforceNodeAllocatable []string
+		tlsCipherSuites        []string
+		tlsMinVersion          string
+		maxPods                int
+		systemReservedCPU      string
+		systemReservedMemory   string
+		staticPodDir           string
+		streamingIdleTimeout   time.Duration
 	}
 	instDir := `C:\k`
 	err := os.MkdirAll(instDir, 0755)
@@ -119,29 +136,1228 @@ func TestCreateKubeletConf(t *testing.T) {
 			args: args{
 				clusterDNS: "172.30.0.10",
 			},
-			want: []byte(`{"kind":"KubeletConfiguration","apiVersion":"kubelet.config.k8s.io/v1beta1","rotateCertificates":true,"serverTLSBootstrap":true,"authentication":{"x509":{"clientCAFile":"C:\\k\\kubelet-ca.crt"},"anonymous":{"enabled":false}},"clusterDomain":"cluster.local","clusterDNS":["172.30.0.10"],"cgroupsPerQOS":false,"runtimeRequestTimeout":"10m0s","maxPods":250,"kubeAPIQPS":50,"kubeAPIBurst":100,"serializeImagePulls":false,"featureGates":{"LegacyNodeRoleBehavior":false,"NodeDisruptionExclusion":true,"RotateKubeletServerCertificate":true,"SCTPSupport":true,"ServiceNodeExclusion":true,"SupportPodPidsLimit":true},"containerLogMaxSize":"50Mi","systemReserved":{"cpu":"500m","ephemeral-storage":"1Gi","memory":"1Gi"},"enforceNodeAllocatable":[]}`),
+			want: []byte(`{"kind":"KubeletConfiguration","apiVersion":"kubelet.config.k8s.io/v1beta1","rotateCertificates":true,"serverTLSBootstrap":true,"authentication":{"x509":{"clientCAFile":"C:\\k\\kubelet-ca.crt"},"anonymous":{"enabled":false}},"clusterDomain":"cluster.local","clusterDNS":["172.30.0.10"],"cgroupsPerQOS":false,"runtimeRequestTimeout":"10m0s","streamingConnectionIdleTimeout":"5m0s","maxPods":250,"kubeAPIQPS":50,"kubeAPIBurst":100,"serializeImagePulls":false,"featureGates":{"LegacyNodeRoleBehavior":false,"NodeDisruptionExclusion":true,"RotateKubeletServerCertificate":true,"SCTPSupport":true,"ServiceNodeExclusion":true,"SupportPodPidsLimit":true},"containerLogMaxSize":"50Mi","systemReserved":{"cpu":"500m","ephemeral-storage":"1Gi","memory":"1Gi"},"enforceNodeAllocatable":[]}`),
 		},
 		{
 			name: "empty clusterDNS",
 			args: args{
 				clusterDNS: "",
 			},
-			want: []byte(`{"kind":"KubeletConfiguration","apiVersion":"kubelet.config.k8s.io/v1beta1","rotateCertificates":true,"serverTLSBootstrap":true,"authentication":{"x509":{"clientCAFile":"C:\\k\\kubelet-ca.crt"},"anonymous":{"enabled":false}},"clusterDomain":"cluster.local","clusterDNS":[],"cgroupsPerQOS":false,"runtimeRequestTimeout":"10m0s","maxPods":250,"kubeAPIQPS":50,"kubeAPIBurst":100,"serializeImagePulls":false,"featureGates":{"LegacyNodeRoleBehavior":false,"NodeDisruptionExclusion":true,"RotateKubeletServerCertificate":true,"SCTPSupport":true,"ServiceNodeExclusion":true,"SupportPodPidsLimit":true},"containerLogMaxSize":"50Mi","systemReserved":{"cpu":"500m","ephemeral-storage":"1Gi","memory":"1Gi"},"enforceNodeAllocatable":[]}`),
+			want: []byte(`{"kind":"KubeletConfiguration","apiVersion":"kubelet.config.k8s.io/v1beta1","rotateCertificates":true,"serverTLSBootstrap":true,"authentication":{"x509":{"clientCAFile":"C:\\k\\kubelet-ca.crt"},"anonymous":{"enabled":false}},"clusterDomain":"cluster.local","clusterDNS":[],"cgroupsPerQOS":false,"runtimeRequestTimeout":"10m0s","streamingConnectionIdleTimeout":"5m0s","maxPods":250,"kubeAPIQPS":50,"kubeAPIBurst":100,"serializeImagePulls":false,"featureGates":{"LegacyNodeRoleBehavior":false,"NodeDisruptionExclusion":true,"RotateKubeletServerCertificate":true,"SCTPSupport":true,"ServiceNodeExclusion":true,"SupportPodPidsLimit":true},"containerLogMaxSize":"50Mi","systemReserved":{"cpu":"500m","ephemeral-storage":"1Gi","memory":"1Gi"},"enforceNodeAllocatable":[]}`),
+		},
+		{
+			name: "dual-stack clusterDNS",
+			args: args{
+				clusterDNS: "172.30.0.10,fd02::a",
+			},
+			want: []byte(`{"kind":"KubeletConfiguration","apiVersion":"kubelet.config.k8s.io/v1beta1","rotateCertificates":true,"serverTLSBootstrap":true,"authentication":{"x509":{"clientCAFile":"C:\\k\\kubelet-ca.crt"},"anonymous":{"enabled":false}},"clusterDomain":"cluster.local","clusterDNS":["172.30.0.10","fd02::a"],"cgroupsPerQOS":false,"runtimeRequestTimeout":"10m0s","streamingConnectionIdleTimeout":"5m0s","maxPods":250,"kubeAPIQPS":50,"kubeAPIBurst":100,"serializeImagePulls":false,"featureGates":{"LegacyNodeRoleBehavior":false,"NodeDisruptionExclusion":true,"RotateKubeletServerCertificate":true,"SCTPSupport":true,"ServiceNodeExclusion":true,"SupportPodPidsLimit":true},"containerLogMaxSize":"50Mi","systemReserved":{"cpu":"500m","ephemeral-storage":"1Gi","memory":"1Gi"},"enforceNodeAllocatable":[]}`),
+		},
+		{
+			name: "enforced node allocatable",
+			args: args{
+				clusterDNS:             "172.30.0.10",
+				enforceNodeAllocatable: []string{"pods"},
+			},
+			want: []byte(`{"kind":"KubeletConfiguration","apiVersion":"kubelet.config.k8s.io/v1beta1","rotateCertificates":true,"serverTLSBootstrap":true,"authentication":{"x509":{"clientCAFile":"C:\\k\\kubelet-ca.crt"},"anonymous":{"enabled":false}},"clusterDomain":"cluster.local","clusterDNS":["172.30.0.10"],"cgroupsPerQOS":false,"runtimeRequestTimeout":"10m0s","streamingConnectionIdleTimeout":"5m0s","maxPods":250,"kubeAPIQPS":50,"kubeAPIBurst":100,"serializeImagePulls":false,"featureGates":{"LegacyNodeRoleBehavior":false,"NodeDisruptionExclusion":true,"RotateKubeletServerCertificate":true,"SCTPSupport":true,"ServiceNodeExclusion":true,"SupportPodPidsLimit":true},"containerLogMaxSize":"50Mi","systemReserved":{"cpu":"500m","ephemeral-storage":"1Gi","memory":"1Gi"},"enforceNodeAllocatable":["pods"]}`),
+		},
+		{
+			name: "TLS settings",
+			args: args{
+				clusterDNS:      "172.30.0.10",
+				tlsCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+				tlsMinVersion:   "VersionTLS12",
+			},
+			want: []byte(`{"kind":"KubeletConfiguration","apiVersion":"kubelet.config.k8s.io/v1beta1","rotateCertificates":true,"serverTLSBootstrap":true,"authentication":{"x509":{"clientCAFile":"C:\\k\\kubelet-ca.crt"},"anonymous":{"enabled":false}},"clusterDomain":"cluster.local","clusterDNS":["172.30.0.10"],"cgroupsPerQOS":false,"runtimeRequestTimeout":"10m0s","streamingConnectionIdleTimeout":"5m0s","maxPods":250,"kubeAPIQPS":50,"kubeAPIBurst":100,"serializeImagePulls":false,"featureGates":{"LegacyNodeRoleBehavior":false,"NodeDisruptionExclusion":true,"RotateKubeletServerCertificate":true,"SCTPSupport":true,"ServiceNodeExclusion":true,"SupportPodPidsLimit":true},"containerLogMaxSize":"50Mi","systemReserved":{"cpu":"500m","ephemeral-storage":"1Gi","memory":"1Gi"},"enforceNodeAllocatable":[],"tlsCipherSuites":["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256","TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"],"tlsMinVersion":"VersionTLS12"}`),
+		},
+		{
+			name: "max pods and system reserved resources",
+			args: args{
+				clusterDNS:           "172.30.0.10",
+				maxPods:              500,
+				systemReservedCPU:    "2",
+				systemReservedMemory: "4Gi",
+			},
+			want: []byte(`{"kind":"KubeletConfiguration","apiVersion":"kubelet.config.k8s.io/v1beta1","rotateCertificates":true,"serverTLSBootstrap":true,"authentication":{"x509":{"clientCAFile":"C:\\k\\kubelet-ca.crt"},"anonymous":{"enabled":false}},"clusterDomain":"cluster.local","clusterDNS":["172.30.0.10"],"cgroupsPerQOS":false,"runtimeRequestTimeout":"10m0s","streamingConnectionIdleTimeout":"5m0s","maxPods":500,"kubeAPIQPS":50,"kubeAPIBurst":100,"serializeImagePulls":false,"featureGates":{"LegacyNodeRoleBehavior":false,"NodeDisruptionExclusion":true,"RotateKubeletServerCertificate":true,"SCTPSupport":true,"ServiceNodeExclusion":true,"SupportPodPidsLimit":true},"containerLogMaxSize":"50Mi","systemReserved":{"cpu":"2","ephemeral-storage":"1Gi","memory":"4Gi"},"enforceNodeAllocatable":[]}`),
+		},
+		{
+			name: "static pod directory",
+			args: args{
+				clusterDNS:   "172.30.0.10",
+				staticPodDir: `D:\k\manifests`,
+			},
+			want: []byte(`{"kind":"KubeletConfiguration","apiVersion":"kubelet.config.k8s.io/v1beta1","rotateCertificates":true,"serverTLSBootstrap":true,"authentication":{"x509":{"clientCAFile":"C:\\k\\kubelet-ca.crt"},"anonymous":{"enabled":false}},"clusterDomain":"cluster.local","clusterDNS":["172.30.0.10"],"cgroupsPerQOS":false,"runtimeRequestTimeout":"10m0s","streamingConnectionIdleTimeout":"5m0s","maxPods":250,"kubeAPIQPS":50,"kubeAPIBurst":100,"serializeImagePulls":false,"featureGates":{"LegacyNodeRoleBehavior":false,"NodeDisruptionExclusion":true,"RotateKubeletServerCertificate":true,"SCTPSupport":true,"ServiceNodeExclusion":true,"SupportPodPidsLimit":true},"containerLogMaxSize":"50Mi","systemReserved":{"cpu":"500m","ephemeral-storage":"1Gi","memory":"1Gi"},"enforceNodeAllocatable":[],"staticPodPath":"D:\\k\\manifests"}`),
+		},
+		{
+			name: "streaming connection idle timeout",
+			args: args{
+				clusterDNS:           "172.30.0.10",
+				streamingIdleTimeout: 90 * time.Second,
+			},
+			want: []byte(`{"kind":"KubeletConfiguration","apiVersion":"kubelet.config.k8s.io/v1beta1","rotateCertificates":true,"serverTLSBootstrap":true,"authentication":{"x509":{"clientCAFile":"C:\\k\\kubelet-ca.crt"},"anonymous":{"enabled":false}},"clusterDomain":"cluster.local","clusterDNS":["172.30.0.10"],"cgroupsPerQOS":false,"runtimeRequestTimeout":"10m0s","streamingConnectionIdleTimeout":"1m30s","maxPods":250,"kubeAPIQPS":50,"kubeAPIBurst":100,"serializeImagePulls":false,"featureGates":{"LegacyNodeRoleBehavior":false,"NodeDisruptionExclusion":true,"RotateKubeletServerCertificate":true,"SCTPSupport":true,"ServiceNodeExclusion":true,"SupportPodPidsLimit":true},"containerLogMaxSize":"50Mi","systemReserved":{"cpu":"500m","ephemeral-storage":"1Gi","memory":"1Gi"},"enforceNodeAllocatable":[]}`),
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			bs := winNodeBootstrapper{
-				installDir: instDir,
-				clusterDNS: tt.args.clusterDNS,
+				installDir:                     instDir,
+				clusterDNS:                     tt.args.clusterDNS,
+				enforceNodeAllocatable:         tt.args.enforceNodeAllocatable,
+				tlsCipherSuites:                tt.args.tlsCipherSuites,
+				tlsMinVersion:                  tt.args.tlsMinVersion,
+				maxPods:                        tt.args.maxPods,
+				systemReservedCPU:              tt.args.systemReservedCPU,
+				systemReservedMemory:           tt.args.systemReservedMemory,
+				staticPodDir:                   tt.args.staticPodDir,
+				streamingConnectionIdleTimeout: tt.args.streamingIdleTimeout,
 			}
-			got, err := bs.createKubeletConf()
+			got, err := bs.renderKubeletConf()
 			assert.NoError(t, err)
 			assert.Equalf(t, tt.want, got, "got = %v, want %v", string(got), string(tt.want))
 		})
 	}
 }
 
+// TestFeatureGates tests that the feature gates of the kubelet systemd unit are merged into the default feature gates
+// of the kubelet configuration
+func TestFeatureGates(t *testing.T) {
+	ignitionTemplate := `{"ignition":{"version":"3.1.0"},"systemd":{"units":[{"contents":"[Unit]\nDescription=Kubernetes Kubelet\n\n[Service]\nExecStart=/usr/bin/hyperkube \\\n    kubelet \\\n      --config=/etc/kubernetes/kubelet.conf \\\n      %s \\\n      --v=4\n","enabled":true,"name":"kubelet.service"}]}}`
+
+	t.Run("feature gates merged", func(t *testing.T) {
+		wnb := winNodeBootstrapper{}
+		err := wnb.parseIgnitionFileContents([]byte(fmt.Sprintf(ignitionTemplate,
+			"--feature-gates=WinOverlay=true,GracefulNodeShutdown=false,SupportPodPidsLimit=false")),
+			map[string]fileTranslation{})
+		require.NoError(t, err, "error parsing ignition file contents")
+
+		kubeletConfData, err := wnb.renderKubeletConf()
+		require.NoError(t, err, "error rendering kubelet configuration")
+		var kubeletConfig struct {
+			FeatureGates map[string]bool `json:"featureGates"`
+		}
+		require.NoError(t, json.Unmarshal(kubeletConfData, &kubeletConfig), "error unmarshalling kubelet.conf")
+		assert.Equal(t, map[string]bool{
+			"GracefulNodeShutdown":           false,
+			"LegacyNodeRoleBehavior":         false,
+			"NodeDisruptionExclusion":        true,
+			"RotateKubeletServerCertificate": true,
+			"SCTPSupport":                    true,
+			"ServiceNodeExclusion":           true,
+			"SupportPodPidsLimit":            false,
+			"WinOverlay":                     true,
+		}, kubeletConfig.FeatureGates)
+	})
+
+	t.Run("invalid feature gate", func(t *testing.T) {
+		wnb := winNodeBootstrapper{}
+		err := wnb.parseIgnitionFileContents([]byte(fmt.Sprintf(ignitionTemplate,
+			"--feature-gates=WinOverlay=enabled")), map[string]fileTranslation{})
+		assert.Error(t, err)
+	})
+}
+
+// TestValidateEnforceNodeAllocatable tests that node allocatable enforcement levels unsupported on Windows are
+// rejected
+func TestValidateEnforceNodeAllocatable(t *testing.T) {
+	tests := []struct {
+		name                   string
+		enforceNodeAllocatable []string
+		wantErr                bool
+	}{
+		{
+			name:    "nothing enforced",
+			wantErr: false,
+		},
+		{
+			name:                   "pods",
+			enforceNodeAllocatable: []string{"pods"},
+			wantErr:                false,
+		},
+		{
+			name:                   "none",
+			enforceNodeAllocatable: []string{"none"},
+			wantErr:                false,
+		},
+		{
+			name:                   "system-reserved",
+			enforceNodeAllocatable: []string{"pods", "system-reserved"},
+			wantErr:                true,
+		},
+		{
+			name:                   "kube-reserved",
+			enforceNodeAllocatable: []string{"kube-reserved"},
+			wantErr:                true,
+		},
+		{
+			name:                   "none combined with another level",
+			enforceNodeAllocatable: []string{"none", "pods"},
+			wantErr:                true,
+		},
+		{
+			name:                   "unknown level",
+			enforceNodeAllocatable: []string{"memory"},
+			wantErr:                true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateEnforceNodeAllocatable(tt.enforceNodeAllocatable)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// TestValidateKubeletResources tests the validation of the max pods and system reserved resources
+func TestValidateKubeletResources(t *testing.T) {
+	tests := []struct {
+		name                 string
+		maxPods              int
+		systemReservedCPU    string
+		systemReservedMemory string
+		wantErr              bool
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name:                 "valid values",
+			maxPods:              500,
+			systemReservedCPU:    "1500m",
+			systemReservedMemory: "2Gi",
+		},
+		{
+			name:    "negative max pods",
+			maxPods: -1,
+			wantErr: true,
+		},
+		{
+			name:              "invalid cpu",
+			systemReservedCPU: "half",
+			wantErr:           true,
+		},
+		{
+			name:                 "invalid memory",
+			systemReservedMemory: "2GB",
+			wantErr:              true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateKubeletResources(tt.maxPods, tt.systemReservedCPU, tt.systemReservedMemory)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// TestValidateTLSConfig tests that unknown cipher suites and TLS versions are rejected
+func TestValidateTLSConfig(t *testing.T) {
+	tests := []struct {
+		name            string
+		tlsCipherSuites []string
+		tlsMinVersion   string
+		wantErr         bool
+	}{
+		{
+			name:    "kubelet defaults",
+			wantErr: false,
+		},
+		{
+			name:            "valid settings",
+			tlsCipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_AES_128_GCM_SHA256"},
+			tlsMinVersion:   "VersionTLS12",
+			wantErr:         false,
+		},
+		{
+			name:            "unknown cipher suite",
+			tlsCipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_FAKE_CIPHER"},
+			wantErr:         true,
+		},
+		{
+			name:          "invalid min version",
+			tlsMinVersion: "TLS1.2",
+			wantErr:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTLSConfig(tt.tlsCipherSuites, tt.tlsMinVersion)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// TestKubeletDrift tests that a kubelet restart is only required when its args, environment or files drift
+func TestKubeletDrift(t *testing.T) {
+	conf := []byte(`{"kind":"KubeletConfiguration","clusterDNS":["172.30.0.10"]}`)
+	cloudConf := []byte("[Global]\nzone = us-east-1a\n")
+	files := map[string][]byte{`C:\k\kubelet.conf`: conf, `C:\k\cloud.conf`: cloudConf}
+	env := []string{"HTTP_PROXY=http://proxy:3128"}
+	tests := []struct {
+		name             string
+		existingCmd      string
+		desiredCmd       string
+		existingEnv      []string
+		desiredEnv       []string
+		existingFiles    map[string][]byte
+		desiredFiles     map[string][]byte
+		wantArgsChanged  bool
+		wantEnvChanged   bool
+		wantFilesChanged bool
+	}{
+		{
+			name:          "in sync",
+			existingCmd:   `C:\k\kubelet.exe --windows-service --v=3`,
+			desiredCmd:    `C:\k\kubelet.exe --windows-service --v=3`,
+			existingEnv:   env,
+			desiredEnv:    env,
+			existingFiles: files,
+			desiredFiles:  files,
+		},
+		{
+			name:          "quoted binary path created by the service manager",
+			existingCmd:   `"C:\k\kubelet.exe" --windows-service --v=3`,
+			desiredCmd:    `C:\k\kubelet.exe --windows-service --v=3`,
+			existingFiles: files,
+			desiredFiles:  files,
+		},
+		{
+			name:            "args drift",
+			existingCmd:     `C:\k\kubelet.exe --windows-service --v=3`,
+			desiredCmd:      `C:\k\kubelet.exe --windows-service --v=4`,
+			existingFiles:   files,
+			desiredFiles:    files,
+			wantArgsChanged: true,
+		},
+		{
+			name:            "missing arg",
+			existingCmd:     `C:\k\kubelet.exe --windows-service`,
+			desiredCmd:      `C:\k\kubelet.exe --windows-service --v=3`,
+			existingFiles:   files,
+			desiredFiles:    files,
+			wantArgsChanged: true,
+		},
+		{
+			name:           "environment added",
+			existingCmd:    `C:\k\kubelet.exe --windows-service --v=3`,
+			desiredCmd:     `C:\k\kubelet.exe --windows-service --v=3`,
+			desiredEnv:     env,
+			existingFiles:  files,
+			desiredFiles:   files,
+			wantEnvChanged: true,
+		},
+		{
+			name:           "environment removed",
+			existingCmd:    `C:\k\kubelet.exe --windows-service --v=3`,
+			desiredCmd:     `C:\k\kubelet.exe --windows-service --v=3`,
+			existingEnv:    env,
+			existingFiles:  files,
+			desiredFiles:   files,
+			wantEnvChanged: true,
+		},
+		{
+			name:          "config drift",
+			existingCmd:   `C:\k\kubelet.exe --windows-service --v=3`,
+			desiredCmd:    `C:\k\kubelet.exe --windows-service --v=3`,
+			existingFiles: files,
+			desiredFiles: map[string][]byte{
+				`C:\k\kubelet.conf`: []byte(`{"kind":"KubeletConfiguration","clusterDNS":["172.30.0.11"]}`),
+				`C:\k\cloud.conf`:   cloudConf,
+			},
+			wantFilesChanged: true,
+		},
+		{
+			name:          "cloud config drift",
+			existingCmd:   `C:\k\kubelet.exe --windows-service --v=3`,
+			desiredCmd:    `C:\k\kubelet.exe --windows-service --v=3`,
+			existingFiles: files,
+			desiredFiles: map[string][]byte{
+				`C:\k\kubelet.conf`: conf,
+				`C:\k\cloud.conf`:   []byte("[Global]\nzone = us-east-1b\n"),
+			},
+			wantFilesChanged: true,
+		},
+		{
+			name:             "missing config",
+			existingCmd:      `C:\k\kubelet.exe --windows-service --v=3`,
+			desiredCmd:       `C:\k\kubelet.exe --windows-service --v=3`,
+			existingFiles:    map[string][]byte{`C:\k\cloud.conf`: cloudConf},
+			desiredFiles:     files,
+			wantFilesChanged: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			argsChanged, envChanged, filesChanged := kubeletDrift(tt.existingCmd, tt.desiredCmd, tt.existingEnv,
+				tt.desiredEnv, tt.existingFiles, tt.desiredFiles)
+			assert.Equal(t, tt.wantArgsChanged, argsChanged, "unexpected args drift")
+			assert.Equal(t, tt.wantEnvChanged, envChanged, "unexpected environment drift")
+			assert.Equal(t, tt.wantFilesChanged, filesChanged, "unexpected files drift")
+		})
+	}
+}
+
+// TestVerifyCloudProviderArgs tests the detection of a kubelet running with a cloud provider not matching the platform
+func TestVerifyCloudProviderArgs(t *testing.T) {
+	tests := []struct {
+		name            string
+		kubeletCmd      string
+		platformType    string
+		wantCloudConfig string
+		wantErr         bool
+	}{
+		{
+			name:         "matching in-tree provider",
+			kubeletCmd:   `"C:\k\kubelet.exe" --windows-service --cloud-provider=aws --v=3`,
+			platformType: "AWS",
+		},
+		{
+			name:            "matching provider with cloud config",
+			kubeletCmd:      `C:\k\kubelet.exe --cloud-provider=azure --cloud-config=C:\k\cloud.conf --v=3`,
+			platformType:    "Azure",
+			wantCloudConfig: `C:\k\cloud.conf`,
+		},
+		{
+			name:         "external provider",
+			kubeletCmd:   `C:\k\kubelet.exe --cloud-provider=external --v=3`,
+			platformType: "GCP",
+		},
+		{
+			name:         "no provider on a platform without one",
+			kubeletCmd:   `C:\k\kubelet.exe --v=3`,
+			platformType: "None",
+		},
+		{
+			name:         "provider of another platform",
+			kubeletCmd:   `C:\k\kubelet.exe --cloud-provider=aws --v=3`,
+			platformType: "Azure",
+			wantErr:      true,
+		},
+		{
+			name:         "provider missing",
+			kubeletCmd:   `C:\k\kubelet.exe --v=3`,
+			platformType: "AWS",
+			wantErr:      true,
+		},
+		{
+			name:         "provider on a platform without one",
+			kubeletCmd:   `C:\k\kubelet.exe --cloud-provider=vsphere --v=3`,
+			platformType: "BareMetal",
+			wantErr:      true,
+		},
+		{
+			name:         "cloud config without provider",
+			kubeletCmd:   `C:\k\kubelet.exe --cloud-config=C:\k\cloud.conf --v=3`,
+			platformType: "None",
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cloudConfig, err := verifyCloudProviderArgs(tt.kubeletCmd, tt.platformType)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantCloudConfig, cloudConfig)
+		})
+	}
+}
+
+// TestCheckServiceMode tests that the service mode is enforced based on the presence of the kubelet service
+func TestCheckServiceMode(t *testing.T) {
+	tests := []struct {
+		name          string
+		serviceMode   string
+		serviceExists bool
+		wantErr       error
+	}{
+		{
+			name:          "create with no existing service",
+			serviceMode:   ServiceModeCreate,
+			serviceExists: false,
+			wantErr:       nil,
+		},
+		{
+			name:          "create with existing service",
+			serviceMode:   ServiceModeCreate,
+			serviceExists: true,
+			wantErr:       ErrKubeletServiceExists,
+		},
+		{
+			name:          "update with existing service",
+			serviceMode:   ServiceModeUpdate,
+			serviceExists: true,
+			wantErr:       nil,
+		},
+		{
+			name:          "update with no existing service",
+			serviceMode:   ServiceModeUpdate,
+			serviceExists: false,
+			wantErr:       ErrKubeletServiceMissing,
+		},
+		{
+			name:          "ensure with existing service",
+			serviceMode:   ServiceModeEnsure,
+			serviceExists: true,
+			wantErr:       nil,
+		},
+		{
+			name:          "ensure with no existing service",
+			serviceMode:   ServiceModeEnsure,
+			serviceExists: false,
+			wantErr:       nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantErr, checkServiceMode(tt.serviceMode, tt.serviceExists))
+		})
+	}
+}
+
+// TestHostnameOverrideArgs tests that the hostname override derived from the platform is added to the kubelet args,
+// and omitted on platforms without a node name requirement. Only the platforms whose node name can be derived without
+// reaching a real metadata server are covered, the other platforms are covered by the cloud package tests.
+func TestHostnameOverrideArgs(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err, "error getting hostname")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("winworker.c.project.internal"))
+	}))
+	defer server.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(server.URL, "http://"))
+
+	tests := []struct {
+		name         string
+		platformType string
+		wantPresent  bool
+		wantHostname string
+	}{
+		{
+			name:         "GCP",
+			platformType: "GCP",
+			wantPresent:  true,
+			wantHostname: "winworker.c.project.internal",
+		},
+		{
+			name:         "vSphere",
+			platformType: "vSphere",
+			wantPresent:  true,
+			wantHostname: strings.ToLower(hostname),
+		},
+		{
+			name:         "platform without node name requirement",
+			platformType: "None",
+			wantPresent:  false,
+		},
+		{
+			name:         "no platform type",
+			platformType: "",
+			wantPresent:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wnb := winNodeBootstrapper{platformType: tt.platformType}
+			kubeletArgs, err := wnb.generateInitialKubeletArgs(map[string]string{})
+			require.NoError(t, err, "error generating kubelet args")
+			hostnameOverride, present := getArgValue("hostname-override", kubeletArgs)
+			assert.Equal(t, tt.wantPresent, present, "unexpected presence of hostname-override option")
+			assert.Equal(t, tt.wantHostname, hostnameOverride)
+		})
+	}
+}
+
+// TestIgnitionSpecVersions tests that worker ignition files of the supported spec versions are parsed, with the kubelet
+// args extracted and the files translated, and that spec v3.2 and v3.3 configs using fields unknown to spec v3.1 or
+// failing its validation are rejected
+func TestIgnitionSpecVersions(t *testing.T) {
+	// ignitionTemplate is a worker ignition with the spec version, the fields specific to that version and the
+	// ignition file path given by the test case
+	ignitionTemplate := `{"ignition":{"version":"%s"}%s,"storage":{"files":[{"path":"%s","contents":{"source":"data:,dummy-ca"},"mode":420}]%s},"systemd":{"units":[{"contents":"[Unit]\nDescription=Kubernetes Kubelet\n\n[Service]\nExecStart=/usr/bin/hyperkube \\\n    kubelet \\\n      --config=/etc/kubernetes/kubelet.conf \\\n      --cloud-provider=aws \\\n      --v=4\n","enabled":true,"name":"kubelet.service"}]}}`
+
+	tests := []struct {
+		name           string
+		version        string
+		topLevelFields string
+		storageFields  string
+		filePath       string
+		wantErr        bool
+	}{
+		{
+			name:    "spec v3.1",
+			version: "3.1.0",
+		},
+		{
+			name:    "spec v3.2",
+			version: "3.2.0",
+		},
+		{
+			name:    "spec v3.3",
+			version: "3.3.0",
+		},
+		{
+			name:          "spec v3.2 with luks",
+			version:       "3.2.0",
+			storageFields: `,"luks":[{"name":"data","device":"/dev/sdb","clevis":{"tpm2":true}}]`,
+			wantErr:       true,
+		},
+		{
+			name:           "spec v3.3 with kernel arguments",
+			version:        "3.3.0",
+			topLevelFields: `,"kernelArguments":{"shouldExist":["nosmt"]}`,
+			wantErr:        true,
+		},
+		{
+			name:     "spec v3.3 with relative file path",
+			version:  "3.3.0",
+			filePath: "etc/kubernetes/kubelet-ca.crt",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wmcb")
+			require.NoError(t, err, "error creating temp directory")
+			// Ignore the return error as there is not much we can do if the temporary directory is not deleted
+			defer os.RemoveAll(dir)
+
+			filePath := tt.filePath
+			if filePath == "" {
+				filePath = "/etc/kubernetes/kubelet-ca.crt"
+			}
+			wnb := winNodeBootstrapper{installDir: dir}
+			ignitionContents := fmt.Sprintf(ignitionTemplate, tt.version, tt.topLevelFields, filePath,
+				tt.storageFields)
+			err = wnb.parseIgnitionFileContents([]byte(ignitionContents), map[string]fileTranslation{
+				"/etc/kubernetes/kubelet-ca.crt": {
+					dest: filepath.Join(dir, "kubelet-ca.crt"),
+				},
+			})
+			if tt.wantErr {
+				assert.Error(t, err, "no error parsing an invalid ignition config")
+				return
+			}
+			require.NoError(t, err, "error parsing ignition file contents")
+
+			caContents, err := ioutil.ReadFile(filepath.Join(dir, "kubelet-ca.crt"))
+			require.NoError(t, err, "kubelet-ca.crt was not created")
+			assert.Equal(t, "dummy-ca", string(caContents))
+
+			cloudProvider, present := getArgValue("cloud-provider", wnb.kubeletArgs)
+			assert.True(t, present, "cloud-provider option is not present in kubelet args")
+			assert.Equal(t, "aws", cloudProvider)
+			verbosity, _ := getArgValue("v", wnb.kubeletArgs)
+			assert.Equal(t, "4", verbosity)
+		})
+	}
+
+	t.Run("unsupported spec version", func(t *testing.T) {
+		wnb := winNodeBootstrapper{installDir: "/"}
+		err := wnb.parseIgnitionFileContents([]byte(fmt.Sprintf(ignitionTemplate, "3.9.0", "",
+			"/etc/kubernetes/kubelet-ca.crt", "")),
+			map[string]fileTranslation{})
+		assert.Error(t, err, "no error for an unsupported spec version")
+	})
+}
+
+// TestMissingIgnitionFiles tests that an error lists the expected files missing from the ignition storage
+func TestMissingIgnitionFiles(t *testing.T) {
+	ignitionContents := `{"ignition":{"version":"3.1.0"},"storage":{"files":[{"path":"/etc/kubernetes/kubeconfig","contents":{"source":"data:,dummy-kubeconfig"},"mode":420}]},"systemd":{"units":[{"contents":"[Unit]\nDescription=Kubernetes Kubelet\n\n[Service]\nExecStart=/usr/bin/hyperkube \\\n    kubelet \\\n      --config=/etc/kubernetes/kubelet.conf \\\n      --v=4\n","enabled":true,"name":"kubelet.service"}]}}`
+
+	dir, err := ioutil.TempDir("", "wmcb")
+	require.NoError(t, err, "error creating temp directory")
+	// Ignore the return error as there is not much we can do if the temporary directory is not deleted
+	defer os.RemoveAll(dir)
+
+	wnb := winNodeBootstrapper{installDir: dir}
+	err = wnb.parseIgnitionFileContents([]byte(ignitionContents), map[string]fileTranslation{
+		"/etc/kubernetes/kubeconfig": {
+			dest: filepath.Join(dir, "bootstrap-kubeconfig"),
+		},
+		"/etc/kubernetes/kubelet-ca.crt": {
+			dest: filepath.Join(dir, "kubelet-ca.crt"),
+		},
+	})
+	require.Error(t, err, "no error when kubelet-ca.crt is missing from the ignition file")
+	assert.Contains(t, err.Error(), "/etc/kubernetes/kubelet-ca.crt")
+	assert.NotContains(t, err.Error(), "/etc/kubernetes/kubeconfig")
+}
+
+// TestIgnitionFromMachineConfig tests that the kubelet args are extracted from the ignition embedded in a worker
+// MachineConfig
+func TestIgnitionFromMachineConfig(t *testing.T) {
+	machineConfigTemplate := `apiVersion: machineconfiguration.openshift.io/v1
+kind: %s
+metadata:
+  name: %s
+  labels:
+    machineconfiguration.openshift.io/role: %s
+spec:
+  config:
+    ignition:
+      version: 3.1.0
+    systemd:
+      units:
+      - name: kubelet.service
+        enabled: true
+        contents: |
+          [Unit]
+          Description=Kubernetes Kubelet
+
+          [Service]
+          ExecStart=/usr/bin/hyperkube \
+              kubelet \
+                --config=/etc/kubernetes/kubelet.conf \
+                --cloud-provider=aws \
+                --v=4
+`
+	tests := []struct {
+		name    string
+		kind    string
+		mcName  string
+		role    string
+		wantErr bool
+	}{
+		{
+			name:   "worker MachineConfig",
+			kind:   "MachineConfig",
+			mcName: "01-worker-kubelet",
+			role:   "worker",
+		},
+		{
+			name:   "rendered worker MachineConfig",
+			kind:   "MachineConfig",
+			mcName: "rendered-worker-5f2a8c1e",
+		},
+		{
+			name:    "master MachineConfig",
+			kind:    "MachineConfig",
+			mcName:  "01-master-kubelet",
+			role:    "master",
+			wantErr: true,
+		},
+		{
+			name:    "not a MachineConfig",
+			kind:    "MachineConfigPool",
+			mcName:  "worker",
+			role:    "worker",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ignitionContents, err := ignitionFromMachineConfig([]byte(fmt.Sprintf(machineConfigTemplate, tt.kind,
+				tt.mcName, tt.role)))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			dir, err := ioutil.TempDir("", "wmcb")
+			require.NoError(t, err, "error creating temp directory")
+			// Ignore the return error as there is not much we can do if the temporary directory is not deleted
+			defer os.RemoveAll(dir)
+
+			wnb := winNodeBootstrapper{installDir: dir}
+			err = wnb.parseIgnitionFileContents(ignitionContents, map[string]fileTranslation{})
+			require.NoError(t, err, "error parsing ignition extracted from the MachineConfig")
+			assert.Subset(t, wnb.kubeletArgs, []string{"--cloud-provider=aws", "--v=4"})
+		})
+	}
+
+	t.Run("MachineConfig without ignition", func(t *testing.T) {
+		_, err := ignitionFromMachineConfig([]byte("kind: MachineConfig\nmetadata:\n  name: rendered-worker-5f2a8c1e\n"))
+		assert.Error(t, err)
+	})
+}
+
+// TestServiceEnv tests that the kubelet unit environment and the proxy settings of the worker ignition are gathered
+// for the kubelet service environment
+func TestServiceEnv(t *testing.T) {
+	// ignitionTemplate is a worker ignition with the storage files and kubelet unit environment files given by the
+	// test case
+	ignitionTemplate := `{"ignition":{"version":"3.1.0"},"storage":{"files":[%s]},"systemd":{"units":[{"contents":"[Unit]\nDescription=Kubernetes Kubelet\n\n[Service]\nEnvironmentFile=/etc/os-release\n%s\nExecStart=/usr/bin/hyperkube \\\n    kubelet \\\n      --config=/etc/kubernetes/kubelet.conf \\\n      --v=4\n","enabled":true,"name":"kubelet.service"}]}}`
+	// proxyFile is a proxy environment file in the format written by the machine config operator
+	proxyFile := `{"path":"%s","contents":{"source":"data:,%s"},"mode":420}`
+
+	tests := []struct {
+		name           string
+		files          string
+		environment    string
+		wantServiceEnv []string
+	}{
+		{
+			name:  "dedicated proxy file",
+			files: fmt.Sprintf(proxyFile, proxyEnvFile, "HTTP_PROXY%3Dhttp%3A%2F%2Fproxy%3A3128%0AHTTPS_PROXY%3Dhttp%3A%2F%2Fproxy%3A3129%0ANO_PROXY%3D.cluster.local%2C10.0.0.0%2F16%0A"),
+			wantServiceEnv: []string{"HTTPS_PROXY=http://proxy:3129", "HTTP_PROXY=http://proxy:3128",
+				"NO_PROXY=.cluster.local,10.0.0.0/16"},
+		},
+		{
+			name:           "environment file referenced by the kubelet unit",
+			files:          fmt.Sprintf(proxyFile, "/etc/kubernetes/kubelet-env", "%23%20proxy%0Ahttps_proxy%3D%22http%3A%2F%2Fproxy%3A3129%22%0AOTHER%3Dvalue%0A"),
+			environment:    `EnvironmentFile=-/etc/kubernetes/kubelet-env`,
+			wantServiceEnv: []string{"HTTPS_PROXY=http://proxy:3129", "OTHER=value"},
+		},
+		{
+			name:           "environment declared by the kubelet unit",
+			environment:    `Environment=NODE_IP=10.0.0.5`,
+			wantServiceEnv: []string{"NODE_IP=10.0.0.5"},
+		},
+		{
+			name:  "non proxy settings in the dedicated proxy file",
+			files: fmt.Sprintf(proxyFile, proxyEnvFile, "OTHER%3Dvalue"),
+		},
+		{
+			name:  "environment file not referenced by the kubelet unit",
+			files: fmt.Sprintf(proxyFile, "/etc/kubernetes/kubelet-env", "HTTPS_PROXY%3Dhttp%3A%2F%2Fproxy%3A3129"),
+		},
+		{
+			name: "no proxy",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wnb := winNodeBootstrapper{installDir: "/"}
+			ignitionContents := fmt.Sprintf(ignitionTemplate, tt.files, tt.environment)
+			err := wnb.parseIgnitionFileContents([]byte(ignitionContents), map[string]fileTranslation{})
+			require.NoError(t, err, "error parsing ignition file contents")
+			assert.Equal(t, tt.wantServiceEnv, wnb.serviceEnv)
+		})
+	}
+}
+
+// TestUnitEnvironmentExpansion tests that environment variable references in the kubelet systemd unit args are
+// expanded, with the default transformers and with a transformer keeping the node labels of the unit, which are then
+// merged into the single node-labels arg of WMCB
+func TestUnitEnvironmentExpansion(t *testing.T) {
+	ignitionContents := `{"ignition":{"version":"3.1.0"},"storage":{"files":[{"path":"/etc/kubernetes/kubelet-env","contents":{"source":"data:,KUBELET_VERBOSITY%3D5%0AMAX_PODS%3D300%0A"},"mode":420}]},"systemd":{"units":[{"contents":"[Unit]\nDescription=Kubernetes Kubelet\n\n[Service]\nEnvironment=ID=windows \"ROLE=worker\" PROVIDER=aws\nEnvironment=MAX_PODS=100\nEnvironmentFile=/etc/os-release\nEnvironmentFile=-/etc/kubernetes/kubelet-env\nExecStart=/usr/bin/hyperkube \\\n    kubelet \\\n      --node-labels=node-role.kubernetes.io/${ROLE},example.com/os=${ID} \\\n      --cloud-provider=${PROVIDER} \\\n      --max-pods=${MAX_PODS} \\\n      --pod-infra-container-image=${INFRA_IMAGE} \\\n      --v=$KUBELET_VERBOSITY\n","enabled":true,"name":"kubelet.service"}]}}`
+
+	t.Run("default transformers", func(t *testing.T) {
+		wnb := winNodeBootstrapper{installDir: "/"}
+		err := wnb.parseIgnitionFileContents([]byte(ignitionContents), map[string]fileTranslation{})
+		require.NoError(t, err, "error parsing ignition file contents")
+
+		// declared with Environment=
+		cloudProvider, _ := getArgValue("cloud-provider", wnb.kubeletArgs)
+		assert.Equal(t, "aws", cloudProvider)
+		// set by an environment file, referenced without braces
+		verbosity, _ := getArgValue("v", wnb.kubeletArgs)
+		assert.Equal(t, "5", verbosity)
+		// the node labels of the unit are dropped, only the labels of WMCB are applied
+		assert.Equal(t, []string{"--node-labels=" + nodeLabel}, argsNamed("node-labels", wnb.kubeletArgs))
+		_, present := getArgValue("max-pods", wnb.kubeletArgs)
+		assert.False(t, present, "max-pods kept without a transformer")
+	})
+
+	t.Run("node labels kept", func(t *testing.T) {
+		wnb := winNodeBootstrapper{
+			installDir: "/",
+			kubeletArgTransformers: map[string]KubeletArgTransformer{
+				"node-labels":               keepKubeletArg("node-labels"),
+				"max-pods":                  keepKubeletArg("max-pods"),
+				"pod-infra-container-image": keepKubeletArg("pod-infra-container-image"),
+			},
+		}
+		err := wnb.parseIgnitionFileContents([]byte(ignitionContents), map[string]fileTranslation{})
+		require.NoError(t, err, "error parsing ignition file contents")
+
+		// declared with Environment=, merged into the node labels of WMCB
+		assert.Equal(t, []string{"--node-labels=" + nodeLabel + ",example.com/os=windows,node-role.kubernetes.io/worker="},
+			argsNamed("node-labels", wnb.kubeletArgs))
+		// set by an environment file, overriding the declared value
+		maxPods, _ := getArgValue("max-pods", wnb.kubeletArgs)
+		assert.Equal(t, "300", maxPods)
+		// unknown variables are left as is
+		infraImage, _ := getArgValue("pod-infra-container-image", wnb.kubeletArgs)
+		assert.Equal(t, "${INFRA_IMAGE}", infraImage)
+	})
+}
+
+// argsNamed returns the kubelet args with the given name
+func argsNamed(name string, args []string) []string {
+	var named []string
+	for _, arg := range args {
+		if kubeletArgName(arg) == "--"+name {
+			named = append(named, arg)
+		}
+	}
+	return named
+}
+
+// TestMultiStringValue tests the encoding and decoding of the kubelet service environment in the registry
+func TestMultiStringValue(t *testing.T) {
+	assert.Equal(t, []uint16{'A', '=', '1', 0, 'B', '=', '2', 0, 0}, multiStringValue([]string{"A=1", "B=2"}))
+	assert.Equal(t, []uint16{0}, multiStringValue(nil))
+	assert.Equal(t, []string{"A=1", "B=2"}, parseMultiStringValue(multiStringValue([]string{"A=1", "B=2"})))
+	assert.Nil(t, parseMultiStringValue(multiStringValue(nil)))
+}
+
+// TestCheckDNSServer tests the cluster DNS reachability check against a local UDP DNS stub
+func TestCheckDNSServer(t *testing.T) {
+	tests := []struct {
+		name string
+		// respond returns the response of the DNS stub to the given query, no response is sent if it returns nil
+		respond func(query []byte) []byte
+		wantErr bool
+	}{
+		{
+			name: "server answers",
+			respond: func(query []byte) []byte {
+				// Echo the query back as a NXDOMAIN response
+				response := append([]byte{}, query...)
+				response[2] |= 0x80
+				response[3] |= 0x03
+				return response
+			},
+		},
+		{
+			name: "server answers with a different id",
+			respond: func(query []byte) []byte {
+				response := append([]byte{}, query...)
+				response[0]++
+				response[2] |= 0x80
+				return response
+			},
+			wantErr: true,
+		},
+		{
+			name:    "server does not answer",
+			respond: func([]byte) []byte { return nil },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			require.NoError(t, err, "error starting DNS stub")
+			defer conn.Close()
+			go func() {
+				buf := make([]byte, 512)
+				for {
+					n, addr, err := conn.ReadFrom(buf)
+					if err != nil {
+						return
+					}
+					if response := tt.respond(buf[:n]); response != nil {
+						conn.WriteTo(response, addr)
+					}
+				}
+			}()
+
+			err = checkDNSServer(conn.LocalAddr().String(), 500*time.Millisecond)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// TestKubeconfigServer tests finding the API server URL of a kubeconfig
+func TestKubeconfigServer(t *testing.T) {
+	tests := []struct {
+		name       string
+		kubeconfig string
+		want       string
+		wantErr    bool
+	}{
+		{
+			name: "current context",
+			kubeconfig: `apiVersion: v1
+clusters:
+- cluster:
+    server: https://api-int.other.example.com:6443
+  name: other
+- cluster:
+    certificate-authority-data: ZHVtbXk=
+    server: https://api-int.cluster.example.com:6443
+  name: local
+contexts:
+- context:
+    cluster: local
+    user: kubelet
+  name: kubelet
+current-context: kubelet
+kind: Config`,
+			want: "https://api-int.cluster.example.com:6443",
+		},
+		{
+			name: "single cluster without current context",
+			kubeconfig: `clusters:
+- cluster:
+    server: https://api-int.cluster.example.com:6443
+  name: local`,
+			want: "https://api-int.cluster.example.com:6443",
+		},
+		{
+			name: "current context missing",
+			kubeconfig: `clusters:
+- cluster:
+    server: https://api-int.cluster.example.com:6443
+  name: local
+current-context: kubelet`,
+			wantErr: true,
+		},
+		{
+			name: "cluster of current context missing",
+			kubeconfig: `clusters:
+- cluster:
+    server: https://api-int.cluster.example.com:6443
+  name: local
+contexts:
+- context:
+    cluster: other
+  name: kubelet
+current-context: kubelet`,
+			wantErr: true,
+		},
+		{
+			name:       "no cluster",
+			kubeconfig: `kind: Config`,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := kubeconfigServer([]byte(tt.kubeconfig))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// TestCheckAPIServer tests the connectivity check against a listening and a closed fake API server address
+func TestCheckAPIServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	// Nothing listens on the address of a closed listener
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, closed.Close())
+
+	tests := []struct {
+		name    string
+		server  string
+		wantErr bool
+	}{
+		{
+			name:   "server listening",
+			server: "https://" + listener.Addr().String(),
+		},
+		{
+			name:    "server not listening",
+			server:  "https://" + closed.Addr().String(),
+			wantErr: true,
+		},
+		{
+			name:    "no host",
+			server:  "https://:6443",
+			wantErr: true,
+		},
+		{
+			name:    "no port",
+			server:  "tcp://127.0.0.1",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkAPIServer(tt.server, 500*time.Millisecond)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// TestInitializeKubeletAPIServerUnreachable tests that a running kubelet is left untouched if the API server of the
+// bootstrap kubeconfig in the ignition is not reachable
+func TestInitializeKubeletAPIServerUnreachable(t *testing.T) {
+	// Nothing listens on the address of a closed listener
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, closed.Close())
+	kubeconfig := "clusters:\n- cluster:\n    server: https://" + closed.Addr().String() + "\n  name: local\n"
+	ignitionContents := fmt.Sprintf(`{"ignition":{"version":"3.1.0"},"storage":{"files":[{"path":"/etc/kubernetes/kubeconfig","contents":{"source":"data:,%s"},"mode":420},{"path":"/etc/kubernetes/kubelet-ca.crt","contents":{"source":"data:,dummy-ca"},"mode":420}]},"systemd":{"units":[{"contents":"[Unit]\nDescription=Kubernetes Kubelet\n\n[Service]\nExecStart=/usr/bin/hyperkube \\\n    kubelet \\\n      --v=4\n","enabled":true,"name":"kubelet.service"}]}}`,
+		url.PathEscape(kubeconfig))
+
+	dir, err := ioutil.TempDir("", "wmcb")
+	require.NoError(t, err, "error creating temp directory")
+	// Ignore the return error as there is not much we can do if the temporary directory is not deleted
+	defer os.RemoveAll(dir)
+	ignitionFile := filepath.Join(dir, "worker.ign")
+	require.NoError(t, ioutil.WriteFile(ignitionFile, []byte(ignitionContents), 0644))
+
+	service := &fakeWindowsService{state: svc.Running}
+	kubeletSVC, err := newKubeletService(service, nil)
+	require.NoError(t, err)
+	wnb := winNodeBootstrapper{
+		installDir:       filepath.Join(dir, "k"),
+		ignitionFilePath: ignitionFile,
+		serviceMode:      ServiceModeEnsure,
+		checkAPIServer:   true,
+		kubeletSVC:       kubeletSVC,
+		services:         &fakeServiceManager{services: map[string]*fakeWindowsService{KubeletServiceName: service}},
+	}
+	_, err = wnb.InitializeKubelet()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), closed.Addr().String())
+	assert.Zero(t, service.stops, "kubelet stopped although the API server is not reachable")
+	assert.NoDirExists(t, wnb.installDir, "kubelet files written although the API server is not reachable")
+}
+
+// TestCheckContainerdVersion tests the comparison of the installed containerd version against the minimum version
+func TestCheckContainerdVersion(t *testing.T) {
+	tests := []struct {
+		name       string
+		output     string
+		minVersion string
+		wantErr    bool
+	}{
+		{
+			name:       "newer version",
+			output:     "containerd github.com/containerd/containerd v1.6.8 9cd3357b7fd7218e4aec3eae239db1f68a5a6ec6\n",
+			minVersion: "1.6.0",
+		},
+		{
+			name:       "same version",
+			output:     "containerd github.com/containerd/containerd v1.6.8 9cd3357b7fd7218e4aec3eae239db1f68a5a6ec6\n",
+			minVersion: "1.6.8",
+		},
+		{
+			name:       "older version",
+			output:     "containerd github.com/containerd/containerd v1.5.13 a17ec496a95e55601607ca50828147e8ccaeebf1\n",
+			minVersion: "1.6.0",
+			wantErr:    true,
+		},
+		{
+			name:       "release candidate of the minimum version",
+			output:     "containerd github.com/containerd/containerd v1.7.0-rc.1 ad97e3a2f3e6dd8e3f9eeb1e06cd8d71ca38cf32\n",
+			minVersion: "1.7.0",
+			wantErr:    true,
+		},
+		{
+			name:       "version built from source",
+			output:     "containerd github.com/containerd/containerd 1.7.0+unknown\n",
+			minVersion: "1.6.8",
+		},
+		{
+			name:       "no version",
+			output:     "containerd: command not found\n",
+			minVersion: "1.6.8",
+			wantErr:    true,
+		},
+		{
+			name:       "invalid minimum version",
+			output:     "containerd github.com/containerd/containerd v1.6.8 9cd3357b7fd7218e4aec3eae239db1f68a5a6ec6\n",
+			minVersion: "1.6",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkContainerdVersion(tt.output, tt.minVersion)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// TestKubeletArgTransformers tests that the kubelet systemd unit args are transformed by the default and custom
+// transformers
+func TestKubeletArgTransformers(t *testing.T) {
+	unitContents := "[Service]\nExecStartPre=/bin/mkdir --parents /etc/kubernetes/manifests\n" +
+		"ExecStart=/usr/bin/hyperkube \\\n    kubelet \\\n" +
+		"      --config=/etc/kubernetes/kubelet.conf \\\n" +
+		"      --container-runtime-endpoint=/var/run/crio/crio.sock \\\n" +
+		"      --volume-plugin-dir=/etc/kubernetes/kubelet-plugins/volume/exec \\\n" +
+		"      --minimum-container-ttl-duration=6m0s \\\n" +
+		"      --max-pods=100 \\\n" +
+		"      --cloud-provider=aws \\\n" +
+		"      --v=3\n"
+	unit := ignitionCfgv3Types.Unit{Name: kubeletSystemdName, Contents: &unitContents}
+
+	tests := []struct {
+		name         string
+		transformers map[string]KubeletArgTransformer
+		want         map[string]string
+	}{
+		{
+			name: "default transformers",
+			want: map[string]string{
+				"cloud-provider": "aws",
+				"v":              "3",
+			},
+		},
+		{
+			name: "custom transformers",
+			transformers: map[string]KubeletArgTransformer{
+				// keep an arg dropped by default
+				"minimum-container-ttl-duration": keepKubeletArg("minimum-container-ttl-duration"),
+				// keep an arg without a default transformer
+				"max-pods": keepKubeletArg("max-pods"),
+				// map the Linux socket to the Windows named pipe
+				"container-runtime-endpoint": func(string) (string, string) {
+					return "image-service-endpoint", containerdEndpointValue
+				},
+				// drop an arg kept by default
+				"cloud-provider": dropKubeletArg,
+			},
+			want: map[string]string{
+				"minimum-container-ttl-duration": "6m0s",
+				"max-pods":                       "100",
+				"image-service-endpoint":         containerdEndpointValue,
+				"v":                              "3",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wnb := winNodeBootstrapper{kubeletArgTransformers: tt.transformers}
+			args, err := wnb.parseKubeletArgs(unit)
+			require.NoError(t, err, "error parsing kubelet args")
+			assert.Equal(t, tt.want, args)
+
+			kubeletArgs, err := wnb.generateInitialKubeletArgs(args)
+			require.NoError(t, err, "error generating kubelet args")
+			for name, value := range tt.want {
+				if name == "v" {
+					continue
+				}
+				argValue, present := getArgValue(name, kubeletArgs)
+				assert.True(t, present, "%s option is not present in kubelet args", name)
+				assert.Equal(t, value, argValue)
+			}
+		})
+	}
+}
+
 // TestCloudConfExtraction tests if parseIgnitionFileContents can extract the cloud.conf present in a worker ignition
 // file contents and the resulting file is in the expected format with a set of key value pairs.
 // It also confirms the "--cloud-config" option constructed by WMCB is as expected. Example cloud.conf:
@@ -182,6 +1398,248 @@ func TestCreateKubeletConf(t *testing.T) {
 //	"maximumLoadBalancerRuleCount": 0
 // }
 
+// TestExtraKubeletArgs tests that extra kubelet args take precedence over the generated and ignition-derived args
+func TestExtraKubeletArgs(t *testing.T) {
+	unitContents := "[Service]\nExecStart=/usr/bin/hyperkube \\\n    kubelet \\\n" +
+		"      --max-pods=100 \\\n" +
+		"      --cloud-provider=aws \\\n" +
+		"      --v=3\n"
+	unit := ignitionCfgv3Types.Unit{Name: kubeletSystemdName, Contents: &unitContents}
+
+	wnb := winNodeBootstrapper{
+		kubeletArgTransformers: map[string]KubeletArgTransformer{"max-pods": keepKubeletArg("max-pods")},
+		extraKubeletArgs: []string{"--max-pods=250", "--system-reserved=cpu=500m,memory=1Gi", "--max-pods=500",
+			"--resolv-conf=c:\\k\\resolv.conf"},
+	}
+	args, err := wnb.parseKubeletArgs(unit)
+	require.NoError(t, err, "error parsing kubelet args")
+	kubeletArgs, err := wnb.generateInitialKubeletArgs(args)
+	require.NoError(t, err, "error generating kubelet args")
+
+	for name, want := range map[string]string{
+		// overrides both the ignition-derived value and an earlier extra arg
+		"max-pods": "500",
+		// not generated by WMCB
+		"system-reserved": "cpu=500m,memory=1Gi",
+		// overrides the value generated by WMCB
+		"resolv-conf": "c:\\k\\resolv.conf",
+		// left untouched
+		"cloud-provider": "aws",
+	} {
+		var values []string
+		for _, arg := range kubeletArgs {
+			if kubeletArgName(arg) == "--"+name {
+				values = append(values, strings.TrimPrefix(arg, "--"+name+"="))
+			}
+		}
+		assert.Equal(t, []string{want}, values, "unexpected values for kubelet arg %s", name)
+	}
+	assert.Equal(t, "--resolv-conf=c:\\k\\resolv.conf", kubeletArgs[len(kubeletArgs)-1],
+		"extra kubelet args not appended after the generated args")
+}
+
+// TestStartCordoned tests that the node is registered as unschedulable only when starting cordoned
+func TestStartCordoned(t *testing.T) {
+	for _, startCordoned := range []bool{true, false} {
+		t.Run(fmt.Sprintf("start cordoned %t", startCordoned), func(t *testing.T) {
+			wnb := winNodeBootstrapper{startCordoned: startCordoned}
+			kubeletArgs, err := wnb.generateInitialKubeletArgs(map[string]string{})
+			require.NoError(t, err, "error generating kubelet args")
+			_, present := getArgValue("register-schedulable", kubeletArgs)
+			assert.False(t, present, "deprecated register-schedulable option used")
+			taints, present := getArgValue("register-with-taints", kubeletArgs)
+			require.True(t, present, "register-with-taints option missing")
+			assert.Equal(t, startCordoned, strings.Contains(taints, cordonedTaint),
+				"unexpected presence of the cordoned taint")
+		})
+	}
+}
+
+// TestTaints tests that the node registers with the os=Windows taint and the given taints, unique by key and effect,
+// and that malformed taints, taints reusing the os key and taints duplicating a key and effect are rejected
+func TestTaints(t *testing.T) {
+	tests := []struct {
+		name               string
+		registerWithTaints []string
+		startCordoned      bool
+		want               string
+		wantErr            bool
+	}{
+		{
+			name: "default",
+			want: "os=Windows:NoSchedule",
+		},
+		{
+			name:               "extra taints",
+			registerWithTaints: []string{"gpu=true:NoSchedule", "example.com/team=windows:NoExecute"},
+			want:               "os=Windows:NoSchedule,gpu=true:NoSchedule,example.com/team=windows:NoExecute",
+		},
+		{
+			name:               "os=Windows effect changed",
+			registerWithTaints: []string{"gpu=true:NoSchedule", "os=Windows:PreferNoSchedule"},
+			want:               "os=Windows:PreferNoSchedule,gpu=true:NoSchedule",
+		},
+		{
+			name:               "os=Windows with several effects",
+			registerWithTaints: []string{"os=Windows:NoExecute", "gpu=true:NoSchedule", "os=Windows:PreferNoSchedule"},
+			want:               "os=Windows:NoExecute,os=Windows:PreferNoSchedule,gpu=true:NoSchedule",
+		},
+		{
+			name:               "cordoned taint given with start cordoned",
+			registerWithTaints: []string{"node.openshift.io/cordoned=true:NoSchedule"},
+			startCordoned:      true,
+			want:               "os=Windows:NoSchedule,node.openshift.io/cordoned=true:NoSchedule",
+		},
+		{
+			name:               "os key with another value",
+			registerWithTaints: []string{"os=Linux:NoSchedule"},
+			wantErr:            true,
+		},
+		{
+			name:               "os key with another value and effect",
+			registerWithTaints: []string{"os=Linux:NoExecute"},
+			wantErr:            true,
+		},
+		{
+			name:               "duplicate os=Windows taint",
+			registerWithTaints: []string{"os=Windows:NoExecute", "os=Windows:NoExecute"},
+			wantErr:            true,
+		},
+		{
+			name:               "same key and effect",
+			registerWithTaints: []string{"gpu=true:NoSchedule", "gpu=false:NoSchedule"},
+			wantErr:            true,
+		},
+		{
+			name:               "missing effect",
+			registerWithTaints: []string{"gpu=true"},
+			wantErr:            true,
+		},
+		{
+			name:               "missing value",
+			registerWithTaints: []string{"gpu:NoSchedule"},
+			wantErr:            true,
+		},
+		{
+			name:               "invalid effect",
+			registerWithTaints: []string{"gpu=true:NoRun"},
+			wantErr:            true,
+		},
+		{
+			name:               "invalid key",
+			registerWithTaints: []string{"-gpu=true:NoSchedule"},
+			wantErr:            true,
+		},
+		{
+			name:               "invalid value",
+			registerWithTaints: []string{"gpu=true:false:NoSchedule"},
+			wantErr:            true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTaints(tt.registerWithTaints)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			wnb := winNodeBootstrapper{registerWithTaints: tt.registerWithTaints, startCordoned: tt.startCordoned}
+			kubeletArgs, err := wnb.generateInitialKubeletArgs(map[string]string{})
+			require.NoError(t, err, "error generating kubelet args")
+			taints, present := getArgValue("register-with-taints", kubeletArgs)
+			require.True(t, present, "register-with-taints option not present")
+			assert.Equal(t, tt.want, taints)
+		})
+	}
+}
+
+// TestNodeLabels tests that the node is labelled with its machine config pool and the extra node labels, and that
+// the os_id label cannot be overridden
+func TestNodeLabels(t *testing.T) {
+	tests := []struct {
+		name              string
+		machineConfigPool string
+		nodeLabels        map[string]string
+		want              string
+	}{
+		{
+			name: "no pool",
+			want: "node.openshift.io/os_id=Windows",
+		},
+		{
+			name:              "pool",
+			machineConfigPool: "windows-gpu",
+			want:              "node.openshift.io/os_id=Windows,machineconfiguration.openshift.io/pool=windows-gpu",
+		},
+		{
+			name:              "extra labels merged with pool",
+			machineConfigPool: "windows-gpu",
+			nodeLabels: map[string]string{
+				"topology.kubernetes.io/zone":      "us-east-1a",
+				"node.kubernetes.io/instance-type": "m5a.large",
+			},
+			want: "node.openshift.io/os_id=Windows,machineconfiguration.openshift.io/pool=windows-gpu," +
+				"node.kubernetes.io/instance-type=m5a.large,topology.kubernetes.io/zone=us-east-1a",
+		},
+		{
+			name:              "extra labels override pool",
+			machineConfigPool: "windows-gpu",
+			nodeLabels:        map[string]string{"machineconfiguration.openshift.io/pool": "windows"},
+			want:              "node.openshift.io/os_id=Windows,machineconfiguration.openshift.io/pool=windows",
+		},
+		{
+			name:       "os_id enforced",
+			nodeLabels: map[string]string{"node.openshift.io/os_id": "Linux", "zone": "a"},
+			want:       "node.openshift.io/os_id=Windows,zone=a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wnb := winNodeBootstrapper{machineConfigPool: tt.machineConfigPool, extraNodeLabels: tt.nodeLabels}
+			kubeletArgs, err := wnb.generateInitialKubeletArgs(map[string]string{})
+			require.NoError(t, err, "error generating kubelet args")
+			nodeLabels, present := getArgValue("node-labels", kubeletArgs)
+			require.True(t, present, "node-labels option not present")
+			assert.Equal(t, tt.want, nodeLabels)
+		})
+	}
+}
+
+// TestKubeletLogArgs tests that the kubelet log file is written to the log directory, and rotated at the given size
+func TestKubeletLogArgs(t *testing.T) {
+	tests := []struct {
+		name           string
+		logDir         string
+		logFileMaxSize int
+		wantMaxSize    string
+	}{
+		{
+			name:   "default max size",
+			logDir: filepath.Join("c:", "var", "log", "kubelet"),
+		},
+		{
+			name:           "custom log directory and max size",
+			logDir:         filepath.Join("d:", "logs", "kubelet"),
+			logFileMaxSize: 100,
+			wantMaxSize:    "100",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wnb := winNodeBootstrapper{logDir: tt.logDir, logFileMaxSize: tt.logFileMaxSize}
+			kubeletArgs, err := wnb.generateInitialKubeletArgs(map[string]string{})
+			require.NoError(t, err, "error generating kubelet args")
+			logFile, present := getArgValue("log-file", kubeletArgs)
+			require.True(t, present, "log-file option not present")
+			assert.Equal(t, filepath.Join(tt.logDir, "kubelet.log"), logFile)
+			maxSize, present := getArgValue("log-file-max-size", kubeletArgs)
+			assert.Equal(t, tt.wantMaxSize != "", present, "unexpected presence of log-file-max-size option")
+			assert.Equal(t, tt.wantMaxSize, maxSize)
+		})
+	}
+}
+
 // getArgValue takes a slice of args and returns whether the specified arg is present, and if it is, its value
 func getArgValue(key string, args []string) (string, bool) {
 	prefix := fmt.Sprintf("--%s=", key)
@@ -191,7 +1649,119 @@ func getArgValue(key string, args []string) (string, bool) {
 		}
 		return strings.TrimPrefix(arg, prefix), true
 	}
-	return "", false
+	return "", false
+}
+
+// TestContainerRuntimeEndpoint tests that the container runtime endpoint can be overridden, and that the kubelet
+// service depends on the service serving it
+func TestContainerRuntimeEndpoint(t *testing.T) {
+	tests := []struct {
+		name             string
+		endpoint         string
+		wantArg          string
+		wantDependencies []string
+		wantErr          bool
+	}{
+		{
+			name:             "default containerd pipe",
+			wantArg:          "--container-runtime-endpoint=npipe://./pipe/containerd-containerd",
+			wantDependencies: []string{"containerd"},
+		},
+		{
+			name:             "custom containerd pipe",
+			endpoint:         "npipe:////./pipe/containerd-custom",
+			wantArg:          "--container-runtime-endpoint=npipe:////./pipe/containerd-custom",
+			wantDependencies: []string{"containerd"},
+		},
+		{
+			name:             "docker pipe",
+			endpoint:         "npipe://./pipe/docker_engine",
+			wantArg:          "--container-runtime-endpoint=npipe://./pipe/docker_engine",
+			wantDependencies: []string{"docker"},
+		},
+		{
+			name:     "tcp endpoint",
+			endpoint: "tcp://localhost:3735",
+			wantArg:  "--container-runtime-endpoint=tcp://localhost:3735",
+		},
+		{
+			name:     "unix socket",
+			endpoint: "unix:///run/containerd/containerd.sock",
+			wantErr:  true,
+		},
+		{
+			name:     "unix socket path",
+			endpoint: "/run/containerd/containerd.sock",
+			wantErr:  true,
+		},
+		{
+			name:     "pipe without a name",
+			endpoint: "npipe://./pipe/",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.endpoint != "" {
+				err := validateContainerRuntimeEndpoint(tt.endpoint)
+				if tt.wantErr {
+					assert.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+			}
+			wnb := winNodeBootstrapper{containerRuntimeEndpoint: tt.endpoint}
+			kubeletArgs, err := wnb.generateInitialKubeletArgs(map[string]string{})
+			require.NoError(t, err)
+			assert.Contains(t, kubeletArgs, tt.wantArg)
+			assert.Equal(t, tt.wantDependencies, wnb.kubeletServiceConfig().Dependencies)
+		})
+	}
+}
+
+// TestRuntimeServiceDependencies tests that the container runtime service the kubelet depends on can be overridden,
+// and that the dependency is omitted if the service is not installed
+func TestRuntimeServiceDependencies(t *testing.T) {
+	svcMgr := &fakeServiceManager{services: map[string]*fakeWindowsService{
+		"containerd":        {state: svc.Running},
+		"containerd-custom": {state: svc.Running},
+	}}
+	tests := []struct {
+		name               string
+		runtimeServiceName string
+		endpoint           string
+		wantDependencies   []string
+	}{
+		{
+			name:             "default",
+			wantDependencies: []string{"containerd"},
+		},
+		{
+			name:               "custom service",
+			runtimeServiceName: "containerd-custom",
+			wantDependencies:   []string{"containerd-custom"},
+		},
+		{
+			name:               "custom service overrides the endpoint",
+			runtimeServiceName: "containerd-custom",
+			endpoint:           "npipe://./pipe/docker_engine",
+			wantDependencies:   []string{"containerd-custom"},
+		},
+		{
+			name:               "custom service not installed",
+			runtimeServiceName: "containerd-missing",
+		},
+		{
+			name:     "docker not installed",
+			endpoint: "npipe://./pipe/docker_engine",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wnb := winNodeBootstrapper{runtimeServiceName: tt.runtimeServiceName, containerRuntimeEndpoint: tt.endpoint}
+			assert.Equal(t, tt.wantDependencies, installedServices(svcMgr, wnb.kubeletServiceConfig().Dependencies))
+		})
+	}
 }
 
 // TestKubeletArgs tests that parseIgnitionFileContents populates the kubelet args properly
@@ -234,6 +1804,7 @@ func TestKubeletArgs(t *testing.T) {
 				kubeconfigPath:  filepath.Join("/fakepath/kubeconfig"),
 				kubeletConfPath: filepath.Join("/fakepath/kubelet.conf"),
 				logDir:          "/fakepath/",
+				certDir:         "c:\\var\\lib\\kubelet\\pki\\",
 			},
 		},
 		{
@@ -244,6 +1815,7 @@ func TestKubeletArgs(t *testing.T) {
 				kubeconfigPath:  filepath.Join("/fakepath/kubeconfig"),
 				kubeletConfPath: filepath.Join("/fakepath/kubelet.conf"),
 				logDir:          "/fakepath/",
+				certDir:         "c:\\var\\lib\\kubelet\\pki\\",
 				nodeIP:          "192.168.1.1",
 			},
 		},
@@ -289,7 +1861,9 @@ func TestKubeletVerbosityArgs(t *testing.T) {
 			name:                   "verbosity present in ignition content should use it",
 			ignitionContents:       ignitionContentsWithKubeletVerbosity,
 			additionalExpectedArgs: []string{"--v=1"},
-			wnb:                    winNodeBootstrapper{},
+			wnb: winNodeBootstrapper{
+				certDir: "c:\\var\\lib\\kubelet\\pki\\",
+			},
 		},
 		{
 			name:                   "verbosity present program argument should use it",
@@ -297,13 +1871,16 @@ func TestKubeletVerbosityArgs(t *testing.T) {
 			additionalExpectedArgs: []string{"--v=2"},
 			wnb: winNodeBootstrapper{
 				kubeletVerbosity: "2",
+				certDir:          "c:\\var\\lib\\kubelet\\pki\\",
 			},
 		},
 		{
 			name:                   "no verbosity should load default",
 			ignitionContents:       ignitionContentsWithoutKubeletVerbosity,
 			additionalExpectedArgs: []string{"--v=3"},
-			wnb:                    winNodeBootstrapper{},
+			wnb: winNodeBootstrapper{
+				certDir: "c:\\var\\lib\\kubelet\\pki\\",
+			},
 		},
 	}
 	for _, test := range testIO {
@@ -387,6 +1964,44 @@ func TestCloudConfExtraction(t *testing.T) {
 	assert.Contains(t, cloudConfigOptValue, string(os.PathSeparator), "Path not correctly set for cloud-config")
 }
 
+// TestVSphereCloudConfExtraction tests that the cloud config referenced by the kubelet args of a vSphere ignition is
+// created in the install dir, as the cloud config is not specific to Azure
+func TestVSphereCloudConfExtraction(t *testing.T) {
+	// ignitionContents is a minimal vSphere worker ignition with a vsphere.conf cloud config
+	ignitionContents := `{"ignition":{"version":"3.1.0"},"storage":{"files":[{"path":"/etc/kubernetes/vsphere.conf","contents":{"source":"data:,%5BGlobal%5D%0Asecret-name%20%3D%20vsphere-creds%0Asecret-namespace%20%3D%20kube-system%0Ainsecure-flag%20%3D%201%0A%0A%5BWorkspace%5D%0Aserver%20%3D%20vcenter.example.com%0Adatacenter%20%3D%20dc1%0Adefault-datastore%20%3D%20datastore1%0Afolder%20%3D%20%2Fdc1%2Fvm%2Fwinc-test%0A"},"mode":420}]},"systemd":{"units":[{"contents":"[Service]\nExecStart=/usr/bin/hyperkube kubelet --cloud-provider=vsphere --cloud-config=/etc/kubernetes/vsphere.conf --v=3\n","enabled":true,"name":"kubelet.service"}]}}`
+
+	// Create a temp directory with wmcb prefix
+	dir, err := ioutil.TempDir("", "wmcb")
+	require.NoError(t, err, "error creating temp directory")
+	// Ignore the return error as there is not much we can do if the temporary directory is not deleted
+	defer os.RemoveAll(dir)
+
+	wnb := winNodeBootstrapper{
+		installDir:   dir,
+		platformType: "VSphere",
+	}
+	err = wnb.parseIgnitionFileContents([]byte(ignitionContents), map[string]fileTranslation{})
+	require.NoError(t, err, "error parsing ignition file contents")
+
+	confContents, err := ioutil.ReadFile(filepath.Join(dir, "vsphere.conf"))
+	require.NoError(t, err, "error reading vsphere.conf")
+	assert.Equal(t, "[Global]\nsecret-name = vsphere-creds\nsecret-namespace = kube-system\ninsecure-flag = 1\n\n[Workspace]\nserver = vcenter.example.com\ndatacenter = dc1\ndefault-datastore = datastore1\nfolder = /dc1/vm/winc-test\n", string(confContents))
+
+	cloudConfig, present := getArgValue(cloudConfigOption, wnb.kubeletArgs)
+	assert.True(t, present, "cloud-config option is not present in kubelet args")
+	assert.Equal(t, filepath.Join(dir, "vsphere.conf"), cloudConfig)
+	cloudProvider, present := getArgValue("cloud-provider", wnb.kubeletArgs)
+	assert.True(t, present, "cloud-provider option is not present in kubelet args")
+	assert.Equal(t, "vsphere", cloudProvider)
+
+	t.Run("missing cloud config", func(t *testing.T) {
+		withoutCloudConfig := strings.Replace(ignitionContents, "/etc/kubernetes/vsphere.conf\",\"contents\"",
+			"/etc/kubernetes/other.conf\",\"contents\"", 1)
+		err := wnb.parseIgnitionFileContents([]byte(withoutCloudConfig), map[string]fileTranslation{})
+		assert.Error(t, err, "no error for a cloud config missing from the ignition")
+	})
+}
+
 // TestCloudConfNotPresent tests that parseIgnitionFileContents will only create a cloud.conf file and add the
 // "--cloud-config" option to the kubelet args, if the cloud.conf file is present in the ignition file.
 func TestCloudConfNotPresent(t *testing.T) {
@@ -429,7 +2044,467 @@ func TestCloudConfInvalidNames(t *testing.T) {
 	assert.Error(t, err, "error not thrown on encountering invalid --cloud-config option")
 }
 
+// TestCloudProviderAndConfCombinations tests that the cloud provider and cloud config kubelet args are validated
+// and passed along together
+func TestCloudProviderAndConfCombinations(t *testing.T) {
+	// ignitionTemplate is a minimal worker ignition with a cloud.conf file, and a kubelet unit whose cloud related
+	// args are given by the test case
+	ignitionTemplate := `{"ignition":{"version":"3.1.0"},"storage":{"files":[{"path":"/etc/kubernetes/cloud.conf","contents":{"source":"data:,%%7B%%7D"},"mode":420}]},"systemd":{"units":[{"contents":"[Service]\nExecStart=/usr/bin/hyperkube kubelet %s --v=3\n","enabled":true,"name":"kubelet.service"}]}}`
+
+	tests := []struct {
+		name              string
+		cloudArgs         string
+		platformType      string
+		wantErr           bool
+		wantCloudProvider string
+		wantCloudConfig   bool
+	}{
+		{
+			name:              "external cloud provider with cloud config",
+			cloudArgs:         "--cloud-provider=external --cloud-config=/etc/kubernetes/cloud.conf",
+			platformType:      "Azure",
+			wantCloudProvider: "external",
+			wantCloudConfig:   true,
+		},
+		{
+			name:              "cloud config without cloud provider defaults from the platform",
+			cloudArgs:         "--cloud-config=/etc/kubernetes/cloud.conf",
+			platformType:      "Azure",
+			wantCloudProvider: "azure",
+			wantCloudConfig:   true,
+		},
+		{
+			name:              "vSphere cloud config without cloud provider defaults from the platform",
+			cloudArgs:         "--cloud-config=/etc/kubernetes/cloud.conf",
+			platformType:      "VSphere",
+			wantCloudProvider: "vsphere",
+			wantCloudConfig:   true,
+		},
+		{
+			name:              "GCP cloud config",
+			cloudArgs:         "--cloud-provider=gce --cloud-config=/etc/kubernetes/cloud.conf",
+			platformType:      "GCP",
+			wantCloudProvider: "gce",
+			wantCloudConfig:   true,
+		},
+		{
+			name:         "cloud config without cloud provider on an unknown platform",
+			cloudArgs:    "--cloud-config=/etc/kubernetes/cloud.conf",
+			platformType: "",
+			wantErr:      true,
+		},
+		{
+			name:              "cloud provider without cloud config",
+			cloudArgs:         "--cloud-provider=azure",
+			platformType:      "Azure",
+			wantCloudProvider: "azure",
+			wantCloudConfig:   false,
+		},
+	}
+	// The node name is not under test, it is derived from the metadata servers of the platforms
+	defer func(derive func(string) (string, error)) { deriveNodeName = derive }(deriveNodeName)
+	deriveNodeName = func(string) (string, error) { return "", nil }
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "wmcb")
+			require.NoError(t, err, "error creating temp directory")
+			// Ignore the return error as there is not much we can do if the temporary directory is not deleted
+			defer os.RemoveAll(dir)
+
+			wnb := winNodeBootstrapper{
+				installDir:   dir,
+				platformType: tt.platformType,
+			}
+			err = wnb.parseIgnitionFileContents([]byte(fmt.Sprintf(ignitionTemplate, tt.cloudArgs)),
+				map[string]fileTranslation{})
+			if tt.wantErr {
+				assert.Error(t, err, "no error for cloud config without cloud provider")
+				return
+			}
+			require.NoError(t, err, "error parsing ignition file contents")
+
+			cloudProvider, present := getArgValue("cloud-provider", wnb.kubeletArgs)
+			assert.True(t, present, "cloud-provider option is not present in kubelet args")
+			assert.Equal(t, tt.wantCloudProvider, cloudProvider)
+
+			cloudConfig, present := getArgValue(cloudConfigOption, wnb.kubeletArgs)
+			assert.Equal(t, tt.wantCloudConfig, present, "unexpected presence of cloud-config option")
+			if tt.wantCloudConfig {
+				assert.Equal(t, filepath.Join(dir, "cloud.conf"), cloudConfig)
+				assert.FileExists(t, filepath.Join(dir, "cloud.conf"), "cloud.conf was not created")
+			}
+		})
+	}
+}
+
+// TestInstallDrive tests that the kubelet directories follow the drive of the install dir
+func TestInstallDrive(t *testing.T) {
+	tests := []struct {
+		name        string
+		installDir  string
+		wantLogDir  string
+		wantCertDir string
+	}{
+		{
+			name:        "default install dir",
+			installDir:  `c:\k`,
+			wantLogDir:  `c:\var\log\kubelet`,
+			wantCertDir: `c:\var\lib\kubelet\pki\`,
+		},
+		{
+			name:        "install dir on D drive",
+			installDir:  `D:\k`,
+			wantLogDir:  `D:\var\log\kubelet`,
+			wantCertDir: `D:\var\lib\kubelet\pki\`,
+		},
+		{
+			name:        "install dir without drive",
+			installDir:  `\k`,
+			wantLogDir:  `c:\var\log\kubelet`,
+			wantCertDir: `c:\var\lib\kubelet\pki\`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantLogDir, installDrive(tt.installDir)+logDirectory)
+			assert.Equal(t, tt.wantCertDir, installDrive(tt.installDir)+certDirectory)
+		})
+	}
+}
+
+// TestDisconnect tests that a bootstrapper without a kubelet service can be disconnected
+func TestDisconnect(t *testing.T) {
+	wnb := winNodeBootstrapper{svcMgr: &mgr.Mgr{}}
+	assert.NotPanics(t, func() {
+		// The returned error depends on the Windows service manager handle, which is not valid here
+		_ = wnb.Disconnect()
+	})
+	assert.Nil(t, wnb.svcMgr, "service manager was not disconnected")
+	assert.NoError(t, wnb.Disconnect(), "error disconnecting an already disconnected bootstrapper")
+}
+
 // TestKubeletDirectoriesCreation tests if the directories needed for Kubelet are initialized as required
+// TestValidate tests that the kubelet args are generated from the ignition without creating any files in the install
+// directory or looking up the node name. The bootstrapper has no service manager connection, so any service manager
+// call would fail the test.
+func TestValidate(t *testing.T) {
+	defer func(derive func(string) (string, error)) { deriveNodeName = derive }(deriveNodeName)
+	deriveNodeName = func(string) (string, error) {
+		t.Error("node name was looked up")
+		return "", nil
+	}
+
+	ignitionContents := `{"ignition":{"version":"3.1.0"},"storage":{"files":[{"path":"/etc/kubernetes/kubeconfig","contents":{"source":"data:,dummy-kubeconfig"},"mode":420},{"path":"/etc/kubernetes/kubelet-ca.crt","contents":{"source":"data:,dummy-ca"},"mode":420}]},"systemd":{"units":[{"contents":"[Unit]\nDescription=Kubernetes Kubelet\n\n[Service]\nExecStart=/usr/bin/hyperkube \\\n    kubelet \\\n      --config=/etc/kubernetes/kubelet.conf \\\n      --cloud-provider=aws \\\n      --v=4\n","enabled":true,"name":"kubelet.service"}]}}`
+
+	dir, err := ioutil.TempDir("", "wmcb")
+	require.NoError(t, err, "error creating temp directory")
+	// Ignore the return error as there is not much we can do if the temporary directory is not deleted
+	defer os.RemoveAll(dir)
+	ignitionFile := filepath.Join(dir, "worker.ign")
+	require.NoError(t, ioutil.WriteFile(ignitionFile, []byte(ignitionContents), 0644))
+	installDir := filepath.Join(dir, "k")
+
+	wnb := winNodeBootstrapper{
+		installDir:       installDir,
+		kubeconfigPath:   filepath.Join(installDir, "kubeconfig"),
+		kubeletConfPath:  filepath.Join(installDir, "kubelet.conf"),
+		logDir:           filepath.Join(dir, "log"),
+		staticPodDir:     filepath.Join(installDir, "etc", "kubernetes", "manifests"),
+		ignitionFilePath: ignitionFile,
+		platformType:     "GCP",
+		checkAPIServer:   true,
+	}
+	kubeletArgs, err := wnb.Validate()
+	require.NoError(t, err, "error validating")
+	assert.Subset(t, kubeletArgs, []string{"--cloud-provider=aws", "--v=4"})
+	_, present := getArgValue("hostname-override", kubeletArgs)
+	assert.False(t, present, "hostname-override option is present in kubelet args")
+	assert.NoDirExists(t, installDir, "install directory was created")
+	assert.NoDirExists(t, filepath.Join(dir, "log"), "log directory was created")
+	assert.Nil(t, wnb.kubeletArgs, "the bootstrapper was modified")
+
+	t.Run("missing kubelet", func(t *testing.T) {
+		wnb.initialKubeletPath = filepath.Join(dir, "kubelet.exe")
+		_, err := wnb.Validate()
+		assert.Error(t, err)
+	})
+}
+
+// TestValidationCopy tests that the copy of the bootstrapper used for validation shares no slices or maps with it
+func TestValidationCopy(t *testing.T) {
+	wnb := winNodeBootstrapper{
+		installDir:             `c:\k`,
+		kubeletArgs:            []string{"--v=4"},
+		enforceNodeAllocatable: []string{"pods"},
+		tlsCipherSuites:        []string{"TLS_AES_128_GCM_SHA256"},
+		serviceEnv:             []string{"HTTP_PROXY=http://proxy"},
+		extraKubeletArgs:       []string{"--max-pods=100"},
+		registerWithTaints:     []string{"dedicated=infra:NoSchedule"},
+		featureGates:           map[string]bool{"RotateKubeletServerCertificate": true},
+		kubeletArgTransformers: map[string]KubeletArgTransformer{"v": nil},
+		extraNodeLabels:        map[string]string{"example.com/tier": "web"},
+		checkDNS:               true,
+		checkAPIServer:         true,
+	}
+	validation := wnb.validationCopy(`c:\tmp\wmcb`)
+	assert.Equal(t, `c:\tmp\wmcb`, validation.installDir)
+	assert.False(t, validation.checkDNS, "DNS check is enabled")
+	assert.False(t, validation.checkAPIServer, "API server check is enabled")
+	assert.True(t, validation.skipNodeNameLookup, "node name is looked up")
+
+	validation.kubeletArgs[0] = "--v=2"
+	validation.enforceNodeAllocatable[0] = "none"
+	validation.tlsCipherSuites[0] = "TLS_AES_256_GCM_SHA384"
+	validation.serviceEnv[0] = "HTTP_PROXY="
+	validation.extraKubeletArgs[0] = "--max-pods=200"
+	validation.registerWithTaints[0] = "dedicated=infra:NoExecute"
+	validation.featureGates["RotateKubeletServerCertificate"] = false
+	delete(validation.kubeletArgTransformers, "v")
+	validation.extraNodeLabels["example.com/tier"] = "db"
+	assert.Equal(t, []string{"--v=4"}, wnb.kubeletArgs)
+	assert.Equal(t, []string{"pods"}, wnb.enforceNodeAllocatable)
+	assert.Equal(t, []string{"TLS_AES_128_GCM_SHA256"}, wnb.tlsCipherSuites)
+	assert.Equal(t, []string{"HTTP_PROXY=http://proxy"}, wnb.serviceEnv)
+	assert.Equal(t, []string{"--max-pods=100"}, wnb.extraKubeletArgs)
+	assert.Equal(t, []string{"dedicated=infra:NoSchedule"}, wnb.registerWithTaints)
+	assert.Equal(t, map[string]bool{"RotateKubeletServerCertificate": true}, wnb.featureGates)
+	assert.Contains(t, wnb.kubeletArgTransformers, "v")
+	assert.Equal(t, map[string]string{"example.com/tier": "web"}, wnb.extraNodeLabels)
+	assert.Equal(t, `c:\k`, wnb.installDir, "the bootstrapper was modified")
+	assert.True(t, wnb.checkDNS, "the bootstrapper was modified")
+}
+
+// TestKubeletUpToDate tests the detection of a kubelet service already running with the desired args, environment and
+// files, which does not need to be restarted
+func TestKubeletUpToDate(t *testing.T) {
+	ignitionContents := `{"ignition":{"version":"3.1.0"},"storage":{"files":[{"path":"/etc/kubernetes/kubeconfig","contents":{"source":"data:,dummy-kubeconfig"},"mode":420},{"path":"/etc/kubernetes/kubelet-ca.crt","contents":{"source":"data:,dummy-ca"},"mode":420}]},"systemd":{"units":[{"contents":"[Unit]\nDescription=Kubernetes Kubelet\n\n[Service]\nExecStart=/usr/bin/hyperkube \\\n    kubelet \\\n      --config=/etc/kubernetes/kubelet.conf \\\n      --cloud-provider=aws \\\n      --v=4\n","enabled":true,"name":"kubelet.service"}]}}`
+
+	dir, err := ioutil.TempDir("", "wmcb")
+	require.NoError(t, err, "error creating temp directory")
+	// Ignore the return error as there is not much we can do if the temporary directory is not deleted
+	defer os.RemoveAll(dir)
+	ignitionFile := filepath.Join(dir, "worker.ign")
+	require.NoError(t, ioutil.WriteFile(ignitionFile, []byte(ignitionContents), 0644))
+	kubeletFile := filepath.Join(dir, "kubelet.exe")
+	installDir := filepath.Join(dir, "k")
+
+	tests := []struct {
+		name string
+		// modify changes the state of the node after the kubelet files were initialized
+		modify func(t *testing.T)
+		// existingCmd returns the command of the kubelet service given the desired one
+		existingCmd func(desiredCmd string) string
+		existingEnv []string
+		want        bool
+	}{
+		{
+			name:        "unchanged",
+			modify:      func(t *testing.T) {},
+			existingCmd: func(desiredCmd string) string { return desiredCmd },
+			want:        true,
+		},
+		{
+			name:   "quoted binary path created by the service manager",
+			modify: func(t *testing.T) {},
+			existingCmd: func(desiredCmd string) string {
+				binaryPath := filepath.Join(installDir, "kubelet.exe")
+				return strings.Replace(desiredCmd, binaryPath, `"`+binaryPath+`"`, 1)
+			},
+			want: true,
+		},
+		{
+			name:        "args changed",
+			modify:      func(t *testing.T) {},
+			existingCmd: func(desiredCmd string) string { return strings.Replace(desiredCmd, "--v=4", "--v=3", 1) },
+			want:        false,
+		},
+		{
+			name:        "environment changed",
+			modify:      func(t *testing.T) {},
+			existingCmd: func(desiredCmd string) string { return desiredCmd },
+			existingEnv: []string{"HTTP_PROXY=http://proxy:3128"},
+			want:        false,
+		},
+		{
+			name: "kubelet configuration changed",
+			modify: func(t *testing.T) {
+				require.NoError(t, ioutil.WriteFile(filepath.Join(installDir, "kubelet.conf"), []byte("{}"), 0644))
+			},
+			existingCmd: func(desiredCmd string) string { return desiredCmd },
+			want:        false,
+		},
+		{
+			name: "new kubelet binary",
+			modify: func(t *testing.T) {
+				require.NoError(t, ioutil.WriteFile(kubeletFile, []byte("new kubelet"), 0644))
+			},
+			existingCmd: func(desiredCmd string) string { return desiredCmd },
+			want:        false,
+		},
+		{
+			name: "missing bootstrap kubeconfig",
+			modify: func(t *testing.T) {
+				require.NoError(t, os.Remove(filepath.Join(installDir, "bootstrap-kubeconfig")))
+			},
+			existingCmd: func(desiredCmd string) string { return desiredCmd },
+			want:        false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, ioutil.WriteFile(kubeletFile, []byte("kubelet"), 0644))
+			wnb := winNodeBootstrapper{
+				installDir:         installDir,
+				kubeconfigPath:     filepath.Join(installDir, "kubeconfig"),
+				kubeletConfPath:    filepath.Join(installDir, "kubelet.conf"),
+				logDir:             filepath.Join(dir, "log"),
+				staticPodDir:       filepath.Join(installDir, "etc", "kubernetes", "manifests"),
+				ignitionFilePath:   ignitionFile,
+				initialKubeletPath: kubeletFile,
+				services: &fakeServiceManager{env: map[string][]string{
+					KubeletServiceName: tt.existingEnv,
+				}},
+			}
+			setup, err := wnb.generateKubeletSetup()
+			require.NoError(t, err, "error generating kubelet setup")
+			_, err = wnb.initializeKubeletFiles(setup)
+			require.NoError(t, err, "error initializing kubelet files")
+			existingCmd := tt.existingCmd(wnb.kubeletCommand(wnb.kubeletArgs))
+			tt.modify(t)
+
+			upToDate, err := wnb.kubeletUpToDate(existingCmd, setup)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, upToDate)
+		})
+	}
+}
+
+// TestInitializeKubeletUnchanged tests that a kubelet service already running with the environment, args and files
+// generated from the ignition is neither stopped nor started again, and that the ignition is parsed only once, the
+// node name being derived a single time although the API server is checked as well
+func TestInitializeKubeletUnchanged(t *testing.T) {
+	apiServer, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer apiServer.Close()
+	kubeconfig := "clusters:\n- cluster:\n    server: https://" + apiServer.Addr().String() + "\n  name: local\n"
+	ignitionContents := fmt.Sprintf(`{"ignition":{"version":"3.1.0"},"storage":{"files":[{"path":"/etc/kubernetes/kubeconfig","contents":{"source":"data:,%s"},"mode":420},{"path":"/etc/kubernetes/kubelet-ca.crt","contents":{"source":"data:,dummy-ca"},"mode":420}]},"systemd":{"units":[{"contents":"[Unit]\nDescription=Kubernetes Kubelet\n\n[Service]\nEnvironment=HTTP_PROXY=http://proxy:3128\nExecStart=/usr/bin/hyperkube \\\n    kubelet \\\n      --config=/etc/kubernetes/kubelet.conf \\\n      --v=4\n","enabled":true,"name":"kubelet.service"}]}}`,
+		url.PathEscape(kubeconfig))
+
+	dir, err := ioutil.TempDir("", "wmcb")
+	require.NoError(t, err, "error creating temp directory")
+	// Ignore the return error as there is not much we can do if the temporary directory is not deleted
+	defer os.RemoveAll(dir)
+	ignitionFile := filepath.Join(dir, "worker.ign")
+	require.NoError(t, ioutil.WriteFile(ignitionFile, []byte(ignitionContents), 0644))
+	installDir := filepath.Join(dir, "k")
+
+	svcMgr := &fakeServiceManager{services: map[string]*fakeWindowsService{}}
+	wnb := winNodeBootstrapper{
+		installDir:       installDir,
+		kubeconfigPath:   filepath.Join(installDir, "kubeconfig"),
+		kubeletConfPath:  filepath.Join(installDir, "kubelet.conf"),
+		logDir:           filepath.Join(dir, "log"),
+		staticPodDir:     filepath.Join(installDir, "etc", "kubernetes", "manifests"),
+		ignitionFilePath: ignitionFile,
+		serviceMode:      ServiceModeEnsure,
+		services:         svcMgr,
+	}
+	// Set up the kubelet as a previous run would have
+	setup, err := wnb.generateKubeletSetup()
+	require.NoError(t, err, "error generating kubelet setup")
+	_, err = wnb.initializeKubeletFiles(setup)
+	require.NoError(t, err, "error initializing kubelet files")
+	require.Equal(t, []string{"HTTP_PROXY=http://proxy:3128"}, wnb.serviceEnv)
+	require.NoError(t, wnb.ensureKubeletService())
+	require.NoError(t, wnb.kubeletSVC.start())
+	service := svcMgr.services[KubeletServiceName]
+	service.starts = 0
+
+	// A new run reads the kubelet service and generates the kubelet configuration again
+	rerun := wnb
+	rerun.kubeletArgs = nil
+	rerun.serviceEnv = nil
+	rerun.checkAPIServer = true
+	derivations := 0
+	defer func(derive func(string) (string, error)) { deriveNodeName = derive }(deriveNodeName)
+	deriveNodeName = func(string) (string, error) {
+		derivations++
+		return "", nil
+	}
+	result, err := rerun.InitializeKubelet()
+	require.NoError(t, err)
+	assert.Equal(t, 1, derivations, "ignition not parsed exactly once")
+	assert.False(t, result.Changed, "kubelet unexpectedly changed")
+	assert.Zero(t, service.stops, "kubelet unexpectedly stopped")
+	assert.Zero(t, service.starts, "kubelet unexpectedly started")
+}
+
+// TestReconcileKubeletEnvironment tests that a drift of the kubelet service environment is reconciled by restarting
+// the kubelet with the new environment
+func TestReconcileKubeletEnvironment(t *testing.T) {
+	ignitionContents := `{"ignition":{"version":"3.1.0"},"storage":{"files":[{"path":"/etc/kubernetes/kubeconfig","contents":{"source":"data:,dummy-kubeconfig"},"mode":420},{"path":"/etc/kubernetes/kubelet-ca.crt","contents":{"source":"data:,dummy-ca"},"mode":420}]},"systemd":{"units":[{"contents":"[Unit]\nDescription=Kubernetes Kubelet\n\n[Service]\nEnvironment=HTTP_PROXY=http://proxy:3128\nExecStart=/usr/bin/hyperkube \\\n    kubelet \\\n      --config=/etc/kubernetes/kubelet.conf \\\n      --v=4\n","enabled":true,"name":"kubelet.service"}]}}`
+
+	dir, err := ioutil.TempDir("", "wmcb")
+	require.NoError(t, err, "error creating temp directory")
+	// Ignore the return error as there is not much we can do if the temporary directory is not deleted
+	defer os.RemoveAll(dir)
+	ignitionFile := filepath.Join(dir, "worker.ign")
+	require.NoError(t, ioutil.WriteFile(ignitionFile, []byte(ignitionContents), 0644))
+	installDir := filepath.Join(dir, "k")
+
+	svcMgr := &fakeServiceManager{services: map[string]*fakeWindowsService{}}
+	wnb := winNodeBootstrapper{
+		installDir:       installDir,
+		kubeconfigPath:   filepath.Join(installDir, "kubeconfig"),
+		kubeletConfPath:  filepath.Join(installDir, "kubelet.conf"),
+		logDir:           filepath.Join(dir, "log"),
+		staticPodDir:     filepath.Join(installDir, "etc", "kubernetes", "manifests"),
+		ignitionFilePath: ignitionFile,
+		services:         svcMgr,
+	}
+	// Set up a kubelet running without the environment of the ignition
+	setup, err := wnb.generateKubeletSetup()
+	require.NoError(t, err, "error generating kubelet setup")
+	_, err = wnb.initializeKubeletFiles(setup)
+	require.NoError(t, err, "error initializing kubelet files")
+	require.NoError(t, wnb.ensureKubeletService())
+	require.NoError(t, wnb.kubeletSVC.start())
+	require.NoError(t, svcMgr.SetServiceEnvironment(KubeletServiceName, nil))
+	service := svcMgr.services[KubeletServiceName]
+
+	changed, err := wnb.ReconcileKubelet()
+	require.NoError(t, err)
+	assert.True(t, changed, "environment drift not reconciled")
+	assert.Equal(t, []string{"HTTP_PROXY=http://proxy:3128"}, svcMgr.env[KubeletServiceName])
+	assert.Equal(t, 1, service.stops, "kubelet not restarted")
+	assert.Equal(t, svc.Running, service.state, "kubelet not running")
+
+	changed, err = wnb.ReconcileKubelet()
+	require.NoError(t, err)
+	assert.False(t, changed, "kubelet in sync reconciled")
+	assert.Equal(t, 1, service.stops, "kubelet in sync restarted")
+}
+
+// TestArchiveKubeletLog tests that an existing kubelet log is archived under a timestamped name
+func TestArchiveKubeletLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wmcb")
+	require.NoError(t, err, "error creating temp directory")
+	// Ignore the return error as there is not much we can do if the temporary directory is not deleted
+	defer os.RemoveAll(dir)
+	now := time.Date(2021, time.March, 4, 15, 30, 0, 0, time.UTC)
+
+	// There is nothing to archive on the first initialization
+	require.NoError(t, archiveKubeletLog(dir, now))
+
+	logFile := filepath.Join(dir, "kubelet.log")
+	require.NoError(t, ioutil.WriteFile(logFile, []byte("previous run"), 0644))
+	require.NoError(t, archiveKubeletLog(dir, now))
+	assert.NoFileExists(t, logFile, "kubelet log was not archived")
+	archived, err := ioutil.ReadFile(filepath.Join(dir, "kubelet.log.20210304T153000Z"))
+	require.NoError(t, err, "error reading archived kubelet log")
+	assert.Equal(t, "previous run", string(archived))
+}
+
 func TestKubeletDirectoriesCreation(t *testing.T) {
 	// Create a temp directory with wmcb prefix
 	dir, err := ioutil.TempDir("", "wmcb")
@@ -441,11 +2516,305 @@ func TestKubeletDirectoriesCreation(t *testing.T) {
 	// logDirectory which has to be created by wmcb
 	logDirectory := filepath.Join(dir, "log")
 	wnb := winNodeBootstrapper{
-		installDir: dir,
-		logDir:     logDirectory,
+		installDir:   dir,
+		logDir:       logDirectory,
+		staticPodDir: podManifestDirectory,
 	}
-	err = wnb.initializeKubeletFiles()
+	setup, err := wnb.generateKubeletSetup()
+	require.NoError(t, err, "error generating kubelet setup")
+	writtenFiles, err := wnb.initializeKubeletFiles(setup)
 	assert.NoError(t, err, "error initializing kubelet files")
 	assert.DirExists(t, podManifestDirectory, "pod manifest directory was not created")
 	assert.DirExists(t, logDirectory, "log directory was not created")
+	assert.Equal(t, []string{filepath.Join(dir, "kubelet.conf")}, writtenFiles)
+
+	// The kubelet must look for static pods in the created pod manifest directory
+	kubeletConfData, err := ioutil.ReadFile(filepath.Join(dir, "kubelet.conf"))
+	require.NoError(t, err, "error reading kubelet.conf")
+	var kubeletConfig struct {
+		StaticPodPath string `json:"staticPodPath"`
+	}
+	require.NoError(t, json.Unmarshal(kubeletConfData, &kubeletConfig), "error unmarshalling kubelet.conf")
+	assert.Equal(t, podManifestDirectory, kubeletConfig.StaticPodPath, "unexpected static pod path")
+}
+
+// parseIgnitionFileContents parses the ignition file contents gathering the required kubelet args, and writes the
+// contents of the described files, as initializeKubeletFiles does with the files of the generated setup
+func (wmcb *winNodeBootstrapper) parseIgnitionFileContents(ignitionFileContents []byte,
+	filesToTranslate map[string]fileTranslation) error {
+	translatedContents, err := wmcb.translateIgnition(ignitionFileContents, filesToTranslate)
+	if err != nil {
+		return err
+	}
+	for dest, contents := range translatedContents {
+		if err = ioutil.WriteFile(dest, contents, 0644); err != nil {
+			return fmt.Errorf("could not write to %s: %s", dest, err)
+		}
+	}
+	return nil
+}
+
+// fakeWindowsService is a Windows service holding its config and state in memory
+type fakeWindowsService struct {
+	config  mgr.Config
+	state   svc.State
+	deleted bool
+	// starts and stops count the times the service has been started and stopped
+	starts int
+	stops  int
+}
+
+func (f *fakeWindowsService) Config() (mgr.Config, error) {
+	return f.config, nil
+}
+
+func (f *fakeWindowsService) UpdateConfig(config mgr.Config) error {
+	f.config = config
+	return nil
+}
+
+func (f *fakeWindowsService) Start(...string) error {
+	f.state = svc.Running
+	f.starts++
+	return nil
+}
+
+func (f *fakeWindowsService) Control(cmd svc.Cmd) (svc.Status, error) {
+	if cmd == svc.Stop {
+		f.state = svc.Stopped
+		f.stops++
+	}
+	return svc.Status{State: f.state}, nil
+}
+
+func (f *fakeWindowsService) Query() (svc.Status, error) {
+	return svc.Status{State: f.state}, nil
+}
+
+func (f *fakeWindowsService) Delete() error {
+	f.deleted = true
+	return nil
+}
+
+func (f *fakeWindowsService) Close() error {
+	return nil
+}
+
+func (f *fakeWindowsService) SetRecoveryActions([]mgr.RecoveryAction, uint32) error {
+	return nil
+}
+
+// fakeServiceManager is a Windows service manager holding the services and their environment in memory
+type fakeServiceManager struct {
+	services map[string]*fakeWindowsService
+	env      map[string][]string
+}
+
+func (f *fakeServiceManager) CreateService(name, exePath string, config mgr.Config,
+	args ...string) (windowsService, error) {
+	config.BinaryPathName = strings.Join(append([]string{exePath}, args...), " ")
+	f.services[name] = &fakeWindowsService{config: config, state: svc.Stopped}
+	return f.services[name], nil
+}
+
+func (f *fakeServiceManager) OpenService(name string) (windowsService, error) {
+	service, ok := f.services[name]
+	if !ok || service.deleted {
+		return nil, fmt.Errorf("The specified service does not exist as an installed service.")
+	}
+	return service, nil
+}
+
+func (f *fakeServiceManager) ServiceEnvironment(name string) ([]string, error) {
+	return f.env[name], nil
+}
+
+func (f *fakeServiceManager) SetServiceEnvironment(name string, env []string) error {
+	if f.env == nil {
+		f.env = map[string][]string{}
+	}
+	if len(env) == 0 {
+		delete(f.env, name)
+		return nil
+	}
+	f.env[name] = env
+	return nil
+}
+
+// TestKubeletServiceLifecycle tests that the kubelet service is stopped and started through the service helpers
+func TestKubeletServiceLifecycle(t *testing.T) {
+	service := &fakeWindowsService{state: svc.Running}
+	ksvc, err := newKubeletService(service, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, ksvc.stop())
+	assert.Equal(t, svc.Stopped, service.state, "service not stopped")
+	running, err := ksvc.isRunning()
+	require.NoError(t, err)
+	assert.False(t, running)
+
+	require.NoError(t, ksvc.start())
+	assert.Equal(t, svc.Running, service.state, "service not started")
+
+	require.NoError(t, ksvc.stopAndRemove())
+	assert.True(t, service.deleted, "service not deleted")
+}
+
+// TestEnsureKubeletServiceEnvironment tests that the environment of the kubelet service is replaced, and removed once
+// the kubelet has no environment variables anymore, e.g. when the cluster proxy is removed
+func TestEnsureKubeletServiceEnvironment(t *testing.T) {
+	svcMgr := &fakeServiceManager{services: map[string]*fakeWindowsService{}}
+	wmcb := &winNodeBootstrapper{installDir: `C:\k`, services: svcMgr,
+		kubeletArgs: []string{"--config=C:\\k\\kubelet.conf"}}
+
+	wmcb.serviceEnv = []string{"HTTP_PROXY=http://proxy.example.com:3128", "NO_PROXY=.cluster.local"}
+	require.NoError(t, wmcb.ensureKubeletService())
+	assert.Equal(t, wmcb.serviceEnv, svcMgr.env[KubeletServiceName], "environment not set on creation")
+
+	wmcb.serviceEnv = []string{"HTTPS_PROXY=http://proxy.example.com:3128"}
+	require.NoError(t, wmcb.ensureKubeletService())
+	assert.Equal(t, wmcb.serviceEnv, svcMgr.env[KubeletServiceName], "environment not replaced on update")
+
+	wmcb.serviceEnv = nil
+	require.NoError(t, wmcb.ensureKubeletService())
+	assert.NotContains(t, svcMgr.env, KubeletServiceName, "stale environment left on the kubelet service")
+}
+
+// TestHybridOverlayService tests the lifecycle of the hybrid-overlay-node service
+func TestHybridOverlayService(t *testing.T) {
+	wantCommand := `C:\k\hybrid-overlay-node.exe --node=winworker-abcde --k8s-kubeconfig=C:\k\kubeconfig ` +
+		`--windows-service --logfile=` + filepath.Join(`C:\var\log\hybrid-overlay`, "hybrid-overlay.log") +
+		` --hybrid-overlay-vxlan-port=9898`
+	svcMgr := &fakeServiceManager{services: map[string]*fakeWindowsService{}}
+	hybridOverlay, err := newHybridOverlayService(svcMgr, `C:\k\hybrid-overlay-node.exe`, "winworker-abcde",
+		`C:\k\kubeconfig`, `C:\var\log\hybrid-overlay`, "9898")
+	require.NoError(t, err)
+
+	t.Run("create", func(t *testing.T) {
+		require.NoError(t, hybridOverlay.ensure())
+		service := svcMgr.services[HybridOverlayServiceName]
+		require.NotNil(t, service, "service not created")
+		assert.Equal(t, wantCommand, service.config.BinaryPathName)
+		assert.Equal(t, []string{KubeletServiceName}, service.config.Dependencies)
+		assert.Equal(t, svc.Running, service.state, "service not started")
+	})
+
+	t.Run("update", func(t *testing.T) {
+		service := svcMgr.services[HybridOverlayServiceName]
+		service.config.BinaryPathName = `C:\k\hybrid-overlay-node.exe --node=winworker-abcde`
+		service.config.Dependencies = nil
+		require.NoError(t, hybridOverlay.ensure())
+		assert.Equal(t, wantCommand, service.config.BinaryPathName)
+		assert.Equal(t, []string{KubeletServiceName}, service.config.Dependencies)
+		assert.Equal(t, svc.Running, service.state, "service not restarted")
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		service := svcMgr.services[HybridOverlayServiceName]
+		require.NoError(t, hybridOverlay.remove())
+		assert.Equal(t, svc.Stopped, service.state, "service not stopped")
+		assert.True(t, service.deleted, "service not deleted")
+	})
+
+	t.Run("remove missing", func(t *testing.T) {
+		assert.NoError(t, hybridOverlay.remove())
+	})
+
+	t.Run("invalid VXLAN port", func(t *testing.T) {
+		_, err := newHybridOverlayService(svcMgr, `C:\k\hybrid-overlay-node.exe`, "winworker-abcde",
+			`C:\k\kubeconfig`, `C:\var\log\hybrid-overlay`, "98980")
+		assert.Error(t, err)
+	})
+}
+
+// TestKubeProxyService tests the arguments and the lifecycle of the kube-proxy service
+func TestKubeProxyService(t *testing.T) {
+	tests := []struct {
+		name        string
+		nodeName    string
+		networkName string
+		sourceVIP   string
+		clusterCIDR string
+		wantArgs    string
+		wantErr     bool
+	}{
+		{
+			name:        "all arguments",
+			nodeName:    "winworker-abcde",
+			networkName: DefaultHNSNetworkName,
+			sourceVIP:   "10.132.0.2",
+			clusterCIDR: "10.128.0.0/14",
+			wantArgs: "--windows-service --proxy-mode=kernelspace --feature-gates=WinOverlay=true " +
+				`--hostname-override=winworker-abcde --kubeconfig=C:\k\kubeconfig --logtostderr=false ` +
+				`--log-dir=C:\var\log\kube-proxy --network-name=OVNKubernetesHybridOverlayNetwork ` +
+				"--source-vip=10.132.0.2 --enable-dsr=false --cluster-cidr=10.128.0.0/14",
+		},
+		{
+			name:        "no cluster CIDR",
+			nodeName:    "winworker-abcde",
+			networkName: DefaultHNSNetworkName,
+			sourceVIP:   "10.132.0.2",
+			wantArgs: "--windows-service --proxy-mode=kernelspace --feature-gates=WinOverlay=true " +
+				`--hostname-override=winworker-abcde --kubeconfig=C:\k\kubeconfig --logtostderr=false ` +
+				`--log-dir=C:\var\log\kube-proxy --network-name=OVNKubernetesHybridOverlayNetwork ` +
+				"--source-vip=10.132.0.2 --enable-dsr=false",
+		},
+		{
+			name:        "no node name",
+			networkName: DefaultHNSNetworkName,
+			sourceVIP:   "10.132.0.2",
+			wantErr:     true,
+		},
+		{
+			name:      "no network name",
+			nodeName:  "winworker-abcde",
+			sourceVIP: "10.132.0.2",
+			wantErr:   true,
+		},
+		{
+			name:        "invalid source VIP",
+			nodeName:    "winworker-abcde",
+			networkName: DefaultHNSNetworkName,
+			sourceVIP:   "10.132.0",
+			wantErr:     true,
+		},
+		{
+			name:        "invalid cluster CIDR",
+			nodeName:    "winworker-abcde",
+			networkName: DefaultHNSNetworkName,
+			sourceVIP:   "10.132.0.2",
+			clusterCIDR: "10.128.0.0",
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kubeProxy, err := newKubeProxyService(nil, `C:\k\kube-proxy.exe`, tt.nodeName, `C:\k\kubeconfig`,
+				`C:\var\log\kube-proxy`, tt.networkName, tt.sourceVIP, tt.clusterCIDR)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, `C:\k\kube-proxy.exe `+tt.wantArgs, kubeProxy.command())
+		})
+	}
+
+	t.Run("lifecycle", func(t *testing.T) {
+		svcMgr := &fakeServiceManager{services: map[string]*fakeWindowsService{}}
+		kubeProxy, err := newKubeProxyService(svcMgr, `C:\k\kube-proxy.exe`, "winworker-abcde", `C:\k\kubeconfig`,
+			`C:\var\log\kube-proxy`, DefaultHNSNetworkName, "10.132.0.2", "")
+		require.NoError(t, err)
+
+		require.NoError(t, kubeProxy.ensure())
+		service := svcMgr.services[KubeProxyServiceName]
+		require.NotNil(t, service, "service not created")
+		assert.Equal(t, kubeProxy.command(), service.config.BinaryPathName)
+		assert.Equal(t, []string{KubeletServiceName, HybridOverlayServiceName}, service.config.Dependencies)
+		assert.Equal(t, svc.Running, service.state, "service not started")
+
+		require.NoError(t, kubeProxy.remove())
+		assert.Equal(t, svc.Stopped, service.state, "service not stopped")
+		assert.True(t, service.deleted, "service not deleted")
+	})
 }
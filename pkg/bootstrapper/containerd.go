@@ -0,0 +1,53 @@
+package bootstrapper
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+
+	"github.com/coreos/go-semver/semver"
+)
+
+// containerdVersionRegex searches for the version in the output of `containerd --version`, e.g.
+// "containerd github.com/containerd/containerd v1.6.8 9cd3357b7fd7218e4aec3eae239db1f68a5a6ec6"
+var containerdVersionRegex = regexp.MustCompile(`\sv?(\d+\.\d+\.\d+\S*)`)
+
+// parseContainerdVersion returns the containerd version given in the output of `containerd --version`
+func parseContainerdVersion(output string) (*semver.Version, error) {
+	results := containerdVersionRegex.FindStringSubmatch(output)
+	if results == nil {
+		return nil, fmt.Errorf("could not find containerd version in %q", output)
+	}
+	version, err := semver.NewVersion(results[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid containerd version %s: %v", results[1], err)
+	}
+	return version, nil
+}
+
+// checkContainerdVersion returns an error if the containerd version given in the output of `containerd --version` is
+// older than the minimum version
+func checkContainerdVersion(output, minVersion string) error {
+	version, err := parseContainerdVersion(output)
+	if err != nil {
+		return err
+	}
+	min, err := semver.NewVersion(minVersion)
+	if err != nil {
+		return fmt.Errorf("invalid minimum containerd version %s: %v", minVersion, err)
+	}
+	if version.LessThan(*min) {
+		return fmt.Errorf("containerd version %s is older than the minimum supported version %s", version, min)
+	}
+	return nil
+}
+
+// ensureContainerdVersion runs the containerd binary at the given path to get its version, and returns an error if
+// it is older than the minimum version
+func ensureContainerdVersion(containerdPath, minVersion string) error {
+	output, err := exec.Command(containerdPath, "--version").Output()
+	if err != nil {
+		return fmt.Errorf("could not get version of %s: %v", containerdPath, err)
+	}
+	return checkContainerdVersion(string(output), minVersion)
+}
@@ -0,0 +1,47 @@
+package bootstrapper
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// dnsCheckTimeout is the maximum duration to wait for the cluster DNS server to answer the preflight query
+const dnsCheckTimeout = 5 * time.Second
+
+// checkDNSServer sends a DNS query for the root name servers to the DNS server at the given address, and returns an
+// error if no valid response is received within the timeout. Any response, including an error response, shows that
+// the server is reachable.
+func checkDNSServer(address string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("udp", address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	id := uint16(rand.Intn(1 << 16))
+	query := []byte{
+		// header: id, flags with recursion desired, one question, no answer, authority or additional records
+		byte(id >> 8), byte(id), 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// question: root name, type NS, class IN
+		0x00, 0x00, 0x02, 0x00, 0x01,
+	}
+	if _, err := conn.Write(query); err != nil {
+		return fmt.Errorf("could not send DNS query: %v", err)
+	}
+
+	response := make([]byte, 512)
+	n, err := conn.Read(response)
+	if err != nil {
+		return fmt.Errorf("no response to DNS query: %v", err)
+	}
+	// The response must echo the query id and have the QR bit set
+	if n < len(query) || response[0] != query[0] || response[1] != query[1] || response[2]&0x80 == 0 {
+		return fmt.Errorf("invalid response to DNS query")
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package bootstrapper
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// HybridOverlayServiceName is the name of the hybrid-overlay-node Windows service
+	HybridOverlayServiceName = kubeletDependentSvc
+	// hybridOverlayLogDirectory is where the hybrid-overlay-node logs are written, relative to the root of the install
+	// dir's drive
+	hybridOverlayLogDirectory = "\\var\\log\\hybrid-overlay"
+)
+
+// newHybridOverlayService returns the hybrid-overlay-node service, which sets up the OVN-Kubernetes hybrid overlay
+// network on the Windows node. It runs the given binary for the node with the given name, authenticating with the given
+// kubeconfig and logging to the given directory. The VXLAN port of the hybrid overlay network is the
+// hybrid-overlay-node default if vxlanPort is empty.
+func newHybridOverlayService(svcMgr serviceManager, binaryPath, nodeName, kubeconfigPath, logDir,
+	vxlanPort string) (*managedService, error) {
+	if nodeName == "" {
+		return nil, fmt.Errorf("node name must be set to configure %s", HybridOverlayServiceName)
+	}
+	args := []string{
+		"--node=" + nodeName,
+		"--k8s-kubeconfig=" + kubeconfigPath,
+		"--windows-service",
+		"--logfile=" + filepath.Join(logDir, "hybrid-overlay.log"),
+	}
+	if vxlanPort != "" {
+		if port, err := strconv.Atoi(vxlanPort); err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid VXLAN port %s, must be between 1 and 65535", vxlanPort)
+		}
+		args = append(args, "--hybrid-overlay-vxlan-port="+vxlanPort)
+	}
+	return &managedService{
+		svcMgr:     svcMgr,
+		name:       HybridOverlayServiceName,
+		binaryPath: binaryPath,
+		args:       args,
+		// hybrid-overlay-node watches the node object, so it requires the kubelet to have registered the node
+		dependencies: []string{KubeletServiceName},
+	}, nil
+}
@@ -18,14 +18,14 @@ const (
 
 // kubeletService struct contains the kubelet specific service information
 type kubeletService struct {
-	// obj is a pointer to the Windows service object
-	obj *mgr.Service
+	// obj is the Windows service object
+	obj windowsService
 	// dependents contains a list of services dependent on the current service
-	dependents []*mgr.Service
+	dependents []windowsService
 }
 
 // newKubeletService creates and returns a new kubeletService object
-func newKubeletService(ksvc *mgr.Service, dependents []*mgr.Service) (*kubeletService, error) {
+func newKubeletService(ksvc windowsService, dependents []windowsService) (*kubeletService, error) {
 	if ksvc == nil {
 		return nil, fmt.Errorf("service object should not be nil")
 	}
@@ -67,7 +67,7 @@ func (k *kubeletService) start() error {
 	for _, dependent := range k.dependents {
 		err := startService(dependent)
 		if err != nil {
-			return fmt.Errorf("failed to start dependent service %s", dependent.Name)
+			return fmt.Errorf("failed to start dependent service: %v", err)
 		}
 	}
 	return nil
@@ -75,23 +75,7 @@ func (k *kubeletService) start() error {
 
 // control sends a signal to the service and waits until it changes state in response to the signal
 func (k *kubeletService) control(cmd svc.Cmd, desiredState svc.State) error {
-	status, err := k.obj.Control(cmd)
-	if err != nil {
-		return err
-	}
-	// Most of the rest of the function borrowed from https://godoc.org/golang.org/x/sys/windows/svc/mgr#Service.Control
-	timeout := time.Now().Add(serviceWaitTime)
-	for status.State != desiredState {
-		if timeout.Before(time.Now()) {
-			return fmt.Errorf("timeout waiting for service to go to state=%d", desiredState)
-		}
-		time.Sleep(300 * time.Millisecond)
-		status, err = k.obj.Query()
-		if err != nil {
-			return fmt.Errorf("could not retrieve service status: %v", err)
-		}
-	}
-	return nil
+	return controlService(k.obj, cmd, desiredState)
 }
 
 // stop ensures that the kubelet service and its dependent services are stopped,
@@ -108,7 +92,7 @@ func (k *kubeletService) stop() error {
 	if len(k.dependents) != 0 {
 		for _, dependent := range k.dependents {
 			if err := stopService(dependent); err != nil {
-				return fmt.Errorf("failed to stop dependent service %s", dependent.Name)
+				return fmt.Errorf("failed to stop dependent service: %v", err)
 			}
 		}
 	}
@@ -134,7 +118,7 @@ func (k *kubeletService) refresh(config mgr.Config) error {
 		return fmt.Errorf("error starting kubelet service: %v", err)
 	}
 	// Wait for service to go to Running state
-	err := wait.Poll(svcPollInterval, svcRunTimeout, func() (done bool, err error) {
+	err := wait.PollImmediate(svcPollInterval, svcRunTimeout, func() (done bool, err error) {
 		isKubeletRunning, err := k.isRunning()
 		if err != nil {
 			return false, nil
@@ -150,11 +134,7 @@ func (k *kubeletService) refresh(config mgr.Config) error {
 
 // isRunning returns true if the kubelet service is running
 func (k *kubeletService) isRunning() (bool, error) {
-	status, err := k.obj.Query()
-	if err != nil {
-		return false, err
-	}
-	return status.State == svc.Running, nil
+	return isServiceRunning(k.obj)
 }
 
 // disconnect removes all connections to the Windows service svcMgr api, and allows services to be deleted
@@ -195,7 +175,7 @@ func (k *kubeletService) stopAndRemove() error {
 }
 
 // startService is a helper to start a given service
-func startService(serviceObj *mgr.Service) error {
+func startService(serviceObj windowsService) error {
 	if serviceObj == nil {
 		return fmt.Errorf("service object should not be nil")
 	}
@@ -213,7 +193,7 @@ func startService(serviceObj *mgr.Service) error {
 }
 
 // controlService is a helper to send control signal to a given service
-func controlService(serviceObj *mgr.Service, cmd svc.Cmd, desiredState svc.State) error {
+func controlService(serviceObj windowsService, cmd svc.Cmd, desiredState svc.State) error {
 	if serviceObj == nil {
 		return fmt.Errorf("service object should not be nil")
 	}
@@ -238,7 +218,7 @@ func controlService(serviceObj *mgr.Service, cmd svc.Cmd, desiredState svc.State
 }
 
 // stopService is a helper to stop a given service
-func stopService(serviceObj *mgr.Service) error {
+func stopService(serviceObj windowsService) error {
 	if serviceObj == nil {
 		return fmt.Errorf("service object should not be nil")
 	}
@@ -249,14 +229,14 @@ func stopService(serviceObj *mgr.Service) error {
 	if isServiceRunning {
 		err := controlService(serviceObj, svc.Stop, svc.Stopped)
 		if err != nil {
-			return fmt.Errorf("unable to stop %s service", serviceObj.Name)
+			return fmt.Errorf("unable to stop service: %v", err)
 		}
 	}
 	return nil
 }
 
 // isServiceRunning returns true if the given service is running
-func isServiceRunning(serviceObj *mgr.Service) (bool, error) {
+func isServiceRunning(serviceObj windowsService) (bool, error) {
 	if serviceObj == nil {
 		return false, fmt.Errorf("service object should not be nil")
 	}
@@ -0,0 +1,58 @@
+package bootstrapper
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	// KubeProxyServiceName is the name of the kube-proxy Windows service
+	KubeProxyServiceName = "kube-proxy"
+	// kubeProxyLogDirectory is where the kube-proxy logs are written, relative to the root of the install dir's drive
+	kubeProxyLogDirectory = "\\var\\log\\kube-proxy"
+	// DefaultHNSNetworkName is the name of the HNS network created by hybrid-overlay-node for the pods
+	DefaultHNSNetworkName = "OVNKubernetesHybridOverlayNetwork"
+)
+
+// newKubeProxyService returns the kube-proxy service, which programs the Services of the cluster into the given HNS
+// network. It runs the given binary for the node with the given name, authenticating with the given kubeconfig and
+// logging to the given directory. sourceVIP is the IP of the HNS endpoint the node uses to reach the pods over the
+// overlay network, and clusterCIDR, if set, is the CIDR of the pods of the cluster.
+func newKubeProxyService(svcMgr serviceManager, binaryPath, nodeName, kubeconfigPath, logDir, networkName,
+	sourceVIP, clusterCIDR string) (*managedService, error) {
+	if nodeName == "" {
+		return nil, fmt.Errorf("node name must be set to configure %s", KubeProxyServiceName)
+	}
+	if networkName == "" {
+		return nil, fmt.Errorf("HNS network name must be set to configure %s", KubeProxyServiceName)
+	}
+	if net.ParseIP(sourceVIP) == nil {
+		return nil, fmt.Errorf("invalid source VIP '%s', must be an IP", sourceVIP)
+	}
+	args := []string{
+		"--windows-service",
+		"--proxy-mode=kernelspace",
+		"--feature-gates=WinOverlay=true",
+		"--hostname-override=" + nodeName,
+		"--kubeconfig=" + kubeconfigPath,
+		"--logtostderr=false",
+		"--log-dir=" + logDir,
+		"--network-name=" + networkName,
+		"--source-vip=" + sourceVIP,
+		"--enable-dsr=false",
+	}
+	if clusterCIDR != "" {
+		if _, _, err := net.ParseCIDR(clusterCIDR); err != nil {
+			return nil, fmt.Errorf("invalid cluster CIDR %s: %v", clusterCIDR, err)
+		}
+		args = append(args, "--cluster-cidr="+clusterCIDR)
+	}
+	return &managedService{
+		svcMgr:     svcMgr,
+		name:       KubeProxyServiceName,
+		binaryPath: binaryPath,
+		args:       args,
+		// kube-proxy is stopped with the kubelet, and the HNS network it programs is created by hybrid-overlay-node
+		dependencies: []string{KubeletServiceName, HybridOverlayServiceName},
+	}, nil
+}
@@ -0,0 +1,52 @@
+package bootstrapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// machineConfigRoleLabel is the label holding the role of the nodes a MachineConfig applies to
+	machineConfigRoleLabel = "machineconfiguration.openshift.io/role"
+	// renderedWorkerPrefix is the name prefix of the rendered worker MachineConfigs, which are not labelled with a role
+	renderedWorkerPrefix = "rendered-worker-"
+)
+
+// machineConfig holds the fields of a MachineConfig needed to extract its ignition
+type machineConfig struct {
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name   string            `yaml:"name"`
+		Labels map[string]string `yaml:"labels"`
+	} `yaml:"metadata"`
+	Spec struct {
+		// Config is the ignition config embedded in the MachineConfig
+		Config map[string]interface{} `yaml:"config"`
+	} `yaml:"spec"`
+}
+
+// ignitionFromMachineConfig returns the ignition embedded in the given worker MachineConfig, in YAML or JSON
+func ignitionFromMachineConfig(contents []byte) ([]byte, error) {
+	var mc machineConfig
+	if err := yaml.Unmarshal(contents, &mc); err != nil {
+		return nil, fmt.Errorf("could not unmarshal MachineConfig: %v", err)
+	}
+	if mc.Kind != "MachineConfig" {
+		return nil, fmt.Errorf("expected a MachineConfig, got kind %q", mc.Kind)
+	}
+	if mc.Metadata.Labels[machineConfigRoleLabel] != "worker" &&
+		!strings.HasPrefix(mc.Metadata.Name, renderedWorkerPrefix) {
+		return nil, fmt.Errorf("MachineConfig %s is not a worker MachineConfig", mc.Metadata.Name)
+	}
+	if len(mc.Spec.Config) == 0 {
+		return nil, fmt.Errorf("MachineConfig %s has no ignition config", mc.Metadata.Name)
+	}
+	ignition, err := json.Marshal(mc.Spec.Config)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal ignition config of MachineConfig %s: %v", mc.Metadata.Name, err)
+	}
+	return ignition, nil
+}
@@ -0,0 +1,127 @@
+package bootstrapper
+
+import (
+	"fmt"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// servicesRegistryKey is the registry key holding the configuration of the Windows services
+const servicesRegistryKey = `SYSTEM\CurrentControlSet\Services\`
+
+var (
+	advapi32 = windows.NewLazySystemDLL("advapi32.dll")
+	// procRegSetValueExW is used to write registry values, which is not exposed by golang.org/x/sys/windows
+	procRegSetValueExW = advapi32.NewProc("RegSetValueExW")
+	// procRegDeleteValueW is used to delete registry values, which is not exposed by golang.org/x/sys/windows
+	procRegDeleteValueW = advapi32.NewProc("RegDeleteValueW")
+)
+
+// setServiceEnvironment sets the environment variables, given as KEY=value pairs, that the Windows service is started
+// with. The service control manager reads them from the Environment value of the service's registry key, which is
+// deleted if no environment variables are given.
+func setServiceEnvironment(serviceName string, env []string) error {
+	keyPath, err := windows.UTF16PtrFromString(servicesRegistryKey + serviceName)
+	if err != nil {
+		return err
+	}
+	var key windows.Handle
+	if err := windows.RegOpenKeyEx(windows.HKEY_LOCAL_MACHINE, keyPath, 0, windows.KEY_SET_VALUE,
+		&key); err != nil {
+		return fmt.Errorf("unable to open registry key of service %s: %v", serviceName, err)
+	}
+	defer windows.RegCloseKey(key)
+
+	valueName, err := windows.UTF16PtrFromString("Environment")
+	if err != nil {
+		return err
+	}
+	if len(env) == 0 {
+		ret, _, _ := procRegDeleteValueW.Call(uintptr(key), uintptr(unsafe.Pointer(valueName)))
+		// The value not existing means there is no environment to remove
+		if ret != 0 && syscall.Errno(ret) != windows.ERROR_FILE_NOT_FOUND {
+			return fmt.Errorf("unable to remove environment of service %s: %v", serviceName, syscall.Errno(ret))
+		}
+		return nil
+	}
+	data := multiStringValue(env)
+	ret, _, _ := procRegSetValueExW.Call(uintptr(key), uintptr(unsafe.Pointer(valueName)), 0,
+		uintptr(windows.REG_MULTI_SZ), uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)*2))
+	if ret != 0 {
+		return fmt.Errorf("unable to set environment of service %s: %v", serviceName, syscall.Errno(ret))
+	}
+	return nil
+}
+
+// serviceEnvironment returns the environment variables, as KEY=value pairs, that the Windows service is started with.
+// No environment variables are returned if the Environment value of the service's registry key is not set.
+func serviceEnvironment(serviceName string) ([]string, error) {
+	keyPath, err := windows.UTF16PtrFromString(servicesRegistryKey + serviceName)
+	if err != nil {
+		return nil, err
+	}
+	var key windows.Handle
+	if err := windows.RegOpenKeyEx(windows.HKEY_LOCAL_MACHINE, keyPath, 0, windows.KEY_QUERY_VALUE,
+		&key); err != nil {
+		return nil, fmt.Errorf("unable to open registry key of service %s: %v", serviceName, err)
+	}
+	defer windows.RegCloseKey(key)
+
+	valueName, err := windows.UTF16PtrFromString("Environment")
+	if err != nil {
+		return nil, err
+	}
+	// Query the size of the value first, to allocate a buffer large enough to hold it
+	var size uint32
+	if err := windows.RegQueryValueEx(key, valueName, nil, nil, nil, &size); err != nil {
+		if err == windows.ERROR_FILE_NOT_FOUND {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to read environment of service %s: %v", serviceName, err)
+	}
+	if size < 2 {
+		return nil, nil
+	}
+	data := make([]uint16, size/2)
+	var valueType uint32
+	if err := windows.RegQueryValueEx(key, valueName, nil, &valueType, (*byte)(unsafe.Pointer(&data[0])),
+		&size); err != nil {
+		return nil, fmt.Errorf("unable to read environment of service %s: %v", serviceName, err)
+	}
+	if valueType != windows.REG_MULTI_SZ {
+		return nil, fmt.Errorf("unexpected type %d of the environment of service %s", valueType, serviceName)
+	}
+	return parseMultiStringValue(data[:size/2]), nil
+}
+
+// multiStringValue encodes the given strings as a REG_MULTI_SZ registry value: a sequence of null terminated UTF-16
+// strings, terminated by an additional null character
+func multiStringValue(values []string) []uint16 {
+	var data []uint16
+	for _, value := range values {
+		data = append(data, utf16.Encode([]rune(value))...)
+		data = append(data, 0)
+	}
+	return append(data, 0)
+}
+
+// parseMultiStringValue decodes a REG_MULTI_SZ registry value into its strings. Empty strings are not part of a valid
+// REG_MULTI_SZ value, as an empty string terminates the sequence.
+func parseMultiStringValue(data []uint16) []string {
+	var values []string
+	start := 0
+	for i, c := range data {
+		if c != 0 {
+			continue
+		}
+		if i == start {
+			break
+		}
+		values = append(values, string(utf16.Decode(data[start:i])))
+		start = i + 1
+	}
+	return values
+}
@@ -0,0 +1,170 @@
+package bootstrapper
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// windowsService is the subset of the Windows service API used to manage a service, allowing it to be faked in tests
+type windowsService interface {
+	Config() (mgr.Config, error)
+	UpdateConfig(mgr.Config) error
+	Start(args ...string) error
+	Control(svc.Cmd) (svc.Status, error)
+	Query() (svc.Status, error)
+	Delete() error
+	Close() error
+	SetRecoveryActions(recoveryActions []mgr.RecoveryAction, resetPeriod uint32) error
+}
+
+// serviceManager is the subset of the Windows service manager API used to create and open services and to configure
+// their environment, allowing it to be faked in tests
+type serviceManager interface {
+	CreateService(name, exePath string, config mgr.Config, args ...string) (windowsService, error)
+	OpenService(name string) (windowsService, error)
+	// ServiceEnvironment returns the environment variables, as KEY=value pairs, the service is started with
+	ServiceEnvironment(name string) ([]string, error)
+	// SetServiceEnvironment sets the environment variables the service is started with, removing them if env is empty
+	SetServiceEnvironment(name string, env []string) error
+}
+
+// winServiceManager is the serviceManager of the Windows service manager
+type winServiceManager struct {
+	*mgr.Mgr
+}
+
+// CreateService creates a service with the given name, started with the given binary and args
+func (m winServiceManager) CreateService(name, exePath string, config mgr.Config, args ...string) (windowsService,
+	error) {
+	service, err := m.Mgr.CreateService(name, exePath, config, args...)
+	if err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// OpenService opens the service with the given name
+func (m winServiceManager) OpenService(name string) (windowsService, error) {
+	service, err := m.Mgr.OpenService(name)
+	if err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// ServiceEnvironment returns the environment variables of the service with the given name, read from the registry
+func (m winServiceManager) ServiceEnvironment(name string) ([]string, error) {
+	return serviceEnvironment(name)
+}
+
+// SetServiceEnvironment sets the environment variables of the service with the given name in the registry
+func (m winServiceManager) SetServiceEnvironment(name string, env []string) error {
+	return setServiceEnvironment(name, env)
+}
+
+// managedService manages a Windows service of a node component other than the kubelet, started with a fixed command
+type managedService struct {
+	svcMgr serviceManager
+	// name is the name of the service
+	name string
+	// binaryPath is the location of the binary of the service
+	binaryPath string
+	// args are the args the binary is started with
+	args []string
+	// dependencies are the names of the services the service depends on
+	dependencies []string
+}
+
+// config returns the desired config of the service
+func (s *managedService) config() mgr.Config {
+	return mgr.Config{
+		// StartAutomatic will start the service again if the node restarts
+		StartType:    mgr.StartAutomatic,
+		Dependencies: s.dependencies,
+		Description:  fmt.Sprintf("%s %s", managedServicePrefix, s.name),
+	}
+}
+
+// command returns the command of the service, used to populate the BinaryPathName of the service config
+func (s *managedService) command() string {
+	return strings.Join(append([]string{s.binaryPath}, s.args...), " ")
+}
+
+// open returns the service, or nil if it does not exist
+func (s *managedService) open() (windowsService, error) {
+	service, err := s.svcMgr.OpenService(s.name)
+	if err != nil {
+		if strings.Contains(err.Error(), "service does not exist") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error opening %s service: %v", s.name, err)
+	}
+	return service, nil
+}
+
+// ensure creates the service, or updates it if its config differs from the desired one, and
+// starts it
+func (s *managedService) ensure() error {
+	service, err := s.open()
+	if err != nil {
+		return err
+	}
+	if service == nil {
+		service, err = s.svcMgr.CreateService(s.name, s.binaryPath, s.config(), s.args...)
+		if err != nil {
+			return fmt.Errorf("failed to create %s service: %v", s.name, err)
+		}
+	} else if err = s.update(service); err != nil {
+		service.Close()
+		return err
+	}
+	defer service.Close()
+
+	if err = startService(service); err != nil {
+		return fmt.Errorf("failed to start %s service: %v", s.name, err)
+	}
+	return nil
+}
+
+// update stops the given service and updates its config, if it differs from the desired one
+func (s *managedService) update(service windowsService) error {
+	existingConfig, err := service.Config()
+	if err != nil {
+		return fmt.Errorf("error getting %s service config: %v", s.name, err)
+	}
+	desiredConfig := s.config()
+	// Quoting is ignored, as the service manager quotes the binary path on service creation
+	if strings.ReplaceAll(existingConfig.BinaryPathName, "\"", "") == s.command() &&
+		strings.Join(existingConfig.Dependencies, ",") == strings.Join(desiredConfig.Dependencies, ",") &&
+		existingConfig.StartType == desiredConfig.StartType {
+		return nil
+	}
+
+	if err = stopService(service); err != nil {
+		return fmt.Errorf("unable to stop %s service: %v", s.name, err)
+	}
+	existingConfig.BinaryPathName = s.command()
+	existingConfig.Dependencies = desiredConfig.Dependencies
+	existingConfig.StartType = desiredConfig.StartType
+	existingConfig.Description = desiredConfig.Description
+	if err = service.UpdateConfig(existingConfig); err != nil {
+		return fmt.Errorf("error updating %s service: %v", s.name, err)
+	}
+	return nil
+}
+
+// remove stops and removes the service, if it exists
+func (s *managedService) remove() error {
+	service, err := s.open()
+	if err != nil || service == nil {
+		return err
+	}
+	defer service.Close()
+	if err = stopService(service); err != nil {
+		return fmt.Errorf("unable to stop %s service: %v", s.name, err)
+	}
+	return service.Delete()
+}
@@ -0,0 +1,29 @@
+package cloud
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// azureMetadataHost is the address of the Azure instance metadata service
+var azureMetadataHost = "169.254.169.254"
+
+// getAzureMetadataName returns the lowercased name of the Azure VM from the instance metadata service. The VM name is
+// used rather than the computer name, which is truncated to 15 characters on Windows. An empty string is returned if
+// the metadata service is unreachable.
+func getAzureMetadataName() (string, error) {
+	// https://learn.microsoft.com/en-us/azure/virtual-machines/instance-metadata-service
+	req, err := http.NewRequest(http.MethodGet,
+		"http://"+azureMetadataHost+"/metadata/instance/compute/name?api-version=2021-02-01&format=text", nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to create Azure metadata request: %w", err)
+	}
+	req.Header.Set("Metadata", "true")
+
+	name, err := getMetadata(req, "Azure")
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(string(name)), nil
+}
@@ -1,21 +1,60 @@
 package cloud
 
 import (
+	"fmt"
+	"io"
+	"net/http"
 	"strings"
+	"time"
 )
 
 const (
-	awsPlatformType = "aws"
+	awsPlatformType       = "aws"
+	azurePlatformType     = "azure"
+	gcpPlatformType       = "gcp"
+	openStackPlatformType = "openstack"
+	vSpherePlatformType   = "vsphere"
+
+	// metadataTimeout is the maximum duration to wait for a metadata server to respond
+	metadataTimeout = 5 * time.Second
 )
 
-// GetKubeletHostnameOverride returns correct hostname for kubelet if it should
-// be overridden, or an empty string otherwise.
-func GetKubeletHostnameOverride(platformType string) (string, error) {
+// DeriveNodeName returns the node name expected by the CSR approver on the given platform, to be used as the kubelet
+// hostname override. An empty string is returned if the default hostname of the kubelet is to be used.
+func DeriveNodeName(platformType string) (string, error) {
 	platformType = strings.ToLower(platformType)
 	switch platformType {
 	case awsPlatformType:
 		return getAWSMetadataHostname()
+	case azurePlatformType:
+		return getAzureMetadataName()
+	case gcpPlatformType:
+		return getGCPMetadataHostname()
+	case openStackPlatformType:
+		return getOpenStackMetadataName()
+	case vSpherePlatformType:
+		return getVSphereHostname()
 	default:
 		return "", nil
 	}
 }
+
+// getMetadata sends the given request to a metadata server and returns the response body. An empty body is returned
+// if the metadata server is unreachable, which is the case when not running on the platform the server belongs to.
+func getMetadata(req *http.Request, platform string) ([]byte, error) {
+	client := &http.Client{Timeout: metadataTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, nil
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to retrieve the hostname from the %s instance: %s", platform, res.Status)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read hostname from the %s instance: %w", platform, err)
+	}
+	return body, nil
+}
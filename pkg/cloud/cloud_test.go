@@ -0,0 +1,109 @@
+package cloud
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDeriveNodeName tests that the node name is derived from the metadata source of each platform
+func TestDeriveNodeName(t *testing.T) {
+	// metadata mocks the metadata servers of all platforms, as they are distinguished by their paths
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			w.Write([]byte("token"))
+		case r.URL.Path == "/latest/meta-data/local-hostname":
+			w.Write([]byte("ip-10-0-1-2.ec2.internal"))
+		case r.URL.Path == "/metadata/instance/compute/name" && r.Header.Get("Metadata") == "true":
+			w.Write([]byte("WinC-Worker-EastUS21-abcde"))
+		case r.URL.Path == "/computeMetadata/v1/instance/hostname" && r.Header.Get("Metadata-Flavor") == "Google":
+			w.Write([]byte("winworker.c.project.internal"))
+		case r.URL.Path == "/openstack/latest/meta_data.json":
+			w.Write([]byte(`{"uuid":"d8e02d56-2648-49a3-bf97-6be8f1204f38","name":"WinC-Worker-0",` +
+				`"hostname":"winc-worker-0.novalocal"}`))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer metadata.Close()
+	host := strings.TrimPrefix(metadata.URL, "http://")
+
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", metadata.URL)
+	// Ensure the AWS config does not depend on the environment of the test host
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv(gcpMetadataHostEnv, host)
+	defer func(azureHost, openStackHost string) {
+		azureMetadataHost = azureHost
+		openStackMetadataHost = openStackHost
+	}(azureMetadataHost, openStackMetadataHost)
+	azureMetadataHost = host
+	openStackMetadataHost = host
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	// Nothing listens on the address of a closed server
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	tests := []struct {
+		name         string
+		platformType string
+		// gcpMetadataHost overrides the GCP metadata server host if set
+		gcpMetadataHost string
+		want            string
+	}{
+		{
+			name:         "AWS",
+			platformType: "AWS",
+			want:         "ip-10-0-1-2.ec2.internal",
+		},
+		{
+			name:         "Azure",
+			platformType: "Azure",
+			want:         "winc-worker-eastus21-abcde",
+		},
+		{
+			name:         "GCP",
+			platformType: "GCP",
+			want:         "winworker.c.project.internal",
+		},
+		{
+			name:            "GCP metadata server unreachable",
+			platformType:    "GCP",
+			gcpMetadataHost: strings.TrimPrefix(unreachable.URL, "http://"),
+			want:            "",
+		},
+		{
+			name:         "OpenStack",
+			platformType: "OpenStack",
+			want:         "winc-worker-0",
+		},
+		{
+			name:         "VSphere",
+			platformType: "VSphere",
+			want:         strings.ToLower(hostname),
+		},
+		{
+			name:         "None",
+			platformType: "None",
+			want:         "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.gcpMetadataHost != "" {
+				t.Setenv(gcpMetadataHostEnv, tt.gcpMetadataHost)
+			}
+			got, err := DeriveNodeName(tt.platformType)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
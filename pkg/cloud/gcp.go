@@ -0,0 +1,37 @@
+package cloud
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+)
+
+const (
+	// gcpMetadataHostEnv is the environment variable that can be used to override the GCP metadata server address,
+	// following the convention of the GCP client libraries
+	gcpMetadataHostEnv = "GCE_METADATA_HOST"
+	// gcpMetadataHost is the default address of the GCP metadata server
+	gcpMetadataHost = "metadata.google.internal"
+)
+
+// getGCPMetadataHostname returns the FQDN of the GCP instance from the metadata service. An empty string is returned
+// if the metadata service is unreachable.
+func getGCPMetadataHostname() (string, error) {
+	host := os.Getenv(gcpMetadataHostEnv)
+	if host == "" {
+		host = gcpMetadataHost
+	}
+
+	// https://cloud.google.com/compute/docs/metadata/default-metadata-values
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+"/computeMetadata/v1/instance/hostname", nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to create GCP metadata request: %w", err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	hostname, err := getMetadata(req, "GCP")
+	if err != nil {
+		return "", err
+	}
+	return string(hostname), nil
+}
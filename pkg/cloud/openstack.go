@@ -0,0 +1,35 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// openStackMetadataHost is the address of the OpenStack metadata service
+var openStackMetadataHost = "169.254.169.254"
+
+// getOpenStackMetadataName returns the lowercased name of the OpenStack instance from the metadata service, which is
+// the node name the OpenStack cloud provider resolves. An empty string is returned if the metadata service is
+// unreachable.
+func getOpenStackMetadataName() (string, error) {
+	// https://docs.openstack.org/nova/latest/user/metadata.html#metadata-openstack-format
+	req, err := http.NewRequest(http.MethodGet, "http://"+openStackMetadataHost+"/openstack/latest/meta_data.json",
+		nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to create OpenStack metadata request: %w", err)
+	}
+
+	contents, err := getMetadata(req, "OpenStack")
+	if err != nil || contents == nil {
+		return "", err
+	}
+	var metadata struct {
+		Name string `json:"name"`
+	}
+	if err = json.Unmarshal(contents, &metadata); err != nil {
+		return "", fmt.Errorf("cannot parse the metadata of the OpenStack instance: %w", err)
+	}
+	return strings.ToLower(metadata.Name), nil
+}
@@ -0,0 +1,17 @@
+package cloud
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// getVSphereHostname returns the guest hostname of the vSphere VM, lowercased to match the node name the vSphere
+// cloud provider resolves
+func getVSphereHostname() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("unable to retrieve the hostname of the vSphere VM: %w", err)
+	}
+	return strings.ToLower(hostname), nil
+}
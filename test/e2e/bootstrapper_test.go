@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -57,13 +58,21 @@ func TestBootstrapper(t *testing.T) {
 	}
 
 	t.Run("Uninstall kubelet without kubelet service present", testUninstallWithoutKubeletSvc)
+	kubeletExistedBeforeTest := svcExists(t, bootstrapper.KubeletServiceName)
 
 	// Run the bootstrapper, which will start the kubelet service
 	wmcb, err := bootstrapper.NewWinNodeBootstrapper(installDir, ignitionFilePath, kubeletPath, "", "", "",
 		platformType)
 	require.NoErrorf(t, err, "Could not create WinNodeBootstrapper: %s", err)
-	err = wmcb.InitializeKubelet()
-	assert.NoErrorf(t, err, "Could not run bootstrapper: %s", err)
+	result, err := wmcb.InitializeKubelet()
+	require.NoErrorf(t, err, "Could not run bootstrapper: %s", err)
+
+	t.Run("Bootstrap result reports the kubelet service creation", func(t *testing.T) {
+		assert.Equal(t, !kubeletExistedBeforeTest, result.ServiceCreated)
+		assert.True(t, result.Changed)
+		assert.NotEmpty(t, result.KubeletArgs)
+		assert.Contains(t, result.WrittenFiles, filepath.Join(installDir, "kubelet.conf"))
+	})
 
 	t.Run("Kubelet Windows service starts", func(t *testing.T) {
 		// Wait for the service to start
@@ -100,6 +109,23 @@ func TestBootstrapper(t *testing.T) {
 		require.NoError(t, err, "error getting Kubelet Config")
 		assert.Contains(t, config.Description, "OpenShift managed")
 	})
+	t.Run("Second run with identical inputs does not restart the kubelet", func(t *testing.T) {
+		processID, err := getSvcProcessID(bootstrapper.KubeletServiceName)
+		require.NoError(t, err, "Could not get kubelet process ID")
+		wmcb, err := bootstrapper.NewWinNodeBootstrapper(installDir, ignitionFilePath, kubeletPath, "", "", "",
+			platformType)
+		require.NoErrorf(t, err, "Could not create WinNodeBootstrapper: %s", err)
+		defer wmcb.Disconnect()
+		secondResult, err := wmcb.InitializeKubelet()
+		require.NoErrorf(t, err, "Could not run bootstrapper: %s", err)
+		assert.False(t, secondResult.ServiceCreated, "the existing kubelet service was not updated")
+		assert.False(t, secondResult.Changed, "the unchanged kubelet was reported as changed")
+		assert.Equal(t, result.KubeletArgs, secondResult.KubeletArgs)
+
+		secondProcessID, err := getSvcProcessID(bootstrapper.KubeletServiceName)
+		require.NoError(t, err, "Could not get kubelet process ID")
+		assert.Equal(t, processID, secondProcessID, "the kubelet was restarted")
+	})
 }
 
 // ensureIgnitionFileExists will create a generic ignition file if one is not provided on the node
@@ -186,6 +212,28 @@ func getSvcConfig(svcName string) (mgr.Config, error) {
 	return svcHandle.Config()
 }
 
+// getSvcProcessID returns the ID of the process of the Windows Service with the given name, which changes whenever the
+// service is restarted
+func getSvcProcessID(svcName string) (uint32, error) {
+	svcMgr, err := mgr.Connect()
+	if err != nil {
+		return 0, fmt.Errorf("could not connect to Windows SCM: %s", err)
+	}
+	defer svcMgr.Disconnect()
+
+	svcHandle, err := svcMgr.OpenService(svcName)
+	if err != nil {
+		return 0, err
+	}
+	defer svcHandle.Close()
+
+	status, err := svcHandle.Query()
+	if err != nil {
+		return 0, err
+	}
+	return status.ProcessId, nil
+}
+
 // removeFileIfExists removes the file given by 'path', and will not throw an error if it does not exist
 func removeFileIfExists(t *testing.T, path string) {
 	err := os.Remove(path)